@@ -1,5 +1,7 @@
 package consts
 
+import "time"
+
 // =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
 // =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
 //  CONSTANT VARIABLE SETS
@@ -13,5 +15,98 @@ var PrintByte string = "MB"
 var Factor int64 = 50
 var DirPath string = "./lib/filesys"
 var LocalPath string = "/local/"
+var StorePath string = "/store"         // content addressed segment store, under DirPath
+var CatalogPath string = "/catalog.log" // catalog of locally held files and segments, under DirPath
 var VersionNum string = "1.0"
 var Builders string = "Ito Alcuaz, Abrar Musa, Shariq Aziz & Mimi Ko"
+
+// Kademlia overlay parameters
+var KademliaK int = 20    // bucket size and replication factor
+var KademliaAlpha int = 3 // parallel requests per lookup round
+var KademliaTimeout time.Duration = 3 * time.Second
+var KademliaRefresh time.Duration = 10 * time.Minute
+
+// SWIM membership parameters
+var SwimPeriod time.Duration = 1 * time.Second            // protocol period, one probe per period
+var SwimAckTimeout time.Duration = 300 * time.Millisecond // direct ping timeout before probing indirectly
+var SwimSuspectTimeout time.Duration = 5 * time.Second    // time a suspicion has to be refuted before the member is declared dead
+var SwimIndirect int = 3                                  // members asked to probe indirectly
+var SwimRetransmit int = 3                                // an update is piggybacked SwimRetransmit * log(n+1) times
+var SwimMaxPiggyback int = 16                             // max updates per message
+var SwimDeadExpiry time.Duration = time.Minute            // time dead and left members are remembered before they are forgotten
+
+// Quorum parameters of the chordRPC key value store
+var ReplicationN int = 3 // replicas per key, the owner and its successors
+var ReadQuorum int = 2
+var WriteQuorum int = 2
+var QuorumTimeout time.Duration = 3 * time.Second
+
+// How often replicas compare Merkle trees of the key ranges they share
+var AntiEntropyInterval time.Duration = 10 * time.Second
+
+// Durability of the chordRPC log store: fsync policy (always, interval or never) and compaction thresholds
+var KVSync string = "interval"
+var KVSyncInterval time.Duration = time.Second
+var KVCompactRatio float64 = 0.5
+var KVCompactMinSize int64 = 4 << 20
+
+// Disk budget of a node's segments in bytes (0 for no limit) and the order cached segments are evicted in when it
+// runs out (lru or popularity)
+var QuotaBytes int64 = 0
+var EvictionPolicy string = "lru"
+
+// How often nodes look for unpublished videos and reclaim unreferenced segments, and how old unreferenced data
+// has to be before it is reclaimed
+var GCInterval time.Duration = 5 * time.Minute
+var GCGrace time.Duration = 10 * time.Minute
+
+// Bytes of hot segments a node keeps in memory, segments are read from its store otherwise
+var SegmentCacheBytes int64 = 64 << 20
+
+// Downloads in progress, under DirPath, and how many segments are fetched between two writes of a download's
+// progress. Segments fetched after the last write are found in the store when the download is resumed.
+var DownloadsPath string = "/downloads.log"
+var DownloadCheckpoint int = 16
+
+// How often the first holder of a group of erasure coded shards checks the group and restores lost shards
+var RepairInterval time.Duration = time.Minute
+
+// Files shared by this node and how far their sharing got, under DirPath, and how often the -watch directory is
+// checked for new videos
+var PublishPath string = "/publish.log"
+var WatchInterval time.Duration = 5 * time.Second
+
+// Segment requests a downloading node keeps in flight per peer, how long a request may take before its segment is
+// requested from another peer, and how many requests in a row a peer may fail before it is dropped from a download
+var SwarmInFlight int = 2
+var SwarmTimeout time.Duration = 20 * time.Second
+var SwarmMaxFailures int = 3
+
+// Stripes whose holders a downloading node looks up before its swarm starts. The holders of the other stripes are
+// looked up while the swarm runs, this many at a time.
+var SwarmLookahead int = 4
+
+// Frames of an encrypted video the controller decrypts ahead of the player
+var DecryptAhead int = 100
+
+// Streaming servers keeping the manifest of a video on the chord overlay of the controller (customChord)
+var ManifestCopies int = 3
+
+// Stripes (or erasure coded groups) of a video whose holders are asked when its seeders are counted for a search
+var SeederSample int = 8
+
+// How often a downloading node announces the segments it stored to its swarm (HAVE), and how long nodes list a
+// downloading node to others after its last announcement
+var HaveInterval time.Duration = time.Second
+var DownloaderExpiry time.Duration = time.Minute
+
+// Segment uploads a node runs at once before it serves only the peers it unchoked, how often it decides which peers
+// to unchoke, and for how many decisions an optimistic unchoke lasts
+var UploadSlots int = 4
+var ChokeInterval time.Duration = 10 * time.Second
+var OptimisticRounds int = 3
+
+// How long a node waits before it asks a holder that choked it again, outside a swarm. The wait doubles with every
+// refusal, up to ChokeInterval, and the request is given up after ChokeRetries refusals.
+var ChokeBackoff time.Duration = time.Second
+var ChokeRetries int = 5
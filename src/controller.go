@@ -1,11 +1,20 @@
 package main
 
 import (
+	"./consts"
+	"./lib/crypt"
 	"./lib/customChord"
+	"./lib/kademlia"
+	"./lib/manifest"
+	"./lib/membership"
+	"./lib/search"
 	"./lib/streamerClient"
 	"./lib/streamerServer"
 	//"./lib/transfer"
-	//"./lib/utility"
+	"./lib/utility"
+	"./lib/watch"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -13,13 +22,42 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	//"runtime"
 )
 
 var name string
 var ftAddr string
-var streamingServerAddress string
+var streamingServerAddress string // advertised streaming server address
+var defaultFramesPerNode = int64(200) // frames each node holds of a shared video without cluster membership
+
+var chordAdvertise = flag.String("chord-advertise", "", "address (host or host:port) peers use to reach this chord node")
+var streamAdvertise = flag.String("stream-advertise", "", "address (host or host:port) peers use to reach the streamer server")
+var clientAdvertise = flag.String("client-advertise", "", "address (host or host:port) streaming nodes send udp streams to")
+var gossipBind = flag.String("gossip", "", "udp address for the cluster membership service, disabled when empty")
+var gossipAdvertise = flag.String("gossip-advertise", "", "address (host or host:port) peers use to reach the membership service")
+var gossipSeed = flag.String("gossip-seed", "", "membership address of a known node, defaults to -gossip (first node)")
+var capacity = flag.Int64("capacity", 0, "storage capacity in bytes advertised to the cluster and used as the frame storage quota, unlimited when 0")
+var eviction = flag.String("eviction", "lru", "order backup frames are evicted in when the quota runs out: lru or popularity")
+var unpublishFile = flag.String("unpublish", "", "remove a shared video from every node that holds its frames, then continue as usual")
+var encrypt = flag.Bool("encrypt", false, "encrypt the frames of the shared video with a key of its own, viewers stream it with the printed share link")
+var searchQuery = flag.String("search", "", "list the published videos matching these words, then continue as usual")
+
+// how often the rest of a part is placed under another key when nodes refuse its frames
+var maxPlacements = 3
+var overlay = flag.String("overlay", "chord", "dht used for frame placement and streaming server discovery: chord (customChord) or kademlia")
+
+// placement and discovery functions of the selected overlay
+var getTransferFileSegmentAddr func(string) string
+var getStreamingServer func(string) string
+var publishManifest func(string, []byte)
+var fetchManifest func(string) ([]byte, error)
+
+// keyword index of the published videos, kept next to the manifests
+var index *search.Index
+
+var sharing sync.Mutex // one video is shared at a time
 
 type VidFrames struct {
 	Name        string
@@ -45,6 +83,398 @@ func frameToBytesArray(folderName string) map[string][]byte {
 	return frameBytesMap
 }
 
+/*
+	Returns an rpc handler for the streaming server responsible for key, waiting until the overlay knows one
+*/
+func getStreamingHandler(key string) *rpc.Client {
+	addr := ""
+	for addr == "" {
+		log.Printf("Attempting to get stream server in 2 seconds...")
+		time.Sleep(2 * time.Second)
+		addr = getStreamingServer(key)
+	}
+	var handler *rpc.Client
+	for handler == nil {
+		handler = streamerClient.GetRpcHandler(addr)
+		if handler != nil {
+			break
+		}
+		log.Printf("Attempting to get rpc handler in 2 seconds...")
+		time.Sleep(2 * time.Second)
+	}
+	return handler
+}
+
+/*
+	Returns the keys of the streaming servers keeping a manifest on the chord overlay: the manifest's key
+	followed by keys derived from it, which usually belong to other nodes
+*/
+func manifestCopies(key string) []string {
+	keys := []string{key}
+	for i := 1; i < consts.ManifestCopies; i++ {
+		keys = append(keys, key+"#"+strconv.Itoa(i))
+	}
+	return keys
+}
+
+/*
+	Returns the parts of a video shared before manifests were published. Without cluster membership each node
+	took defaultFramesPerNode frames and the last one the rest, so every part holds at least as many frames, unless
+	the video is shorter. The parts are found by asking the server of each part for its last of those frames.
+*/
+func legacyStripes(video string) []manifest.Stripe {
+	var stripes []manifest.Stripe
+	for i := int64(0); ; i++ {
+		first, last := i*defaultFramesPerNode+1, (i+1)*defaultFramesPerNode
+		stripe := manifest.Stripe{Key: video + " " + strconv.FormatInt(i, 10), First: first, Last: last}
+		handler := getStreamingHandler(stripe.Key)
+		_, err := streamerClient.FetchFrame(handler, video+" "+fmt.Sprintf("%05d.png", last))
+		if err != nil && i == 0 {
+			_, err = streamerClient.FetchFrame(handler, video+" "+fmt.Sprintf("%05d.png", first))
+		}
+		handler.Close()
+		if err != nil {
+			return stripes
+		}
+		stripes = append(stripes, stripe)
+	}
+}
+
+/*
+	Returns an rpc handler for the streaming server holding a part: the server the publisher kept it on, or else the
+	server responsible for the part's key
+*/
+func stripeHandler(stripe manifest.Stripe) *rpc.Client {
+	if stripe.Holder == "" {
+		return getStreamingHandler(stripe.Key)
+	}
+	handler := streamerClient.GetRpcHandler(stripe.Holder)
+	for handler == nil {
+		log.Printf("Attempting to get rpc handler in 2 seconds...")
+		time.Sleep(2 * time.Second)
+		handler = streamerClient.GetRpcHandler(stripe.Holder)
+	}
+	return handler
+}
+
+/*
+	Removes a shared video from the network: the manifest is replaced by a tombstone and the node holding each
+	part deletes its frames, then tells its neighbours to drop their backups.
+*/
+func unpublish(fname string) {
+	data, err := fetchManifest(manifest.Key(fname))
+	if err != nil {
+		fmt.Println("Unable to unpublish " + fname + ": " + err.Error())
+		return
+	}
+	m, err := manifest.Decode(data)
+	checkError(err)
+	tombstone, err := manifest.Encode(manifest.Tombstone(fname))
+	checkError(err)
+	publishManifest(manifest.Key(fname), tombstone)
+	// streaming servers name the frames after the video alone, checkTombstones looks the tombstone up by that name
+	if video := strings.Split(fname, ".")[0]; video != fname {
+		publishManifest(manifest.Key(video), tombstone)
+	}
+	if err = index.Remove(m); err != nil {
+		log.Printf("Unable to remove %s from the search index: %v", fname, err)
+	}
+	for _, stripe := range m.Stripes {
+		handler := stripeHandler(stripe)
+		if err := streamerClient.DeleteVideo(handler, fname); err != nil {
+			log.Printf("Unable to delete part %s: %v", stripe.Key, err)
+		}
+		handler.Close()
+	}
+	// the frames extracted when the video was shared
+	checkError(streamerServer.RemoveVideo(strings.Split(fname, ".")[0]))
+	fmt.Println("Unpublished " + fname)
+}
+
+/*
+	Periodically deletes the frames of videos that were unpublished while this node was unreachable
+*/
+func checkTombstones() {
+	for {
+		time.Sleep(consts.GCInterval)
+		err := streamerServer.RemoveUnpublished(func(video string) time.Time {
+			data, err := fetchManifest(manifest.Key(video))
+			if err != nil {
+				return time.Time{}
+			}
+			m, err := manifest.Decode(data)
+			if err != nil || !m.Deleted {
+				return time.Time{}
+			}
+			return time.Unix(m.DeletedAt, 0)
+		})
+		if err != nil {
+			log.Printf("Unable to check for unpublished videos: %v", err)
+		}
+	}
+}
+
+/*
+	Prints the published videos whose title and metadata contain every word of query
+*/
+func searchVideos(query string) {
+	results, err := index.Search(query)
+	checkError(err)
+	for _, r := range results {
+		line := fmt.Sprintf("%s: %d bytes, %.1fs, %d seeders", r.Name, r.Size, r.Duration, r.Seeders)
+		if r.Encrypted {
+			line += ", encrypted"
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("%d videos found\n", len(results))
+}
+
+/*
+	Counts the streaming servers holding parts of a video
+*/
+func countStreamers(m manifest.Manifest) int {
+	servers := make(map[string]bool)
+	for _, stripe := range m.Stripes {
+		addr := stripe.Holder
+		if addr == "" {
+			addr = getStreamingServer(stripe.Key)
+		}
+		if addr != "" {
+			servers[addr] = true
+		}
+	}
+	streamers := 0
+	for addr := range servers {
+		if holds, _ := streamerClient.HoldsVideo(addr, m.Name); holds {
+			streamers++
+		}
+	}
+	return streamers
+}
+
+/*
+	Streams an encrypted video. The servers only hold sealed frames, so the frames of every part are fetched and
+	decrypted here while this node's player plays the ones decrypted before. Frames that can't be fetched or
+	decrypted are skipped.
+*/
+func streamEncrypted(m manifest.Manifest, key []byte, addr string) {
+	video := strings.Split(m.Name, ".")[0]
+	frames := make(chan []byte, consts.DecryptAhead)
+	go func() {
+		defer close(frames)
+		decrypted, skipped := 0, 0
+		for _, stripe := range m.Stripes {
+			handler := stripeHandler(stripe)
+			for j := stripe.First; j <= stripe.Last; j++ {
+				data, err := streamerClient.FetchFrame(handler, video+" "+fmt.Sprintf("%05d.png", j))
+				if err == nil {
+					// fails for frames that were tampered with or swapped
+					data, err = crypt.Open(key, video, int(j), data)
+				}
+				if err != nil {
+					log.Printf("Skipping frame %d of %s: %v", j, m.Name, err)
+					skipped++
+					continue
+				}
+				frames <- data
+				decrypted++
+			}
+			handler.Close()
+		}
+		log.Printf("Decrypted %d frames of %s, %d skipped", decrypted, m.Name, skipped)
+	}()
+	if err := streamerClient.StreamFrames(frames, addr); err != nil {
+		log.Printf("Unable to stream %s: %v", m.Name, err)
+	}
+}
+
+/*
+* Extracts the frames of a video of FFMPEG/NodesData/<name>/source, places them on the nodes responsible for its
+* parts and publishes the manifest
+*/
+func share(shareFile string) error {
+	sharing.Lock()
+	defer sharing.Unlock()
+	totalSegments, err := streamerServer.GetFrames(shareFile)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Total number of extracted frames from %s: %d\n", shareFile, totalSegments)
+	// storage nodes only get the sealed frames, the key is only in the share link
+	var videoKey []byte
+	if *encrypt {
+		if videoKey, err = crypt.NewKey(); err != nil {
+			return err
+		}
+		if err = streamerServer.EncryptVideo(strings.Split(shareFile, ".")[0], videoKey); err != nil {
+			return err
+		}
+	}
+
+	// Calculate number of nodes to distribute on. Without cluster membership each node holds roughly 200 frames,
+	// otherwise the frames are spread over every live node
+	framesPerNode := defaultFramesPerNode
+	totalNodes := totalSegments / framesPerNode
+	if *gossipBind != "" {
+		membership.PrintMembers()
+		totalNodes = int64(membership.LiveCount())
+		framesPerNode = (totalSegments + totalNodes - 1) / totalNodes
+	}
+	if totalNodes < 1 {
+		totalNodes = 1
+	}
+	fmt.Println("Total number of nodes this file will be distributed on: ", totalNodes)
+	fnArr := strings.Split(shareFile, ".")
+
+	// Get all the byte arrays for this file
+	frameBytesArr := frameToBytesArray(fnArr[0])
+
+	var fileNodes = make([]string, totalNodes)
+	var stripes []manifest.Stripe
+	var placed []manifest.Stripe // parts other nodes took, dropped from this node once published
+
+	for i := 0; i < int(totalNodes); i++ {
+		filenameWithNodeSegment := fnArr[0] + " " + strconv.FormatInt(int64(i), 10)
+		fileNodes[i] = getTransferFileSegmentAddr(filenameWithNodeSegment)
+		fmt.Println("Address of file node to transfer: ", fileNodes[i])
+
+		// transfer framesPerNode frames
+		// filename := fmt.Sprintf("%05d.png", int64(i))
+		//seqNum := fmt.Sprintf("%d", int64(i+1))
+		fn := fnArr[0] + " " + strconv.FormatInt(int64(i), 10)
+		var addr string
+		holder := ""
+
+		for addr == "" {
+			log.Printf("Attempting to get ft server in 2 seconds...")
+			time.Sleep(2 * time.Second)
+			addr = getStreamingServer(fn)
+		}
+		fmt.Printf("File %s to be transferred to %s\n", fn, addr)
+
+		var limit int
+		if limit = i*int(framesPerNode) + int(framesPerNode) + 1; i == int(totalNodes)-1 {
+			limit = int(totalSegments) + 1
+		}
+		first := i*int(framesPerNode) + 1
+
+		if addr != streamingServerAddress {
+			var handler *rpc.Client
+			for handler == nil {
+				handler = streamerClient.GetRpcHandler(addr)
+				if handler != nil {
+					break
+				}
+				log.Printf("Attempting to get rpc handler for ft in 2 seconds...")
+				time.Sleep(2 * time.Second)
+			}
+			attempt := 0
+			for j := first; j < limit && addr != streamingServerAddress; j++ {
+				filename := fmt.Sprintf("%05d.png", int64(j))
+				folderFilePath := fnArr[0] + " " + filename
+				//fmt.Println("Saving to server...")
+				err := streamerClient.SaveToServer(handler, name, folderFilePath, frameBytesArr[filename], ftAddr)
+				if err == nil {
+					continue
+				}
+				// the node is out of space, the rest of the part goes to the node responsible for another key
+				attempt++
+				log.Printf("Frame %s refused by %s: %v", folderFilePath, addr, err)
+				handler.Close()
+				if j > first {
+					stripes = append(stripes, manifest.Stripe{Key: fn, First: int64(first), Last: int64(j - 1)})
+					placed = append(placed, stripes[len(stripes)-1])
+				}
+				first = j
+				if attempt > maxPlacements {
+					// refused everywhere, the rest of the part stays on this node
+					log.Printf("Frames %d to %d of %s refused by %d nodes, keeping them on this node", first, limit-1, shareFile, attempt)
+					addr, holder = streamingServerAddress, streamingServerAddress
+					break
+				}
+				fn = fnArr[0] + " " + strconv.FormatInt(int64(i), 10) + "#" + strconv.Itoa(attempt)
+				addr = ""
+				for addr == "" {
+					log.Printf("Attempting to get ft server in 2 seconds...")
+					time.Sleep(2 * time.Second)
+					addr = getStreamingServer(fn)
+				}
+				fmt.Printf("Rest of part %d to be transferred to %s\n", i, addr)
+				if addr != streamingServerAddress {
+					handler = getStreamingHandler(fn)
+				}
+				j--
+			}
+			if addr != streamingServerAddress {
+				handler.Close()
+			}
+		} else {
+			fmt.Println("Already saved in this node")
+		}
+		stripe := manifest.Stripe{Key: fn, First: int64(first), Last: int64(limit - 1), Holder: holder}
+		if addr == streamingServerAddress {
+			if err := streamerServer.KeepFrames(fnArr[0], first, limit-1); err != nil {
+				log.Printf("Frames %d to %d of %s kept beyond the storage quota: %v", first, limit-1, shareFile, err)
+			}
+		} else {
+			placed = append(placed, stripe)
+		}
+		stripes = append(stripes, stripe)
+	}
+
+	// publish the manifest so that readers find the frames without knowing how they were striped
+	hashes, err := streamerServer.FrameHashes(fnArr[0], totalSegments)
+	if err != nil {
+		return err
+	}
+	m := manifest.Manifest{Name: shareFile, SegNums: totalSegments, Hashes: hashes, Stripes: stripes, Encrypted: videoKey != nil}
+	source := "FFMPEG/NodesData/" + name + "/source/" + shareFile
+	if info, err := os.Stat(source); err == nil {
+		m.Size = info.Size()
+	}
+	m.Duration, m.FrameRate, m.Codec, err = manifest.Probe(source)
+	if err != nil {
+		log.Println("No media info for "+shareFile+": ", err)
+	}
+	data, err := manifest.Encode(m)
+	if err != nil {
+		return err
+	}
+	publishManifest(manifest.Key(shareFile), data)
+	if err = index.Add(m); err != nil {
+		log.Println("Unable to index "+shareFile+" for search: ", err)
+	}
+	if m.Encrypted {
+		fmt.Println("Share link for viewers of " + shareFile + ": " + crypt.Link(shareFile, videoKey))
+	}
+	for _, stripe := range placed {
+		if err = streamerServer.DropFrames(fnArr[0], int(stripe.First), int(stripe.Last)); err != nil {
+			log.Printf("Unable to drop frames %d to %d of %s: %v", stripe.First, stripe.Last, shareFile, err)
+		}
+	}
+	return nil
+}
+
+/*
+* Shares the videos copied into FFMPEG/NodesData/<name>/source, and shares them again when they change. Videos
+* published before with the same size are skipped.
+*/
+func watchSource() {
+	dir := "FFMPEG/NodesData/" + name + "/source"
+	log.Printf("Watching %s for videos to share", dir)
+	watch.New(dir, consts.WatchInterval, watch.Videos).Run(func(path string, info os.FileInfo) {
+		if data, err := fetchManifest(manifest.Key(info.Name())); err == nil {
+			if m, err := manifest.Decode(data); err == nil && !m.Deleted && m.Size == info.Size() {
+				return
+			}
+		}
+		if err := share(info.Name()); err != nil {
+			log.Printf("Unable to share %s: %v", info.Name(), err)
+		}
+	})
+}
+
 func contains(s []string, e string) bool {
 	for _, a := range s {
 		if a == e {
@@ -58,130 +488,180 @@ func contains(s []string, e string) bool {
 	1. my upd address
 	2. starter node udp address
 
-	3. udp address of where im going to be listening for udp streams
-	4. my streamerServer address
+	3. my streamerServer address
+	4. udp address of where im going to be listening for udp streams
 
 	5. node name used for streamer server
+
+	All addresses are bind addresses. Use the -chord-advertise, -stream-advertise and -client-advertise flags
+	when peers have to reach this node through a different host/ip.
 */
 func main() {
 
 	//runtime.GOMAXPROCS(4)
 
-	thisAddr := os.Args[1]
-	startNodeAddr := os.Args[2]
-	streamingServerAddress = os.Args[3]
-	streamingClientAddress := "udp://127.0.0.1" + os.Args[4]
-	name = os.Args[5]
+	flag.Parse()
+	if flag.NArg() < 5 {
+		fmt.Println("Usage: go run controller.go [-overlay chord|kademlia] [-gossip addr [-gossip-seed addr] [-capacity bytes]] [-eviction lru|popularity] [-unpublish file] [-encrypt] [-chord-advertise host[:port]] [-stream-advertise host[:port]] [-client-advertise host[:port]] <udpAddress> <starterNodeAddress> <streamerServerAddress> <streamClientAddress> <nodeName>")
+		os.Exit(-1)
+	}
+	thisAddr := flag.Arg(0)
+	startNodeAddr := flag.Arg(1)
+	streamingServerBind := flag.Arg(2)
+	streamingClientBind := flag.Arg(3)
+	name = flag.Arg(4)
 	//ftAddr = os.Args[6]
 
+	streamingServerAddress = utility.AdvertiseAddr(streamingServerBind, *streamAdvertise)
+	streamingClientAddress := "udp://" + utility.AdvertiseAddr(streamingClientBind, *clientAdvertise)
+
 	//_ = transfer.Initialize(ftAddr, name)
+	if *eviction != "lru" && *eviction != "popularity" {
+		fmt.Println("Unknown eviction policy " + *eviction + ". Use lru or popularity")
+		os.Exit(-1)
+	}
+	streamerServer.SetQuota(*capacity, *eviction)
 
-	go customChord.Start(thisAddr, startNodeAddr, streamingServerAddress, streamingClientAddress, ftAddr, name)
-	go streamerClient.ListenForStream(streamingClientAddress)
-	go streamerServer.Start(streamingServerAddress, name)
+	switch *overlay {
+	case "chord", "customchord":
+		go customChord.Start(thisAddr, *chordAdvertise, startNodeAddr, streamingServerAddress, streamingClientAddress, ftAddr, name)
+		getTransferFileSegmentAddr = customChord.GetTransferFileSegmentAddr
+		getStreamingServer = customChord.GetStreamingServer
+		customChord.StoreBackupFrame = streamerServer.StoreReplica
+		customChord.RemoveBackupFolder = streamerServer.RemoveReplicas
+		customChord.TakeOverFolder = streamerServer.PromoteReplicas
+		streamerServer.OnRemove = customChord.RemoveFolder
+		// manifests are kept by the streaming servers of the nodes responsible for their key and its copies, so
+		// that they outlive the server of their key
+		publishManifest = func(key string, data []byte) {
+			for _, copyKey := range manifestCopies(key) {
+				handler := getStreamingHandler(copyKey)
+				streamerClient.PublishManifest(handler, key, data)
+				handler.Close()
+			}
+		}
+		fetchManifest = func(key string) ([]byte, error) {
+			var err error
+			for _, copyKey := range manifestCopies(key) {
+				handler := getStreamingHandler(copyKey)
+				var data []byte
+				data, err = streamerClient.FetchManifest(handler, key)
+				handler.Close()
+				if err == nil {
+					return data, nil
+				}
+			}
+			return nil, err
+		}
+	case "kademlia":
+		// kademlia runs over tcp rpc, so it can share the port number of the udp chord address
+		go kademlia.Start(thisAddr, *chordAdvertise, startNodeAddr, ftAddr, streamingServerAddress)
+		getTransferFileSegmentAddr = kademlia.GetAddressForSegment
+		getStreamingServer = kademlia.GetStreamingServer
+		publishManifest = func(key string, data []byte) {
+			if kademlia.Put(key, data) == 0 {
+				fmt.Println("Unable to publish " + key)
+			}
+		}
+		fetchManifest = func(key string) ([]byte, error) {
+			data, ok := kademlia.Get(key)
+			if !ok {
+				return nil, errors.New(key + " not found")
+			}
+			return data, nil
+		}
+	default:
+		fmt.Println("Unknown overlay " + *overlay + ". Use chord or kademlia")
+		os.Exit(-1)
+	}
+	if *gossipBind != "" {
+		seed := *gossipSeed
+		if seed == "" {
+			seed = *gossipBind
+		}
+		membership.Start(*gossipBind, *gossipAdvertise, seed, streamingServerAddress, ftAddr, *capacity)
+	}
+	go streamerClient.ListenForStream("udp://" + utility.ListenAddr(streamingClientBind))
+	go streamerServer.Start(streamingServerBind, name)
+	go checkTombstones()
+
+	index = search.New(func(key string, data []byte) error {
+		publishManifest(key, data)
+		return nil
+	}, fetchManifest, countStreamers)
+	if *unpublishFile != "" {
+		unpublish(*unpublishFile)
+	}
+	if *searchQuery != "" {
+		searchVideos(*searchQuery)
+	}
 
 	var shareFile string
 	fmt.Println("====================================================")
-	fmt.Println("Please enter the name of the file you wish to share:")
+	fmt.Println("Please enter the name of the file you wish to share")
+	fmt.Println("(or watch to share every video copied into FFMPEG/NodesData/" + name + "/source):")
 	fmt.Println("====================================================")
 	fmt.Scanf("%s", &shareFile)
 
-	// MOCK DONE: SPLIT THE FILE IN PARTS - returns array of segment filenames (?) - array of strings
-	// TODO: DISTRIBUTE ALL PARTS USING CUSTOMCHORD
-	if shareFile != "none" || shareFile != "" {
-		totalSegments := streamerServer.GetFrames(shareFile)
-		fmt.Printf("Total number of extracted frames from %s: %d\n", shareFile, totalSegments)
-
-		// Calculate number of nodes to distribute on. Each node can hold roughly 200 frames
-		totalNodes := totalSegments / 200
-		fmt.Println("Total number of nodes this file will be distributed on: ", totalNodes)
-		fnArr := strings.Split(shareFile, ".")
-
-		// Get all the byte arrays for this file
-		frameBytesArr := frameToBytesArray(fnArr[0])
-
-		var fileNodes = make([]string, totalNodes)
-
-		for i := 0; i < int(totalNodes); i++ {
-			filenameWithNodeSegment := fnArr[0] + " " + strconv.FormatInt(int64(i), 10)
-			fileNodes[i] = customChord.GetTransferFileSegmentAddr(filenameWithNodeSegment)
-			fmt.Println("Address of file node to transfer: ", fileNodes[i])
-
-			// transfer 200 frames
-			// filename := fmt.Sprintf("%05d.png", int64(i))
-			//seqNum := fmt.Sprintf("%d", int64(i+1))
-			fn := fnArr[0] + " " + strconv.FormatInt(int64(i), 10)
-			var addr string
-
-			for addr == "" {
-				log.Printf("Attempting to get ft server in 2 seconds...")
-				time.Sleep(2 * time.Second)
-				addr = customChord.GetStreamingServer(fn)
-			}
-			fmt.Printf("File %s to be transferred to %s\n", fn, addr)
-
-			if addr != streamingServerAddress {
-				var handler *rpc.Client
-				for handler == nil {
-					handler = streamerClient.GetRpcHandler(addr)
-					if handler != nil {
-						break
-					}
-					log.Printf("Attempting to get rpc handler for ft in 2 seconds...")
-					time.Sleep(2 * time.Second)
-				}
-				var limit int
-				if limit = i*200 + 201; i == int(totalNodes)-1 {
-					limit = int(totalSegments) + 1
-				}
-				for j := i*200 + 1; j < limit; j++ {
-					filename := fmt.Sprintf("%05d.png", int64(j))
-					folderFilePath := fnArr[0] + " " + filename
-					//fmt.Println("Saving to server...")
-					streamerClient.SaveToServer(handler, name, folderFilePath, frameBytesArr[filename], ftAddr)
-					//customChord.SaveToStore(fnArr[0], strconv.FormatInt(int64(i), 10), frameBytesArr[filename])
-					//fmt.Println("Saved!!!!!!!!!!!!!!!!!!!!!!")
-				}
-			} else {
-				fmt.Println("Already saved in this node")
-			}
+	switch shareFile {
+	case "", "none":
+	case "watch":
+		go watchSource()
+	default:
+		if err := share(shareFile); err != nil {
+			log.Printf("Unable to share %s: %v", shareFile, err)
 		}
 	}
 
 	// for a node which holds several parts, just ask for the stream ONCE (?)
 
-	var streamFile string
+	var link string
 	fmt.Println("====================================================")
-	fmt.Println("Please enter the name of the file you wish to stream:")
+	fmt.Println("Please enter the name (or share link) of the file you wish to stream:")
 	fmt.Println("====================================================")
-	fmt.Scanf("%s", &streamFile)
-	const numParts = 2
+	fmt.Scanf("%s", &link)
+	if link == "" || link == "none" {
+		// nothing to stream, keep serving the stored frames (and sharing the watched folder)
+		select {}
+	}
+	streamFile, streamKey, err := crypt.ParseLink(link)
+	checkError(err)
 
-	var handlers [2]*rpc.Client
-	fnArr := strings.Split(streamFile, ".")
-	// Get streaming info for all parts
-	for i := 0; i < numParts; i++ {
-		fn := fnArr[0] + " " + strconv.FormatInt(int64(i), 10)
-		addr := ""
-		for addr == "" {
-			log.Printf("Attempting to get stream server in 2 seconds...")
-			time.Sleep(2 * time.Second)
-			addr = customChord.GetStreamingServer(fn)
+	// the manifest tells how the frames were striped over the nodes
+	var m manifest.Manifest
+	if data, err := fetchManifest(manifest.Key(streamFile)); err == nil {
+		m, err = manifest.Decode(data)
+		checkError(err)
+	} else {
+		log.Printf("No manifest of %s (%v), looking for its parts", streamFile, err)
+		m = manifest.Manifest{Name: streamFile, Stripes: legacyStripes(strings.Split(streamFile, ".")[0])}
+		if len(m.Stripes) == 0 {
+			log.Printf("%s is not available", streamFile)
+			// keep serving the stored frames
+			select {}
 		}
-		log.Println("Stream Server address: ", addr)
-
-		//var handler *rpc.Client
-		for handlers[i] == nil {
-			log.Printf("Attempting to get rpc handler in 2 seconds...")
-			time.Sleep(2 * time.Second)
-			handlers[i] = streamerClient.GetRpcHandler(addr)
+	}
+	if m.Deleted {
+		checkError(errors.New(streamFile + " was unpublished"))
+	}
+	if m.Encrypted {
+		if streamKey == nil {
+			checkError(errors.New(streamFile + " is encrypted, stream it with its share link"))
 		}
+		streamEncrypted(m, streamKey, streamingClientAddress)
+		return
+	}
+	log.Printf("Streaming %s: %d frames in %d parts", streamFile, m.SegNums, len(m.Stripes))
+
+	// Get streaming info for all parts
+	handlers := make([]*rpc.Client, len(m.Stripes))
+	for i, stripe := range m.Stripes {
+		handlers[i] = stripeHandler(stripe)
 	}
 
-	// Start streaming
-	// ASSUMPTION: EACH NODE STORES EITHER ATLEAST 300 SEQUENTIAL FRAMES, OR TILL THE END OF FRAME SEQUENCE
-	for i := 0; i < numParts; i++ {
-		streamerClient.StartStreaming(handlers[i], streamFile, 0, strconv.FormatInt(int64(i*300), 10), streamingClientAddress)
+	// Start streaming, each part from its first frame
+	for i, stripe := range m.Stripes {
+		streamerClient.StartStreaming(handlers[i], streamFile, 0, strconv.FormatInt(stripe.First, 10), streamingClientAddress)
 	}
 	// streamerClient.StartStreaming(handlers[0], 0, "0", streamingClientAddress)
 	// streamerClient.StartStreaming(handlers[1], 0, "300", streamingClientAddress)
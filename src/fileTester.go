@@ -9,7 +9,7 @@ import (
 	"./lib/filemgmt"
 	// "bytes"
 
-	// "./lib/utility"
+	"./lib/utility"
 	// "fmt"
 	"os"
 	// "io/ioutil"
@@ -20,13 +20,13 @@ var vid []byte
 func noder(myAddr string) {
 	// filename := "sample1.mp4"
 	// nodeaddr := ":4000"
-	localFileSys := transfer.Initialize(myAddr, "node1")
+	localFileSys := transfer.Initialize(myAddr, "", "node1")
 	// avail, segNums, segsAvail := transfer.CheckFileAvailability(filename, nodeaddr)
 	// var vidSegment utility.VidSegment
 	// vidSegment = transfer.GetVideoSegment("sample.mp4", 45, ":3000")
 	// transfer.Instr(myAddr)
 	// fmt.Println(consts.DirPath + "/samples/sample1.mp4")
-	filemgmt.SplitFile("sample1.mp4")
+	utility.CheckError(filemgmt.SplitFile("sample1.mp4"))
 	filemgmt.ProcessLocalFiles(localFileSys)
 	filemgmt.PrintFileSysContents(localFileSys)
 	transfer.Instr()
@@ -0,0 +1,659 @@
+package castore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// A content addressed object store. Every object (a video segment or a frame) is stored once under the SHA-256
+// hash of its content, no matter how many files it belongs to. Files are described by manifests mapping each
+// segment index to the hash of its content. Changes to a manifest are appended to its log, which is folded into
+// the manifest once it holds about half as many changes as the manifest has segments, so that adding segments
+// one at a time does not rewrite the whole manifest every time.
+//
+// Layout:
+//
+//	<dir>/objects/<first 2 hex digits>/<remaining hex digits>
+//	<dir>/manifests/<file name>.json
+//	<dir>/manifests/<file name>.log
+type Store struct {
+	dir       string
+	framed    bool                 // objects are written with a header, see OpenFramed
+	lock      sync.Mutex           // serializes manifest read-modify-write cycles
+	manifests map[string]*Manifest // manifests read so far, kept in sync with the disk by every write
+	changes   map[string]int       // changes in the log of each manifest read so far
+	pinned    map[string]int       // objects of running ingests, by number of ingests holding them
+	pinLock   sync.Mutex
+}
+
+// Objects of a file being stored whose manifest is not written yet. Collect keeps them, however old they are, until
+// the ingest is done. An ingest is used by one goroutine at a time.
+type Ingest struct {
+	store  *Store
+	hashes map[string]bool
+}
+
+// Maps the segments of a file to the hashes of their content. Segment indices are the segment ids of the file
+// (or the frame numbers for frame folders).
+type Manifest struct {
+	Name     string
+	SegNums  int64
+	Segments map[int]string
+}
+
+// A change to a manifest, one JSON line of its log
+type manifestChange struct {
+	SegNums int64
+	Set     map[int]string `json:",omitempty"`
+	Removed []int          `json:",omitempty"`
+}
+
+// Returned when an object or manifest is not in the store
+var ErrNotFound = errors.New("castore: not found")
+
+// Returned when a stored object no longer matches its hash. The object is removed so that it can be fetched again.
+var ErrCorrupt = errors.New("castore: object is corrupt")
+
+// Header of the objects of a framed store: magic | segment id (uint64, big endian) | content length (uint64, big
+// endian) | SHA-256 of the content.
+const headerMagic = "CAS2"
+const headerSize = len(headerMagic) + 8 + 8 + sha256.Size
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// OBJECT METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Opens the store in dir, creating it if needed
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// store, err := castore.Open("./lib/filesys/store")
+// hash, err := store.Put(data)
+// err = store.AddToManifest("sample.mp4", 3, 100, hash)
+func Open(dir string) (*Store, error) {
+	for _, sub := range []string{"objects", "manifests"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{dir: dir, manifests: make(map[string]*Manifest), changes: make(map[string]int), pinned: make(map[string]int)}, nil
+}
+
+// Opens a store whose objects start with a small binary header holding the segment id, content length and hash, so
+// that every object file describes its content on its own. Objects written without a header are still read. Use Open for stores
+// whose objects are read directly by other tools (e.g. ffmpeg).
+func OpenFramed(dir string) (*Store, error) {
+	s, err := Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.framed = true
+	return s, nil
+}
+
+// Returns the hex encoded SHA-256 hash of data, the address of data in a store
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Stores data and returns its hash. Storing content that is already present only refreshes its modification time,
+// so that Collect does not take it before it is added to a manifest.
+func (s *Store) Put(data []byte) (string, error) {
+	return s.PutSegment(0, data)
+}
+
+// Stores data like Put. Framed stores record id, the segment the content is stored as, in the object's header.
+// Content shared by several segments keeps the id it was first stored as.
+func (s *Store) PutSegment(id int, data []byte) (string, error) {
+	hash := Hash(data)
+	if s.Has(hash) {
+		now := time.Now()
+		os.Chtimes(s.Path(hash), now, now)
+		return hash, nil
+	}
+	path := s.Path(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	// write to a temporary file first so that a crash never leaves a partial object under its hash
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	if s.framed {
+		_, err = tmp.Write(header(hash, id, len(data)))
+	}
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return hash, nil
+}
+
+// Starts storing the objects of a file. Objects put through the ingest are kept by Collect until Done is called,
+// so call Done once the file's manifest is written or the file is given up.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// ingest := store.BeginIngest()
+// defer ingest.Done()
+// hash, err := ingest.Put(data)
+// err = store.AddAllToManifest("sample.mp4", 100, hashes)
+func (s *Store) BeginIngest() *Ingest {
+	return &Ingest{store: s, hashes: make(map[string]bool)}
+}
+
+// Stores data like Store.Put and keeps it from Collect until the ingest is done
+func (in *Ingest) Put(data []byte) (string, error) {
+	return in.PutSegment(0, data)
+}
+
+// Stores data like Store.PutSegment and keeps it from Collect until the ingest is done
+func (in *Ingest) PutSegment(id int, data []byte) (string, error) {
+	hash := Hash(data)
+	// pinned before it is written, so that Collect never sees it unpinned
+	if !in.hashes[hash] {
+		in.hashes[hash] = true
+		in.store.pinLock.Lock()
+		in.store.pinned[hash]++
+		in.store.pinLock.Unlock()
+	}
+	return in.store.PutSegment(id, data)
+}
+
+// Ends the ingest. Its objects are collected from now on unless a manifest refers to them.
+func (in *Ingest) Done() {
+	in.store.pinLock.Lock()
+	defer in.store.pinLock.Unlock()
+	for hash := range in.hashes {
+		if in.store.pinned[hash]--; in.store.pinned[hash] <= 0 {
+			delete(in.store.pinned, hash)
+		}
+	}
+	in.hashes = make(map[string]bool)
+}
+
+// Returns the content stored under hash. The content is verified against the hash on every read.
+func (s *Store) Get(hash string) ([]byte, error) {
+	if !validHash(hash) {
+		return nil, ErrNotFound
+	}
+	data, err := ioutil.ReadFile(s.Path(hash))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.framed {
+		data = unframe(hash, data)
+	}
+	// objects without a valid header are either corrupt or were written before the store was framed, the hash
+	// tells them apart
+	if Hash(data) != hash {
+		os.Remove(s.Path(hash))
+		return nil, ErrCorrupt
+	}
+	return data, nil
+}
+
+// Returns true if content with the given hash is stored
+func (s *Store) Has(hash string) bool {
+	if !validHash(hash) {
+		return false
+	}
+	_, err := os.Stat(s.Path(hash))
+	return err == nil
+}
+
+// Returns the space an object takes on disk, including its header
+func (s *Store) Size(hash string) (int64, error) {
+	if !validHash(hash) {
+		return 0, ErrNotFound
+	}
+	info, err := os.Stat(s.Path(hash))
+	if os.IsNotExist(err) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Returns the space content of length bytes takes on disk once stored
+func (s *Store) StoredSize(length int) int64 {
+	if s.framed {
+		return int64(length + headerSize)
+	}
+	return int64(length)
+}
+
+// Deletes the object with the given hash. Manifests still referring to it are not changed.
+func (s *Store) Remove(hash string) error {
+	if !validHash(hash) {
+		return nil
+	}
+	err := os.Remove(s.Path(hash))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Returns the path of the object with the given hash
+func (s *Store) Path(hash string) string {
+	return filepath.Join(s.dir, "objects", hash[:2], hash[2:])
+}
+
+// Makes the object with the given hash available at dest (e.g. for tools like ffmpeg that read plain files). dest
+// is hard linked to the object so no space is used, falling back to a copy where hard links are not supported and
+// for framed stores.
+func (s *Store) Link(hash string, dest string) error {
+	if !s.Has(hash) {
+		return ErrNotFound
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	os.Remove(dest)
+	if s.framed {
+		// the header has to be left out, so framed objects are always copied
+		data, err := s.Get(hash)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dest, data, 0644)
+	}
+	if err := os.Link(s.Path(hash), dest); err == nil {
+		return nil
+	}
+	src, err := os.Open(s.Path(hash))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, src)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// MANIFEST METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Returns a copy of the manifest of a file, or ErrNotFound. Manifests are only read from disk once.
+func (s *Store) LoadManifest(name string) (Manifest, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	manifest, err := s.loadManifest(name)
+	if err != nil {
+		return Manifest{}, err
+	}
+	return manifest.copy(), nil
+}
+
+// Returns the content hash of segment index of file name, or ErrNotFound. Unlike LoadManifest, the manifest is
+// not copied, so looking up a single segment costs the same for files of any length.
+func (s *Store) SegmentHash(name string, index int) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	manifest, err := s.loadManifest(name)
+	if err != nil {
+		return "", err
+	}
+	hash, ok := manifest.Segments[index]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return hash, nil
+}
+
+// Writes the manifest of a file, replacing the previous one atomically
+func (s *Store) SaveManifest(manifest Manifest) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.saveManifest(manifest.copy())
+}
+
+// Records that segment index of file name has the content with the given hash. segNums is the total number of
+// segments of the file.
+func (s *Store) AddToManifest(name string, index int, segNums int64, hash string) error {
+	return s.AddAllToManifest(name, segNums, map[int]string{index: hash})
+}
+
+// Records the content hashes of several segments of file name with a single manifest write
+func (s *Store) AddAllToManifest(name string, segNums int64, hashes map[int]string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	manifest, err := s.loadManifest(name)
+	if err == ErrNotFound {
+		// a log left behind by an interrupted RemoveManifest must not be applied to the new manifest
+		os.Remove(s.logPath(name))
+		return s.saveManifest(Manifest{Name: name, SegNums: segNums, Segments: copyHashes(hashes)})
+	}
+	if err != nil {
+		return err
+	}
+	change := manifestChange{SegNums: segNums, Set: make(map[int]string)}
+	for index, hash := range hashes {
+		if manifest.Segments[index] != hash {
+			change.Set[index] = hash
+		}
+	}
+	if len(change.Set) == 0 && manifest.SegNums == segNums {
+		return nil
+	}
+	return s.writeChange(manifest, change)
+}
+
+// Removes segment index from the manifest of file name
+func (s *Store) RemoveFromManifest(name string, index int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	manifest, err := s.loadManifest(name)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := manifest.Segments[index]; !ok {
+		return nil
+	}
+	return s.writeChange(manifest, manifestChange{SegNums: manifest.SegNums, Removed: []int{index}})
+}
+
+// Removes the manifest of file name. Its objects are left to Collect, since other files may share them.
+func (s *Store) RemoveManifest(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.manifests, name)
+	delete(s.changes, name)
+	err := os.Remove(s.manifestPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(s.logPath(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Returns the names of all files with a manifest, sorted
+func (s *Store) Manifests() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.dir, "manifests"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, unescapeName(strings.TrimSuffix(entry.Name(), ".json")))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Deletes every object no manifest refers to. Objects of running ingests (see BeginIngest) are kept, and so are
+// objects modified within grace, since they may have been put without an ingest for a manifest that is about to be
+// written (see AddToManifest). Returns the number of objects and bytes reclaimed.
+func (s *Store) Collect(grace time.Duration) (int, int64, error) {
+	names, err := s.Manifests()
+	if err != nil {
+		return 0, 0, err
+	}
+	referenced := make(map[string]bool)
+	for _, name := range names {
+		manifest, err := s.LoadManifest(name)
+		if err != nil {
+			// an unreadable manifest may still refer to anything, so nothing is collected
+			return 0, 0, err
+		}
+		for _, hash := range manifest.Segments {
+			referenced[hash] = true
+		}
+	}
+	removed, freed := 0, int64(0)
+	cutoff := time.Now().Add(-grace)
+	err = filepath.Walk(filepath.Join(s.dir, "objects"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		hash := filepath.Base(filepath.Dir(path)) + info.Name()
+		if info.ModTime().After(cutoff) || referenced[hash] || s.isPinned(hash) {
+			return nil
+		}
+		if !validHash(hash) && !strings.HasPrefix(info.Name(), ".tmp-") {
+			// neither an object nor a write interrupted by a crash
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	return removed, freed, err
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// HELPER METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+func (s *Store) isPinned(hash string) bool {
+	s.pinLock.Lock()
+	defer s.pinLock.Unlock()
+	return s.pinned[hash] > 0
+}
+
+func header(hash string, id int, length int) []byte {
+	buf := make([]byte, headerSize)
+	copy(buf, headerMagic)
+	binary.BigEndian.PutUint64(buf[len(headerMagic):], uint64(id))
+	binary.BigEndian.PutUint64(buf[len(headerMagic)+8:], uint64(length))
+	hex.Decode(buf[len(headerMagic)+16:], []byte(hash))
+	return buf
+}
+
+// Returns the content of an object without its header. Objects without a valid header are returned as they are.
+func unframe(hash string, data []byte) []byte {
+	if len(data) >= headerSize && string(data[:len(headerMagic)]) == headerMagic {
+		id := int(binary.BigEndian.Uint64(data[len(headerMagic):]))
+		if bytes.Equal(data[:headerSize], header(hash, id, len(data)-headerSize)) {
+			return data[headerSize:]
+		}
+	}
+	return data
+}
+
+// Must hold the lock. The cached manifest is returned as is, callers copy it before changing it.
+func (s *Store) loadManifest(name string) (*Manifest, error) {
+	if manifest, ok := s.manifests[name]; ok {
+		return manifest, nil
+	}
+	data, err := ioutil.ReadFile(s.manifestPath(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Segments == nil {
+		manifest.Segments = make(map[int]string)
+	}
+	changes, err := ioutil.ReadFile(s.logPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	count := 0
+	for _, line := range bytes.Split(changes, []byte("\n")) {
+		var change manifestChange
+		if len(line) == 0 {
+			break
+		}
+		if json.Unmarshal(line, &change) != nil {
+			// the last line of a log is cut short when writing it was interrupted. The log is folded into the
+			// manifest right away, changes appended after the partial line would not be read back.
+			if err = s.saveManifest(*manifest); err != nil {
+				return nil, err
+			}
+			return s.manifests[name], nil
+		}
+		change.apply(manifest)
+		count++
+	}
+	s.manifests[name] = manifest
+	s.changes[name] = count
+	return manifest, nil
+}
+
+// Must hold the lock. Appends a change of a cached manifest to its log, or folds the log into the manifest once it
+// holds about half as many changes as the manifest has segments.
+func (s *Store) writeChange(manifest *Manifest, change manifestChange) error {
+	updated := manifest.copy()
+	change.apply(&updated)
+	if s.changes[manifest.Name] >= len(updated.Segments)/2+16 {
+		return s.saveManifest(updated)
+	}
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.logPath(manifest.Name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// the log may end in a partial line now, which is where reading it stops
+		delete(s.manifests, manifest.Name)
+		return err
+	}
+	s.manifests[manifest.Name] = &updated
+	s.changes[manifest.Name]++
+	return nil
+}
+
+// Must hold the lock. The manifest is cached once it is written, so it must not be changed by the caller afterwards.
+func (s *Store) saveManifest(manifest Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	path := s.manifestPath(manifest.Name)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// the manifest holds every change of the log, replaying them again after a crash here changes nothing
+	if err := os.Remove(s.logPath(manifest.Name)); err != nil && !os.IsNotExist(err) {
+		delete(s.manifests, manifest.Name)
+		return err
+	}
+	s.manifests[manifest.Name] = &manifest
+	s.changes[manifest.Name] = 0
+	return nil
+}
+
+func (manifest *Manifest) copy() Manifest {
+	c := *manifest
+	c.Segments = copyHashes(manifest.Segments)
+	return c
+}
+
+func copyHashes(hashes map[int]string) map[int]string {
+	c := make(map[int]string, len(hashes))
+	for index, hash := range hashes {
+		c[index] = hash
+	}
+	return c
+}
+
+func (change manifestChange) apply(manifest *Manifest) {
+	manifest.SegNums = change.SegNums
+	for index, hash := range change.Set {
+		manifest.Segments[index] = hash
+	}
+	for _, index := range change.Removed {
+		delete(manifest.Segments, index)
+	}
+}
+
+func (s *Store) manifestPath(name string) string {
+	return filepath.Join(s.dir, "manifests", escapeName(name)+".json")
+}
+
+func (s *Store) logPath(name string) string {
+	return filepath.Join(s.dir, "manifests", escapeName(name)+".log")
+}
+
+// File names may contain path separators, which are escaped in manifest file names
+func escapeName(name string) string {
+	return strings.NewReplacer("%", "%25", "/", "%2F", "\\", "%5C").Replace(name)
+}
+
+func unescapeName(name string) string {
+	return strings.NewReplacer("%2F", "/", "%5C", "\\", "%25", "%").Replace(name)
+}
+
+func validHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
@@ -0,0 +1,403 @@
+package catalog
+
+import (
+	"../kvstore"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// The catalog of the files stored on this node and the segments held of each. Entries are kept in memory and
+// written through to an engine, one record per file, so adding a segment costs one small append to the log store
+// instead of a rewrite of the whole catalog. Every record replaces the previous one of its file atomically.
+type Catalog struct {
+	store   kvstore.Engine
+	entries map[string]*Entry
+	lock    sync.RWMutex
+}
+
+// A file in the catalog. Segments has bit id-1 set for every segment id held locally.
+type Entry struct {
+	Name     string
+	Path     string // folder of segments written before the content addressed store
+	SegNums  int64
+	Segments Bitmap
+	Timings  []Timing // Timings[i] belongs to segment i+1. Only known for files cut at keyframes
+	Cached   Bitmap   // segments held as evictable copies rather than placed on this node
+}
+
+// Position of a segment in the timeline of its video, in seconds
+type Timing struct {
+	Start    float64
+	Duration float64
+}
+
+// A set of segment ids, one bit per segment
+type Bitmap []byte
+
+// Returned for records that can't be decoded
+var ErrCorrupt = errors.New("catalog: corrupt entry")
+
+// Timings and cached segments are written under the file's name followed by these suffixes, so that the records
+// updated for every segment stay small. File names never contain a NUL byte.
+const timingsSuffix = "\x00timings"
+const cachedSuffix = "\x00cached"
+
+// The pre-catalog format: localFiles.json
+type legacyFiles struct {
+	Files []struct {
+		Name      string  `json:"name"`
+		Path      string  `json:"dir"`
+		SegNums   int64   `json:"segnums"`
+		SegsAvail []int64 `json:"segsavail"`
+	} `json:"Files"`
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// CATALOG METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Loads the catalog stored in engine
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// store, err := kvstore.OpenLog("./lib/filesys/catalog.log", kvstore.DefaultOptions())
+// cat, err := catalog.Open(store)
+// err = cat.Add("sample.mp4", "./lib/filesys/local/sample/", 100, 3)
+func Open(store kvstore.Engine) (*Catalog, error) {
+	c := &Catalog{store: store, entries: make(map[string]*Entry)}
+	names, err := store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if strings.Contains(name, "\x00") {
+			continue
+		}
+		data, err := store.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := decodeEntry(name, data)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = store.Get(name + timingsSuffix); err == nil {
+			if entry.Timings, err = decodeTimings(data); err != nil {
+				return nil, err
+			}
+		} else if err != kvstore.ErrNotFound {
+			return nil, err
+		}
+		if data, err = store.Get(name + cachedSuffix); err == nil {
+			entry.Cached = Bitmap(data)
+		} else if err != kvstore.ErrNotFound {
+			return nil, err
+		}
+		c.entries[name] = &entry
+	}
+	return c, nil
+}
+
+// Imports a localFiles.json written by earlier versions, then renames it so that it is imported once. The rename
+// happens after every entry is stored, so an interrupted import is simply repeated.
+func (c *Catalog) Migrate(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var legacy legacyFiles
+	if err = json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	for _, file := range legacy.Files {
+		if err = c.AddMany(file.Name, file.Path, file.SegNums, file.SegsAvail); err != nil {
+			return err
+		}
+	}
+	return os.Rename(path, path+".migrated")
+}
+
+// Records that segment id of a file is held locally
+func (c *Catalog) Add(name string, path string, segNums int64, id int64) error {
+	return c.AddMany(name, path, segNums, []int64{id})
+}
+
+// Records that the segments ids of a file are held locally, in a single record
+func (c *Catalog) AddMany(name string, path string, segNums int64, ids []int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[name]
+	if !ok {
+		entry = &Entry{Name: name, Path: path}
+	}
+	next := *entry
+	next.Segments = append(Bitmap(nil), entry.Segments...)
+	if segNums > 0 {
+		next.SegNums = segNums
+	}
+	if next.Path == "" {
+		next.Path = path
+	}
+	for _, id := range ids {
+		next.Segments = next.Segments.Set(id)
+	}
+	if err := c.store.Put(name, encodeEntry(next)); err != nil {
+		return err
+	}
+	c.entries[name] = &next
+	return nil
+}
+
+// Records that segments of a file are no longer held locally. The file stays in the catalog.
+func (c *Catalog) Drop(name string, ids []int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[name]
+	if !ok {
+		return nil
+	}
+	next := *entry
+	next.Segments = append(Bitmap(nil), entry.Segments...)
+	for _, id := range ids {
+		next.Segments = next.Segments.Clear(id)
+	}
+	if err := c.store.Put(name, encodeEntry(next)); err != nil {
+		return err
+	}
+	c.entries[name] = &next
+	return c.markCached(name, ids, false)
+}
+
+// Records whether segments of a file are evictable copies (cached) or were placed on this node
+func (c *Catalog) MarkCached(name string, ids []int64, cached bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.markCached(name, ids, cached)
+}
+
+// Records the position of every segment of a file in its timeline. The file must be in the catalog.
+func (c *Catalog) SetTimings(name string, timings []Timing) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[name]
+	if !ok {
+		return errors.New("catalog: " + name + " is not in the catalog")
+	}
+	if err := c.store.Put(name+timingsSuffix, encodeTimings(timings)); err != nil {
+		return err
+	}
+	next := *entry
+	next.Timings = append([]Timing(nil), timings...)
+	c.entries[name] = &next
+	return nil
+}
+
+// Returns the entry of a file
+func (c *Catalog) Get(name string) (Entry, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	entry, ok := c.entries[name]
+	if !ok {
+		return Entry{}, false
+	}
+	return *entry, true
+}
+
+// Removes a file from the catalog
+func (c *Catalog) Remove(name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.store.Delete(name); err != nil {
+		return err
+	}
+	if err := c.store.Delete(name + timingsSuffix); err != nil {
+		return err
+	}
+	if err := c.store.Delete(name + cachedSuffix); err != nil {
+		return err
+	}
+	delete(c.entries, name)
+	return nil
+}
+
+// Returns every file in the catalog, sorted by name
+func (c *Catalog) Files() []Entry {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	entries := make([]Entry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// Flushes the catalog and closes its engine
+func (c *Catalog) Close() error {
+	return c.store.Close()
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// BITMAP METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Returns true if segment id is in the set
+func (b Bitmap) Has(id int64) bool {
+	if id < 1 || (id-1)/8 >= int64(len(b)) {
+		return false
+	}
+	return b[(id-1)/8]&(1<<uint((id-1)%8)) != 0
+}
+
+// Adds segment id to the set, growing it if needed. Ids start at 1.
+func (b Bitmap) Set(id int64) Bitmap {
+	if id < 1 {
+		return b
+	}
+	for int64(len(b)) <= (id-1)/8 {
+		b = append(b, 0)
+	}
+	b[(id-1)/8] |= 1 << uint((id-1)%8)
+	return b
+}
+
+// Removes segment id from the set
+func (b Bitmap) Clear(id int64) Bitmap {
+	if b.Has(id) {
+		b[(id-1)/8] &^= 1 << uint((id-1)%8)
+	}
+	return b
+}
+
+// Returns the number of segments in the set
+func (b Bitmap) Count() int {
+	count := 0
+	for _, v := range b {
+		for ; v != 0; v &= v - 1 {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns the segment ids in the set, in ascending order
+func (b Bitmap) IDs() []int64 {
+	ids := make([]int64, 0, b.Count())
+	for i, v := range b {
+		for bit := uint(0); bit < 8; bit++ {
+			if v&(1<<bit) != 0 {
+				ids = append(ids, int64(i)*8+int64(bit)+1)
+			}
+		}
+	}
+	return ids
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// HELPER METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Must hold the lock
+func (c *Catalog) markCached(name string, ids []int64, cached bool) error {
+	entry, ok := c.entries[name]
+	if !ok {
+		return nil
+	}
+	next := *entry
+	next.Cached = append(Bitmap(nil), entry.Cached...)
+	changed := false
+	for _, id := range ids {
+		if next.Cached.Has(id) != cached {
+			changed = true
+			if cached {
+				next.Cached = next.Cached.Set(id)
+			} else {
+				next.Cached = next.Cached.Clear(id)
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := c.store.Put(name+cachedSuffix, next.Cached); err != nil {
+		return err
+	}
+	c.entries[name] = &next
+	return nil
+}
+
+// Record layout: segNums (uvarint) | len(path) (uvarint) | path | bitmap. The name is the record's key.
+func encodeEntry(entry Entry) []byte {
+	buf := make([]byte, 2*binary.MaxVarintLen64, 2*binary.MaxVarintLen64+len(entry.Path)+len(entry.Segments))
+	n := binary.PutUvarint(buf, uint64(entry.SegNums))
+	n += binary.PutUvarint(buf[n:], uint64(len(entry.Path)))
+	buf = append(buf[:n], entry.Path...)
+	return append(buf, entry.Segments...)
+}
+
+func decodeEntry(name string, data []byte) (Entry, error) {
+	segNums, n := binary.Uvarint(data)
+	if n <= 0 {
+		return Entry{}, ErrCorrupt
+	}
+	data = data[n:]
+	pathLen, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < pathLen {
+		return Entry{}, ErrCorrupt
+	}
+	data = data[n:]
+	return Entry{
+		Name:     name,
+		Path:     string(data[:pathLen]),
+		SegNums:  int64(segNums),
+		Segments: append(Bitmap(nil), data[pathLen:]...),
+	}, nil
+}
+
+// Timings layout: count (uvarint) | start, duration (float64 bits, big endian) per segment
+func encodeTimings(timings []Timing) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+16*len(timings))
+	n := binary.PutUvarint(buf, uint64(len(timings)))
+	for _, timing := range timings {
+		binary.BigEndian.PutUint64(buf[n:], math.Float64bits(timing.Start))
+		binary.BigEndian.PutUint64(buf[n+8:], math.Float64bits(timing.Duration))
+		n += 16
+	}
+	return buf[:n]
+}
+
+func decodeTimings(data []byte) ([]Timing, error) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) != 16*count {
+		return nil, ErrCorrupt
+	}
+	timings := make([]Timing, count)
+	for i := range timings {
+		timings[i].Start = math.Float64frombits(binary.BigEndian.Uint64(data[n:]))
+		timings[i].Duration = math.Float64frombits(binary.BigEndian.Uint64(data[n+8:]))
+		n += 16
+	}
+	return timings, nil
+}
@@ -0,0 +1,166 @@
+package chordRPC
+
+import (
+	"../../consts"
+	"../merkle"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+//////////////////////////////////////////////////////
+/*			ANTI-ENTROPY START						*/
+//////////////////////////////////////////////////////
+
+type (
+	// Argument of the Merkle rpcs: tree nodes to get the hashes of, or leaves to get the keys of
+	MerkleMsg struct {
+		Nodes  []int
+		Leaves []int
+	}
+
+	// Reply of the Merkle rpcs. Keys[i] holds the key digests of the i-th requested leaf.
+	MerkleReply struct {
+		Hashes [][]byte
+		Keys   []map[string][]byte
+	}
+)
+
+// Merkle tree over every key held by this node, with one leaf per ring identifier
+var datatree *merkle.Tree
+
+/*
+* Returns the hashes of the requested nodes of this node's Merkle tree
+ */
+func (this *ChordService) MerkleHashes(msg *MerkleMsg, reply *MerkleReply) error {
+	reply.Hashes = datatree.Hashes(msg.Nodes)
+	return nil
+}
+
+/*
+* Returns the keys and digests held in the requested leaves of this node's Merkle tree
+ */
+func (this *ChordService) MerkleKeys(msg *MerkleMsg, reply *MerkleReply) error {
+	reply.Keys = make([]map[string][]byte, len(msg.Leaves))
+	for i, leaf := range msg.Leaves {
+		if leaf >= 0 && leaf < datatree.Leaves() {
+			reply.Keys[i] = datatree.Keys(leaf)
+		}
+	}
+	return nil
+}
+
+func initMerkleTree() {
+	datatree = merkle.New(int(math.Pow(2, m)))
+}
+
+/*
+* Digest of a version of a key. Covers the value and the version vector so that replicas holding the same value
+* under different versions are synced too.
+ */
+func versionDigest(versioned Versioned) []byte {
+	nodes := make([]string, 0, len(versioned.Clock))
+	for node := range versioned.Clock {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var buf bytes.Buffer
+	buf.Write(merkle.Digest(versioned.Value))
+	for _, node := range nodes {
+		buf.WriteString(node)
+		binary.Write(&buf, binary.BigEndian, versioned.Clock[node])
+	}
+	return merkle.Digest(buf.Bytes())
+}
+
+/*
+* Periodically syncs the key range owned by this node, (predecessor, this node], with its replicas on the
+* successor list. Only the roots of the range are exchanged while replicas agree.
+ */
+func maintainReplicas() {
+	for {
+		time.Sleep(consts.AntiEntropyInterval)
+		if predecessorAddress == "" {
+			continue
+		}
+		ringSize := int64(math.Pow(2, m))
+		first := int((predecessorIdentifier + 1) % ringSize)
+		last := int(nodeIdentifier)
+		for _, addr := range SuccessorList() {
+			if err := syncRange(addr, first, last); err != nil {
+				sectionedPrint(fmt.Sprintf("Anti-entropy with %s failed: %v\n", addr, err))
+			}
+		}
+	}
+}
+
+/*
+* Syncs the keys with identifiers first to last (wrapping around the ring if first > last) with a replica.
+* Walks both Merkle trees down from the range roots to find the differing leaves, then compares the keys of those
+* leaves and reconciles the differing keys on both sides.
+ */
+func syncRange(addr string, first int, last int) error {
+	leaves, err := merkle.Diff(datatree, datatree.Cover(first, last), func(nodes []int) ([][]byte, error) {
+		var reply MerkleReply
+		err := callReplica(addr, "ChordService.MerkleHashes", &MerkleMsg{Nodes: nodes}, &reply)
+		return reply.Hashes, err
+	})
+	if err != nil || len(leaves) == 0 {
+		return err
+	}
+
+	var reply MerkleReply
+	if err := callReplica(addr, "ChordService.MerkleKeys", &MerkleMsg{Leaves: leaves}, &reply); err != nil {
+		return err
+	}
+	synced := 0
+	for i, leaf := range leaves {
+		var remote map[string][]byte
+		if i < len(reply.Keys) {
+			remote = reply.Keys[i]
+		}
+		for _, key := range merkle.DiffKeys(datatree.Keys(leaf), remote) {
+			if err := syncKey(addr, key); err != nil {
+				return err
+			}
+			synced++
+		}
+	}
+	sectionedPrint(fmt.Sprintf("Anti-entropy with %s: %d leaves and %d keys differed\n", addr, len(leaves), synced))
+	return nil
+}
+
+/*
+* Reconciles the local and remote versions of key and stores the result wherever it is missing
+ */
+func syncKey(addr string, key string) error {
+	var remote VersionedReply
+	if err := callReplica(addr, "ChordService.FetchVersioned", &Msg{nodeAddress, key, -1, "", ""}, &remote); err != nil {
+		return err
+	}
+	local, found := loadLocal(key)
+	switch {
+	case !found && !remote.Found:
+		return nil
+	case !found:
+		return storeLocal(key, remote.Versioned)
+	case !remote.Found:
+		return storeOn(addr, key, local)
+	}
+	merged := reconcile(local, remote.Versioned)
+	if err := storeLocal(key, merged); err != nil {
+		return err
+	}
+	if !sameVersion(merged, remote.Versioned) {
+		return storeOn(addr, key, merged)
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////////
+/*			ANTI-ENTROPY END						*/
+//////////////////////////////////////////////////////
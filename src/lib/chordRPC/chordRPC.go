@@ -1,6 +1,8 @@
 package chordRPC
 
 import (
+	"../kvstore"
+	"../utility"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
@@ -10,6 +12,7 @@ import (
 	"net/rpc"
 	"os"
 	"runtime"
+	"sync"
 	"time"
 )
 
@@ -29,16 +32,17 @@ type (
 
 	// Reply struct to be used as output argument in rpc calls
 	Reply struct {
-		Key     string
-		Val     string
-		DataMap map[string][]byte
+		Key       string
+		Val       string
+		Addresses []string
 	}
 )
 
 var (
-	nodeAddress           string // rpc address this node listens on
+	bindAddress           string // local address the rpc listener binds to
+	nodeAddress           string // canonical rpc address advertised to peers and hashed into nodeIdentifier
 	peerAddress           string // another node's address to connect to
-	ftAddr                string // rpc addr for file transferring
+	ftAddr                string // advertised rpc addr for file transferring
 	nodeIdentifier        int64
 	successorIdentifier   int64
 	predecessorIdentifier int64
@@ -46,11 +50,12 @@ var (
 	predecessorAddress    string
 
 	// finger table as map of identifiers and addresses
-	ftab    map[int64]string
-	datamap map[string][]byte
+	ftab        map[int64]string
+	store       kvstore.Engine // holds owned and replica keys, see SetStore
+	datamapLock sync.Mutex     // serializes read-reconcile-write cycles on store
 
-	predecessorMap map[string][]byte
-	successorMap   map[string][]byte
+	successorList     []string // up to ReplicationN successors, closest first
+	successorListLock sync.RWMutex
 
 	rpcChain           chan string // rpc chain channel to pass down value to the initiator
 	successorHandler   *rpc.Client
@@ -60,7 +65,10 @@ var (
 
 )
 
-func Start(nodeAddr string, peerAddr string, fileTransAddr string) {
+// Starts the chord node. bindAddr is the local address the rpc service listens on while advertiseAddr is the
+// address other nodes use to reach it (empty to advertise bindAddr). fileTransAddr must be the advertised
+// address of this node's file transfer service.
+func Start(bindAddr string, advertiseAddr string, peerAddr string, fileTransAddr string) {
 
 	// if len(os.Args) < 3 {
 	// 	fmt.Println("=====================================================")
@@ -78,8 +86,9 @@ func Start(nodeAddr string, peerAddr string, fileTransAddr string) {
 	// peerAddress = os.Args[2]
 	// ftAddr = os.Args[3]
 
-	nodeAddress = nodeAddr
-	peerAddress = peerAddr
+	bindAddress = bindAddr
+	nodeAddress = utility.AdvertiseAddr(bindAddr, advertiseAddr)
+	peerAddress = utility.AdvertiseAddr(peerAddr, "")
 	ftAddr = fileTransAddr
 
 	// set m
@@ -93,11 +102,15 @@ func Start(nodeAddr string, peerAddr string, fileTransAddr string) {
 	sectionedPrint(str)
 	// initialize finger table
 	ftab = make(map[int64]string)
-	datamap = make(map[string][]byte)
+	if store == nil {
+		store = kvstore.NewMemStore()
+	}
+	initMerkleTree()
+	loadMerkleTree()
 
 	go launchRPCService()
 
-	if nodeAddress == peerAddress {
+	if nodeAddress == peerAddress || bindAddress == peerAddr {
 		str := fmt.Sprintf("First node %s joining the system\n", nodeAddress)
 		sectionedPrint(str)
 		successorAddress = ""
@@ -129,6 +142,7 @@ func Start(nodeAddr string, peerAddr string, fileTransAddr string) {
 	}
 
 	go manageHeartbeats()
+	go maintainReplicas()
 
 	for {
 		runtime.Gosched()
@@ -136,8 +150,19 @@ func Start(nodeAddr string, peerAddr string, fileTransAddr string) {
 
 }
 
+// Saves data under filename on this node only. Use Put to write to the key's replicas.
 func SaveToMap(filename string, data []byte) {
-	datamap[filename] = data
+	current, _ := loadLocal(filename)
+	err := storeLocal(filename, Versioned{data, current.Clock.Increment(nodeAddress)})
+	checkError(err)
+}
+
+// Removes filename from the map. An empty value with a newer version is written to the key's preference list (see
+// Put), so that anti-entropy does not bring the old value back from a replica.
+func RemoveFromMap(filename string) {
+	if err := Put(filename, nil); err != nil {
+		sectionedPrint("Unable to remove " + filename + ": " + err.Error())
+	}
 }
 
 //////////////////////////////////////////////////////
@@ -246,7 +271,6 @@ func (this *ChordService) GetKeyInfo(msg *Msg, reply *Reply) error {
 
 func (this *ChordService) Heartbeat(msg *Msg, reply *Reply) error {
 	reply.Val = "Alive" + " : " + nodeAddress
-	reply.DataMap = datamap
 	return nil
 }
 
@@ -361,21 +385,16 @@ func GetAddressForSegment(filename string) string {
 		return ftAddr
 	}
 
-	fileIdentifier := getIdentifier(filename)
-
 	var reply Reply
-	msg := Msg{nodeAddress, filename, fileIdentifier, "file", ""}
-	handler := getRpcHandler(successorAddress)
-	err := handler.Call("ChordService.GetKeyInfo", &msg, &reply)
+	msg := Msg{nodeAddress, filename, getIdentifier(filename), "file", ""}
+	owner, err := findOwner(filename)
 	checkError(err)
+	reply.Val = owner
 	str := fmt.Sprintf("Reply received for getting file transfer address: %s\n", reply.Val)
 	sectionedPrint(str)
 
-	err = handler.Close()
-	checkError(err)
-
 	// get file transfer address and return
-	handler = getRpcHandler(reply.Val)
+	handler := getRpcHandler(reply.Val)
 	err = handler.Call("ChordService.GetFtAddress", &msg, &reply)
 	checkError(err)
 	str = fmt.Sprintf("File transfer address: %s\n", reply.Val)
@@ -387,6 +406,80 @@ func GetAddressForSegment(filename string) string {
 	return reply.Val
 }
 
+/*
+* Returns the file transfer addresses of all replicas of a file part, owner first. Replicas that cannot be reached
+* are left out, none are returned if the owner can't be looked up.
+ */
+func GetAddressesForSegment(filename string) []string {
+	replicas, err := PreferenceList(filename)
+	if err != nil {
+		sectionedPrint(err.Error())
+		return nil
+	}
+	var addresses []string
+	for _, addr := range replicas {
+		if addr == nodeAddress {
+			addresses = append(addresses, ftAddr)
+			continue
+		}
+		var reply Reply
+		if err := callReplica(addr, "ChordService.GetFtAddress", &Msg{nodeAddress, filename, -1, "file", ""}, &reply); err == nil {
+			addresses = append(addresses, reply.Val)
+		}
+	}
+	return addresses
+}
+
+/*
+* Returns the file transfer addresses of count distinct nodes holding the shards of a group: the node owning key
+* followed by its successors. Fewer addresses are returned when the ring is smaller. Nodes that cannot be reached
+* keep their position with an empty address, so that shard i stays on the i-th node.
+ */
+func GetAddressesForShards(key string, count int) []string {
+	owner, err := findOwner(key)
+	if err != nil {
+		sectionedPrint(err.Error())
+		return nil
+	}
+	list := []string{owner}
+	for len(list) < count {
+		last := list[len(list)-1]
+		successors := SuccessorList()
+		if last != nodeAddress {
+			var reply Reply
+			if err := callReplica(last, "ChordService.GetSuccessorList", &Msg{nodeAddress, key, -1, "", ""}, &reply); err != nil {
+				break
+			}
+			successors = reply.Addresses
+		}
+		added := false
+		for _, addr := range successors {
+			if len(list) == count {
+				break
+			}
+			if !containsAddress(list, addr) {
+				list = append(list, addr)
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	addresses := make([]string, len(list))
+	for i, addr := range list {
+		if addr == nodeAddress {
+			addresses[i] = ftAddr
+			continue
+		}
+		var reply Reply
+		if err := callReplica(addr, "ChordService.GetFtAddress", &Msg{nodeAddress, key, -1, "file", ""}, &reply); err == nil {
+			addresses[i] = reply.Val
+		}
+	}
+	return addresses
+}
+
 //////////////////////////////////////////////////////
 /*			PUBLIC FUNCTIONS END 					*/
 //////////////////////////////////////////////////////
@@ -465,13 +558,16 @@ func manageHeartbeats() {
 				successorAddress = ""
 				successorIdentifier = -1
 				successorHandler = nil
+				successorListLock.Lock()
+				successorList = nil
+				successorListLock.Unlock()
 
 				// search for a new successor(?) TODO
 				findSuccessor()
 			} else {
 				str = fmt.Sprintf("Successor's heartbeat reply: %s\n", reply.Val)
-				successorMap = reply.DataMap
 				sectionedPrint(str)
+				updateSuccessorList()
 			}
 		}
 		if predecessorHandler != nil {
@@ -487,7 +583,6 @@ func manageHeartbeats() {
 				//findPredecessor()
 			} else {
 				str = fmt.Sprintf("Predecessor's heartbeat reply: %s\n", reply.Val)
-				predecessorMap = reply.DataMap
 				sectionedPrint(str)
 			}
 		}
@@ -503,7 +598,7 @@ func launchRPCService() {
 	// Set up RPC service
 	server := new(ChordService)
 	rpc.Register(server)
-	rpcAddr, err := net.ResolveTCPAddr("tcp", nodeAddress)
+	rpcAddr, err := net.ResolveTCPAddr("tcp", bindAddress)
 	checkError(err)
 	rpcListener, err := net.ListenTCP("tcp", rpcAddr)
 	checkError(err)
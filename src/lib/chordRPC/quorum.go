@@ -0,0 +1,473 @@
+package chordRPC
+
+import (
+	"../../consts"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"time"
+)
+
+//////////////////////////////////////////////////////
+/*			VERSIONED VALUES START					*/
+//////////////////////////////////////////////////////
+
+// Results of comparing two version vectors
+const (
+	Equal      = 0
+	Before     = -1 // every counter of a is <= the matching counter of b
+	After      = 1  // every counter of a is >= the matching counter of b
+	Concurrent = 2  // neither dominates the other
+)
+
+type (
+	// Per key version vector, one counter per coordinating node (advertised chord address)
+	VersionVector map[string]uint64
+
+	// A value together with the version vector of the writes it reflects
+	Versioned struct {
+		Value []byte
+		Clock VersionVector
+	}
+
+	// Argument of the StoreVersioned rpc
+	VersionedMsg struct {
+		Key       string
+		Versioned Versioned
+	}
+
+	// Reply of the FetchVersioned rpc. Found is false if the replica does not hold the key.
+	VersionedReply struct {
+		Found     bool
+		Versioned Versioned
+	}
+)
+
+/*
+* Compares two version vectors and returns Equal, Before, After or Concurrent
+ */
+func (a VersionVector) Compare(b VersionVector) int {
+	aBigger, bBigger := false, false
+	for node, count := range a {
+		if count > b[node] {
+			aBigger = true
+		}
+	}
+	for node, count := range b {
+		if count > a[node] {
+			bBigger = true
+		}
+	}
+	switch {
+	case aBigger && bBigger:
+		return Concurrent
+	case aBigger:
+		return After
+	case bBigger:
+		return Before
+	}
+	return Equal
+}
+
+/*
+* Returns a new version vector holding the pairwise maximum of both vectors
+ */
+func (a VersionVector) Merge(b VersionVector) VersionVector {
+	merged := make(VersionVector, len(a))
+	for node, count := range a {
+		merged[node] = count
+	}
+	for node, count := range b {
+		if count > merged[node] {
+			merged[node] = count
+		}
+	}
+	return merged
+}
+
+/*
+* Returns a copy of the version vector with the counter of node incremented
+ */
+func (a VersionVector) Increment(node string) VersionVector {
+	next := a.Merge(nil)
+	next[node]++
+	return next
+}
+
+func (a VersionVector) sum() uint64 {
+	var total uint64
+	for _, count := range a {
+		total += count
+	}
+	return total
+}
+
+/*
+* Reconciles two versions of a key. A version that dominates the other wins. Concurrent versions are resolved
+* deterministically (larger counter sum, then larger value bytes) and the winner gets the merged vector, so that
+* every replica picks the same value and the result dominates both inputs. Equal vectors with different values
+* (two writes coordinated by the same node from the same read) are resolved by the larger value bytes too.
+ */
+func reconcile(a Versioned, b Versioned) Versioned {
+	switch a.Clock.Compare(b.Clock) {
+	case After:
+		return a
+	case Before:
+		return b
+	case Equal:
+		if bytes.Compare(b.Value, a.Value) > 0 {
+			return b
+		}
+		return a
+	}
+	winner := a
+	if b.Clock.sum() > a.Clock.sum() || (b.Clock.sum() == a.Clock.sum() && bytes.Compare(b.Value, a.Value) > 0) {
+		winner = b
+	}
+	return Versioned{winner.Value, a.Clock.Merge(b.Clock)}
+}
+
+//////////////////////////////////////////////////////
+/*			VERSIONED VALUES END					*/
+//////////////////////////////////////////////////////
+
+//////////////////////////////////////////////////////
+/*			RPC FUNCTIONS (INBOUND) START			*/
+//////////////////////////////////////////////////////
+
+/*
+* Stores a versioned value on this replica, reconciling it with the version already held
+ */
+func (this *ChordService) StoreVersioned(msg *VersionedMsg, reply *Reply) error {
+	if err := storeLocal(msg.Key, msg.Versioned); err != nil {
+		return err
+	}
+	reply.Val = "ACK"
+	return nil
+}
+
+/*
+* Returns the version of a key held by this replica
+ */
+func (this *ChordService) FetchVersioned(msg *Msg, reply *VersionedReply) error {
+	reply.Versioned, reply.Found = loadLocal(msg.Key)
+	return nil
+}
+
+/*
+* Returns this node's successor list, closest successor first
+ */
+func (this *ChordService) GetSuccessorList(msg *Msg, reply *Reply) error {
+	reply.Addresses = SuccessorList()
+	return nil
+}
+
+//////////////////////////////////////////////////////
+/*				RPC FUNCTIONS (INBOUND) END			*/
+//////////////////////////////////////////////////////
+
+//////////////////////////////////////////////////////
+/*			PUBLIC FUNCTIONS START					*/
+//////////////////////////////////////////////////////
+
+/*
+* Sets the number of replicas per key (n), the read quorum (r) and the write quorum (w). r + w > n gives
+* read-your-writes consistency as long as the preference list does not change.
+ */
+func SetQuorum(n int, r int, w int) {
+	if r > n || w > n || n < 1 || r < 1 || w < 1 {
+		checkError(fmt.Errorf("invalid quorum N=%d R=%d W=%d", n, r, w))
+	}
+	consts.ReplicationN, consts.ReadQuorum, consts.WriteQuorum = n, r, w
+}
+
+/*
+* Returns this node's successor list, closest successor first
+ */
+func SuccessorList() []string {
+	successorListLock.RLock()
+	defer successorListLock.RUnlock()
+	return append([]string(nil), successorList...)
+}
+
+/*
+* Returns the chord addresses of the N replicas of a key: the node owning the key followed by its successors.
+* Returns an error if neither the successor nor any node of the successor list can be reached.
+ */
+func PreferenceList(key string) ([]string, error) {
+	owner, err := findOwner(key)
+	if err != nil {
+		return nil, err
+	}
+	list := []string{owner}
+	var successors []string
+	if owner == nodeAddress {
+		successors = SuccessorList()
+	} else {
+		var reply Reply
+		if err := callReplica(owner, "ChordService.GetSuccessorList", &Msg{nodeAddress, key, -1, "", ""}, &reply); err == nil {
+			successors = reply.Addresses
+		}
+	}
+	for _, addr := range successors {
+		if len(list) == consts.ReplicationN {
+			break
+		}
+		if !containsAddress(list, addr) {
+			list = append(list, addr)
+		}
+	}
+	return list, nil
+}
+
+/*
+* Writes value under key to the N replicas of the key and returns once W of them acknowledged the write. The new
+* version vector descends from every version seen by a read quorum, so the write supersedes them.
+ */
+func Put(key string, value []byte) error {
+	replicas, err := PreferenceList(key)
+	if err != nil {
+		return err
+	}
+	current, _, err := readQuorum(key, replicas)
+	if err != nil {
+		return err
+	}
+	next := Versioned{value, current.Clock.Increment(nodeAddress)}
+	return writeQuorum(key, next, replicas)
+}
+
+/*
+* Reads key from the N replicas and returns once R of them answered. Divergent versions are reconciled and stale
+* replicas are repaired in the background. Returns an error if the key does not exist or R replicas can't be
+* reached.
+ */
+func Get(key string) ([]byte, error) {
+	versioned, err := GetVersioned(key)
+	return versioned.Value, err
+}
+
+/*
+* Same as Get but also returns the version vector of the value
+ */
+func GetVersioned(key string) (Versioned, error) {
+	replicas, err := PreferenceList(key)
+	if err != nil {
+		return Versioned{}, err
+	}
+	versioned, found, err := readQuorum(key, replicas)
+	if err != nil {
+		return Versioned{}, err
+	}
+	if !found {
+		return Versioned{}, errors.New("chordRPC: key " + key + " not found")
+	}
+	return versioned, nil
+}
+
+//////////////////////////////////////////////////////
+/*			PUBLIC FUNCTIONS END 					*/
+//////////////////////////////////////////////////////
+
+// Result of a single replica read
+type replicaRead struct {
+	addr  string
+	reply VersionedReply
+	err   error
+}
+
+/*
+* Reads key from every replica in parallel and waits for R answers (or all of them to fail). The answers are
+* reconciled, and replicas that answered with a stale version (or not at all within the timeout) get the
+* reconciled version written back.
+ */
+func readQuorum(key string, replicas []string) (Versioned, bool, error) {
+	results := make(chan replicaRead, len(replicas))
+	for _, addr := range replicas {
+		go func(addr string) {
+			res := replicaRead{addr: addr}
+			if addr == nodeAddress {
+				res.reply.Versioned, res.reply.Found = loadLocal(key)
+			} else {
+				res.err = callReplica(addr, "ChordService.FetchVersioned", &Msg{nodeAddress, key, -1, "", ""}, &res.reply)
+			}
+			results <- res
+		}(addr)
+	}
+
+	needed := min(consts.ReadQuorum, len(replicas))
+	var answers []replicaRead
+	failures := 0
+	timeout := time.After(consts.QuorumTimeout)
+	for len(answers) < needed && failures <= len(replicas)-needed {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				failures++
+			} else {
+				answers = append(answers, res)
+			}
+		case <-timeout:
+			return Versioned{}, false, fmt.Errorf("chordRPC: read quorum for %s not reached (%d/%d)", key, len(answers), needed)
+		}
+	}
+	if len(answers) < needed {
+		return Versioned{}, false, fmt.Errorf("chordRPC: read quorum for %s not reached (%d/%d)", key, len(answers), needed)
+	}
+
+	var latest Versioned
+	found := false
+	for _, res := range answers {
+		if !res.reply.Found {
+			continue
+		}
+		if !found {
+			latest, found = res.reply.Versioned, true
+		} else {
+			latest = reconcile(latest, res.reply.Versioned)
+		}
+	}
+	if found {
+		go readRepair(key, latest, replicas, answers)
+	}
+	return latest, found, nil
+}
+
+/*
+* Writes the reconciled version back to every replica that did not answer with it
+ */
+func readRepair(key string, latest Versioned, replicas []string, answers []replicaRead) {
+	upToDate := make(map[string]bool)
+	for _, res := range answers {
+		if res.reply.Found && sameVersion(res.reply.Versioned, latest) {
+			upToDate[res.addr] = true
+		}
+	}
+	for _, addr := range replicas {
+		if !upToDate[addr] {
+			storeOn(addr, key, latest)
+		}
+	}
+}
+
+/*
+* Writes a version to every replica in parallel and waits for W acknowledgements
+ */
+func writeQuorum(key string, versioned Versioned, replicas []string) error {
+	acks := make(chan error, len(replicas))
+	for _, addr := range replicas {
+		go func(addr string) {
+			acks <- storeOn(addr, key, versioned)
+		}(addr)
+	}
+	needed := min(consts.WriteQuorum, len(replicas))
+	acked, failures := 0, 0
+	timeout := time.After(consts.QuorumTimeout)
+	for acked < needed {
+		select {
+		case err := <-acks:
+			if err != nil {
+				failures++
+				if failures > len(replicas)-needed {
+					return fmt.Errorf("chordRPC: write quorum for %s not reached (%d/%d): %v", key, acked, needed, err)
+				}
+			} else {
+				acked++
+			}
+		case <-timeout:
+			return fmt.Errorf("chordRPC: write quorum for %s not reached (%d/%d)", key, acked, needed)
+		}
+	}
+	return nil
+}
+
+func storeOn(addr string, key string, versioned Versioned) error {
+	if addr == nodeAddress {
+		return storeLocal(key, versioned)
+	}
+	var reply Reply
+	return callReplica(addr, "ChordService.StoreVersioned", &VersionedMsg{key, versioned}, &reply)
+}
+
+/*
+* Returns the chord address of the node owning key. The lookup starts at the successor and falls back to the next
+* entries of the successor list while the successor is down, as it is until stabilization replaces it.
+ */
+func findOwner(key string) (string, error) {
+	if successorAddress == "" && predecessorAddress == "" {
+		return nodeAddress, nil
+	}
+	msg := Msg{nodeAddress, key, getIdentifier(key), "file", ""}
+	err := errors.New("chordRPC: no successor to look up " + key)
+	for _, addr := range append([]string{successorAddress}, SuccessorList()...) {
+		if addr == "" || addr == nodeAddress {
+			continue
+		}
+		var reply Reply
+		if err = callReplica(addr, "ChordService.GetKeyInfo", &msg, &reply); err == nil {
+			return reply.Val, nil
+		}
+	}
+	return "", err
+}
+
+/*
+* Refreshes the successor list from the successor's own list. Called on every successful successor heartbeat.
+ */
+func updateSuccessorList() {
+	if successorAddress == "" {
+		return
+	}
+	var reply Reply
+	list := []string{successorAddress}
+	if err := callReplica(successorAddress, "ChordService.GetSuccessorList", &Msg{}, &reply); err == nil {
+		for _, addr := range reply.Addresses {
+			if len(list) >= consts.ReplicationN {
+				break
+			}
+			if addr != nodeAddress && !containsAddress(list, addr) {
+				list = append(list, addr)
+			}
+		}
+	}
+	successorListLock.Lock()
+	successorList = list
+	successorListLock.Unlock()
+}
+
+/*
+* Calls an rpc on a replica. Unlike getRpcHandler, failures are returned instead of exiting since replicas are
+* expected to fail.
+ */
+func callReplica(addr string, method string, args interface{}, reply interface{}) error {
+	conn, err := net.DialTimeout("tcp", addr, consts.QuorumTimeout)
+	if err != nil {
+		return err
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	select {
+	case call := <-client.Go(method, args, reply, make(chan *rpc.Call, 1)).Done:
+		return call.Error
+	case <-time.After(consts.QuorumTimeout):
+		return errors.New("chordRPC: " + method + " to " + addr + " timed out")
+	}
+}
+
+/*
+* Returns true if both versions have the same vector and value
+ */
+func sameVersion(a Versioned, b Versioned) bool {
+	return a.Clock.Compare(b.Clock) == Equal && bytes.Equal(a.Value, b.Value)
+}
+
+func containsAddress(list []string, addr string) bool {
+	for _, a := range list {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package chordRPC
+
+import (
+	"../kvstore"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+//////////////////////////////////////////////////////
+/*			LOCAL STORAGE START						*/
+//////////////////////////////////////////////////////
+
+/*
+* Sets the storage engine holding this node's owned and replica keys. Must be called before Start; without it the
+* keys are kept in memory and lost on restart.
+ */
+func SetStore(engine kvstore.Engine) {
+	store = engine
+}
+
+/*
+* Reconciles a version with the locally held one and stores the result
+ */
+func storeLocal(key string, versioned Versioned) error {
+	datamapLock.Lock()
+	defer datamapLock.Unlock()
+	if current, ok := loadLocal(key); ok {
+		versioned = reconcile(current, versioned)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(versioned); err != nil {
+		return err
+	}
+	if err := store.Put(key, buf.Bytes()); err != nil {
+		return err
+	}
+	datatree.Set(int(getIdentifier(key)), key, versionDigest(versioned))
+	return nil
+}
+
+func loadLocal(key string) (Versioned, bool) {
+	var versioned Versioned
+	data, err := store.Get(key)
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&versioned)
+	}
+	if err != nil {
+		if err != kvstore.ErrNotFound {
+			sectionedPrint(fmt.Sprintf("Unable to load key %s: %v\n", key, err))
+		}
+		return Versioned{}, false
+	}
+	return versioned, true
+}
+
+/*
+* Rebuilds the Merkle tree from the keys already in the store (e.g. after a restart)
+ */
+func loadMerkleTree() {
+	keys, err := store.Keys()
+	checkError(err)
+	for _, key := range keys {
+		if versioned, ok := loadLocal(key); ok {
+			datatree.Set(int(getIdentifier(key)), key, versionDigest(versioned))
+		}
+	}
+	str := fmt.Sprintf("Loaded %d keys from the local store\n", len(keys))
+	sectionedPrint(str)
+}
+
+//////////////////////////////////////////////////////
+/*			LOCAL STORAGE END						*/
+//////////////////////////////////////////////////////
@@ -0,0 +1,123 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Segments (and frames) of an encrypted video are sealed with AES-256-GCM under a key of their own video. The key
+// is not part of the published manifest, publishers hand it to viewers in the share link (see Link), so the nodes
+// storing the segments only ever see ciphertext.
+
+// Bytes of a file key
+const KeySize = 32
+
+// Returned by Open for a segment that was not sealed with the key, or was sealed for another position
+var ErrAuth = errors.New("crypt: segment authentication failed")
+
+// Returned by Open and ParseLink for keys of the wrong size
+var ErrKey = errors.New("crypt: invalid key")
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PUBLIC METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Returns a new random file key
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// key, err := crypt.NewKey()
+// sealed, err := crypt.Seal(key, "sample.mp4", 3, body)
+// fmt.Println(crypt.Link("sample.mp4", key)) // handed to viewers
+// body, err = crypt.Open(key, "sample.mp4", 3, sealed)
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Encrypts segment id of a file. The result is a random nonce followed by the ciphertext and its tag. The name and
+// id are authenticated, so a segment can't be passed off as another segment of the file.
+func Seal(key []byte, name string, id int, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, position(name, id)), nil
+}
+
+// Decrypts a segment sealed by Seal
+func Open(key []byte, name string, id int, sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrAuth
+	}
+	nonce := sealed[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], position(name, id))
+	if err != nil {
+		return nil, ErrAuth
+	}
+	return plaintext, nil
+}
+
+// Returns the share link of an encrypted file: its name followed by the key, e.g. sample.mp4#<key>
+func Link(name string, key []byte) string {
+	return name + "#" + base64.RawURLEncoding.EncodeToString(key)
+}
+
+// Splits a share link into the file name and key. A plain file name has no key (nil).
+func ParseLink(link string) (string, []byte, error) {
+	i := strings.LastIndex(link, "#")
+	if i < 0 {
+		return link, nil, nil
+	}
+	key, err := base64.RawURLEncoding.DecodeString(link[i+1:])
+	if err != nil || len(key) != KeySize {
+		return link[:i], nil, ErrKey
+	}
+	return link[:i], key, nil
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// HELPER METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Additional data binding a sealed segment to its file and position
+func position(name string, id int) []byte {
+	return []byte(name + "/" + strconv.Itoa(id))
+}
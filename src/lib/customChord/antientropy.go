@@ -0,0 +1,378 @@
+package customChord
+
+import (
+  "../merkle"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "math"
+  "strconv"
+  "strings"
+  "unicode/utf8"
+)
+
+// =======================================================================
+// ===================== Merkle tree anti-entropy ========================
+// =======================================================================
+
+// Every node keeps a Merkle tree over its own frames (dataTree) and one over the copy it holds of each
+// neighbour's frames. Heartbeats carry the root of the sender's tree. When it differs from the receiver's copy,
+// the receiver walks down the sender's tree one level per round trip and only fetches the frames of the
+// leaves that differ:
+//
+//   _heartbeat      Val holds the root of the sender's tree (hex)
+//   _merkleNodes    Key holds comma separated tree nodes to get the hashes of
+//   _resMerkleNodes Key holds the nodes, Val their comma separated hashes (hex)
+//   _syncLeaves     Key holds the differing leaves, Val the requester's frame digests in those leaves (json)
+//   _resSyncLeaves  Key holds the leaves, Val every frame key the sender holds in them (json)
+//   _resSyncFrame   Store holds a chunk of a frame that was missing or differed, Key the frame key and Val
+//                   "chunk/chunks/digest" (digest in hex). Chunks keep each datagram within the udp limit.
+//
+// A leaf can hold a whole folder of frames, so _syncLeaves and _resSyncLeaves are sent in chunks of their Val as
+// well (see sendChunked), with Type holding "chunk/chunks/digest".
+
+var frameChunk = 32 * 1024 // bytes of a frame per _resSyncFrame, json encodes them in base64
+var messageChunk = 16 * 1024 // bytes of Val per message, escaping it in json at most doubles its size
+
+type pendingMessage struct {
+  digest string
+  parts []string
+}
+
+var dataTree *merkle.Tree
+var successorTree *merkle.Tree
+var predecessorTree *merkle.Tree
+var pendingFrames map[string][][]byte // chunks of the frames being synced, by neighbour, frame key and digest
+var pendingMessages map[string]*pendingMessage // chunks of the messages being received, by neighbour and command
+
+func initMerkleTrees() {
+  leaves := int(math.Pow(2, m))
+  dataTree = merkle.New(leaves)
+  successorTree = merkle.New(leaves)
+  predecessorTree = merkle.New(leaves)
+  dataMapSuccessor = make(map[string]VidFrames)
+  dataMapPredecessor = make(map[string]VidFrames)
+  pendingFrames = make(map[string][][]byte)
+  pendingMessages = make(map[string]*pendingMessage)
+}
+
+/*
+* Frames are keyed as "folder/filename" in the trees and placed in the leaf of the folder's identifier
+*/
+func frameKey(foldername string, filename string) string {
+  return foldername + "/" + filename
+}
+
+func splitFrameKey(key string) (string, string) {
+  i := strings.LastIndex(key, "/")
+  return key[:i], key[i+1:]
+}
+
+/*
+* Returns the copy of the frames and the tree held for a neighbour, or nil if addr isn't a neighbour
+*/
+func mirrorFor(addr string) (map[string]VidFrames, *merkle.Tree) {
+  if addr == successorAddr {
+    return dataMapSuccessor, successorTree
+  }
+  if addr == predecessorAddr {
+    return dataMapPredecessor, predecessorTree
+  }
+  return nil, nil
+}
+
+/*
+* Called on a neighbour's heartbeat. Starts a sync if the neighbour's root differs from our copy.
+*/
+func compareRoot(addr string, root string) {
+  _, tree := mirrorFor(addr)
+  if tree == nil || root == "" || root == hex.EncodeToString(tree.Root()) {
+    return
+  }
+  fmt.Println("Merkle root of ", addr, " changed. Syncing...")
+  requestMerkleNodes(addr, []int{1})
+}
+
+func requestMerkleNodes(addr string, nodes []int) {
+  msg := CommandMessage{"_merkleNodes", myAddr, addr, joinInts(nodes), "", nil, ""}
+  sendMessage(addr, getJSONBytes(msg))
+}
+
+/*
+* Answers a _merkleNodes request with the hashes of our own tree
+*/
+func sendMerkleNodes(msg CommandMessage) {
+  nodes := splitInts(msg.Key)
+  hashes := dataTree.Hashes(nodes)
+  encoded := make([]string, len(hashes))
+  for i, h := range hashes {
+    encoded[i] = hex.EncodeToString(h)
+  }
+  responseMsg := CommandMessage{"_resMerkleNodes", myAddr, msg.SourceAddr, msg.Key, strings.Join(encoded, ","), nil, ""}
+  sendMessage(msg.SourceAddr, getJSONBytes(responseMsg))
+}
+
+/*
+* Compares a neighbour's node hashes with our copy. Descends into differing inner nodes and requests the frames
+* of differing leaves.
+*/
+func handleMerkleNodes(msg CommandMessage) {
+  _, tree := mirrorFor(msg.SourceAddr)
+  if tree == nil {
+    return
+  }
+  nodes := splitInts(msg.Key)
+  remote := strings.Split(msg.Val, ",")
+  local := tree.Hashes(nodes)
+
+  var next []int
+  var leaves []int
+  for i, node := range nodes {
+    if i < len(remote) && remote[i] == hex.EncodeToString(local[i]) {
+      continue
+    }
+    if node >= tree.Leaves() {
+      leaves = append(leaves, node - tree.Leaves())
+    } else {
+      next = append(next, 2 * node, 2 * node + 1)
+    }
+  }
+  if len(next) > 0 {
+    requestMerkleNodes(msg.SourceAddr, next)
+  }
+  if len(leaves) > 0 {
+    digests := make(map[string][]byte)
+    for _, leaf := range leaves {
+      for key, digest := range tree.Keys(leaf) {
+        digests[key] = digest
+      }
+    }
+    b, err := json.Marshal(digests)
+    checkError(err)
+    responseMsg := CommandMessage{"_syncLeaves", myAddr, msg.SourceAddr, joinInts(leaves), string(b), nil, ""}
+    sendChunked(msg.SourceAddr, responseMsg)
+  }
+}
+
+/*
+* Answers a _syncLeaves request: sends the keys we hold in those leaves, then every frame the requester is
+* missing or holds a different version of, in chunks of frameChunk bytes.
+*/
+func sendLeaves(msg CommandMessage) {
+  var remote map[string][]byte
+  err := json.Unmarshal([]byte(msg.Val), &remote)
+  checkError(err)
+
+  var held []string
+  var differing []string
+  for _, leaf := range splitInts(msg.Key) {
+    local := dataTree.Keys(leaf)
+    for key := range local {
+      held = append(held, key)
+    }
+    for _, key := range merkle.DiffKeys(local, remote) {
+      if _, ok := local[key]; ok {
+        differing = append(differing, key)
+      }
+    }
+  }
+  b, err := json.Marshal(held)
+  checkError(err)
+  responseMsg := CommandMessage{"_resSyncLeaves", myAddr, msg.SourceAddr, msg.Key, string(b), nil, ""}
+  sendChunked(msg.SourceAddr, responseMsg)
+
+  for _, key := range differing {
+    sendFrame(msg.SourceAddr, key)
+  }
+}
+
+func sendFrame(addr string, key string) {
+  foldername, filename := splitFrameKey(key)
+  data := dataMap[foldername].Data[filename]
+  digest := hex.EncodeToString(merkle.Digest(data))
+  chunks := (len(data) + frameChunk - 1) / frameChunk
+  if chunks == 0 {
+    chunks = 1
+  }
+  for i := 0; i < chunks; i++ {
+    end := (i + 1) * frameChunk
+    if end > len(data) {
+      end = len(data)
+    }
+    frame := VidFrames{foldername, filename, 1, map[string][]byte{filename: data[i * frameChunk:end]}}
+    val := strconv.Itoa(i) + "/" + strconv.Itoa(chunks) + "/" + digest
+    frameMsg := CommandMessage{"_resSyncFrame", myAddr, addr, key, val, map[string]VidFrames{foldername: frame}, ""}
+    sendMessage(addr, getJSONBytes(frameMsg))
+  }
+}
+
+/*
+* Drops the frames of our copy that the neighbour no longer holds in the synced leaves
+*/
+func handleLeaves(msg CommandMessage) {
+  mirror, tree := mirrorFor(msg.SourceAddr)
+  if tree == nil {
+    return
+  }
+  var held []string
+  err := json.Unmarshal([]byte(msg.Val), &held)
+  checkError(err)
+  // a new round starts, chunks lost in earlier rounds are sent again
+  for pending := range pendingFrames {
+    if strings.HasPrefix(pending, msg.SourceAddr + " ") {
+      delete(pendingFrames, pending)
+    }
+  }
+  keep := make(map[string]bool)
+  for _, key := range held {
+    keep[key] = true
+  }
+  for _, leaf := range splitInts(msg.Key) {
+    for key := range tree.Keys(leaf) {
+      if !keep[key] {
+        foldername, filename := splitFrameKey(key)
+        delete(mirror[foldername].Data, filename)
+        tree.Delete(leaf, key)
+      }
+    }
+  }
+}
+
+/*
+* Collects the chunks of a frame received from a neighbour and stores the frame in our copy of its frames once
+* every chunk arrived
+*/
+func handleFrame(msg CommandMessage) {
+  mirror, tree := mirrorFor(msg.SourceAddr)
+  if tree == nil {
+    return
+  }
+  parts := strings.Split(msg.Val, "/")
+  if len(parts) != 3 {
+    return
+  }
+  chunk, err := strconv.Atoi(parts[0])
+  if err != nil {
+    return
+  }
+  chunks, err := strconv.Atoi(parts[1])
+  if err != nil || chunk < 0 || chunk >= chunks {
+    return
+  }
+  pending := msg.SourceAddr + " " + msg.Key + " " + parts[2]
+  if len(pendingFrames[pending]) != chunks {
+    pendingFrames[pending] = make([][]byte, chunks)
+  }
+  for _, frame := range msg.Store {
+    for _, data := range frame.Data {
+      pendingFrames[pending][chunk] = append([]byte{}, data...)
+    }
+  }
+  var data []byte
+  for _, part := range pendingFrames[pending] {
+    if part == nil {
+      return
+    }
+    data = append(data, part...)
+  }
+  delete(pendingFrames, pending)
+  if hex.EncodeToString(merkle.Digest(data)) != parts[2] {
+    fmt.Println("Frame ", msg.Key, " from ", msg.SourceAddr, " does not match its digest")
+    return
+  }
+
+  foldername, filename := splitFrameKey(msg.Key)
+  if mirror[foldername].Data == nil {
+    mirror[foldername] = VidFrames{foldername, filename, 0, make(map[string][]byte)}
+  }
+  mirror[foldername].Data[filename] = data
+  tree.Set(int(GetIdentifier(foldername)), msg.Key, merkle.Digest(data))
+}
+
+/*
+* Sends msg with its Val split into chunks of messageChunk bytes, each chunk in a message of its own
+*/
+func sendChunked(addr string, msg CommandMessage) {
+  val := msg.Val
+  if len(val) <= messageChunk {
+    sendMessage(addr, getJSONBytes(msg))
+    return
+  }
+  var parts []string
+  for len(val) > messageChunk {
+    end := messageChunk
+    // json replaces split characters, so chunks end on a character boundary
+    for end > 1 && !utf8.RuneStart(val[end]) {
+      end--
+    }
+    parts = append(parts, val[:end])
+    val = val[end:]
+  }
+  parts = append(parts, val)
+  digest := hex.EncodeToString(merkle.Digest([]byte(msg.Val)))
+  for i, part := range parts {
+    msg.Val = part
+    msg.Type = strconv.Itoa(i) + "/" + strconv.Itoa(len(parts)) + "/" + digest
+    sendMessage(addr, getJSONBytes(msg))
+  }
+}
+
+/*
+* Collects the chunks of a message sent by sendChunked. Returns the whole message once every chunk arrived. Chunks of
+* an earlier message of the same command are dropped when a newer one starts arriving.
+*/
+func receiveChunked(msg CommandMessage) (CommandMessage, bool) {
+  if msg.Type == "" {
+    return msg, true
+  }
+  fields := strings.Split(msg.Type, "/")
+  if len(fields) != 3 {
+    return msg, false
+  }
+  chunk, err := strconv.Atoi(fields[0])
+  if err != nil {
+    return msg, false
+  }
+  chunks, err := strconv.Atoi(fields[1])
+  if err != nil || chunk < 0 || chunk >= chunks || msg.Val == "" {
+    return msg, false
+  }
+  id := msg.SourceAddr + " " + msg.Cmd
+  pending := pendingMessages[id]
+  if pending == nil || pending.digest != fields[2] || len(pending.parts) != chunks {
+    pending = &pendingMessage{fields[2], make([]string, chunks)}
+    pendingMessages[id] = pending
+  }
+  pending.parts[chunk] = msg.Val
+  for _, part := range pending.parts {
+    if part == "" {
+      return msg, false
+    }
+  }
+  delete(pendingMessages, id)
+  msg.Val = strings.Join(pending.parts, "")
+  msg.Type = ""
+  if hex.EncodeToString(merkle.Digest([]byte(msg.Val))) != fields[2] {
+    fmt.Println("Message ", msg.Cmd, " from ", msg.SourceAddr, " does not match its digest")
+    return msg, false
+  }
+  return msg, true
+}
+
+func joinInts(values []int) string {
+  strs := make([]string, len(values))
+  for i, v := range values {
+    strs[i] = strconv.Itoa(v)
+  }
+  return strings.Join(strs, ",")
+}
+
+func splitInts(str string) []int {
+  var values []int
+  for _, s := range strings.Split(str, ",") {
+    if v, err := strconv.Atoi(s); err == nil {
+      values = append(values, v)
+    }
+  }
+  return values
+}
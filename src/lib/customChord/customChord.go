@@ -17,6 +17,8 @@ package customChord
 */
 
 import (
+  "../merkle"
+  "../utility"
   "crypto/sha1"
   "encoding/hex"
   "encoding/json"
@@ -30,9 +32,10 @@ import (
   "strconv"
   "math/big"
   "runtime"
-  //"strings"
+  "strings"
   //"./lib/fileshare"
   "reflect"
+  "sync"
 )
 
 // =======================================================================
@@ -73,16 +76,21 @@ var predecessorAddr string
 var identifier int64
 var m float64
 var c chan string
-var myAddr string
+var myAddr string // canonical advertised address, hashed into identifier
+var bindAddr string // local address the udp listener binds to
 var fileTransferAddr string
 
 var streamServerAddress string
 var streamClientAddress string
 var nodename string
+var StoreBackupFrame func(folder string, frame string, data []byte) error // stores a frame replicated from a neighbour
+var RemoveBackupFolder func(folder string) error // removes the frames StoreBackupFrame stored for a folder
+var TakeOverFolder func(folder string) error // serves the frames StoreBackupFrame stored for a folder of a failed neighbour
 
 var successorAliveChannel chan bool
 var predecessorAliveChannel chan bool
 var streamServerChannel chan string
+var streamServerLock sync.Mutex // one streaming server lookup at a time, replies arrive on streamServerChannel
 var fileTransferChannel chan string
 
 // =======================================================================
@@ -127,9 +135,10 @@ func printFingerTable() {
 
 /*
 * Send a heartbeat message to let inquiring node know that we're still alive
+* Carries the Merkle root of this node's frames instead of the frames themselves
 */
 func sendAliveMessage(addr string) {
-      msg := CommandMessage{"_heartbeat", myAddr, addr, strconv.FormatInt(identifier, 10), myAddr, dataMap, ""}
+      msg := CommandMessage{"_heartbeat", myAddr, addr, strconv.FormatInt(identifier, 10), hex.EncodeToString(dataTree.Root()), nil, ""}
       aliveMessage, err := json.Marshal(msg)
       checkError(err)
       b := []byte(aliveMessage)
@@ -164,6 +173,7 @@ func handlePredecessorHeartbeats() {
         fmt.Println("Heartbeat from predecessor", predecessorAddr)
       case <-timeout_p:
         fmt.Println("Timed out on predecessor heartbeat")
+        takeOver(dataMapPredecessor)
         predecessor = -1
         predecessorAddr = ""
         //stabilizeNode()
@@ -479,10 +489,11 @@ func sendPredInfo(src string, succ string) {
 /*
 * Initializes the P2P system
 * Responsible for triggering heartbeat goroutines, backup goroutine and command loop
+* Listens on bindAddr while nodeAddr is the advertised address used in replies
 */
 func startUpSystem(nodeAddr string) {
 
-  serverAddr, err := net.ResolveUDPAddr("udp", nodeAddr)
+  serverAddr, err := net.ResolveUDPAddr("udp", bindAddr)
   checkError(err)
 
   //go handlePredecessorHeartbeats()
@@ -497,7 +508,7 @@ func startUpSystem(nodeAddr string) {
   defer conn.Close()
 
   var msg CommandMessage
-  buf := make([]byte, 2048)
+  buf := make([]byte, 65535) // frames synced by anti-entropy are sent in chunks of frameChunk bytes
 
   for {
     // fmt.Println("Waiting for packet to arrive on udp port...")
@@ -514,6 +525,10 @@ func startUpSystem(nodeAddr string) {
         // copy files and adjust store (?)
         copyFiles(msg.Store)
 
+      case "_deleteFolder":
+        fmt.Println("Dropping backup of unpublished folder ", msg.Key, " from: ", msg.SourceAddr)
+        dropFolder(msg.SourceAddr, msg.Key)
+
       case "_fileProposal":
         fmt.Printf("Received proposal for file %s with identifier %s\n", msg.Key, msg.Val)
         cmdMsg := CommandMessage{"_resFileProposal", myAddr, msg.SourceAddr, msg.Key, fileTransferAddr, nil, msg.Type}
@@ -588,15 +603,29 @@ func startUpSystem(nodeAddr string) {
         if msg.SourceAddr == successorAddr {
           // successor is still alive so all good
           // fmt.Println("SUCCESSOR ALIVE!")
-          dataMapSuccessor = msg.Store
+          compareRoot(msg.SourceAddr, msg.Val)
           successorAliveChannel <- true
         }
         if msg.SourceAddr == predecessorAddr {
           // predecessor is still alive so all good
           // fmt.Println("PREDECESSOR ALIVE!")
-          dataMapPredecessor = msg.Store
+          compareRoot(msg.SourceAddr, msg.Val)
           predecessorAliveChannel <- true
         }
+      case "_merkleNodes":
+        sendMerkleNodes(msg)
+      case "_resMerkleNodes":
+        handleMerkleNodes(msg)
+      case "_syncLeaves":
+        if whole, ok := receiveChunked(msg); ok {
+          sendLeaves(whole)
+        }
+      case "_resSyncLeaves":
+        if whole, ok := receiveChunked(msg); ok {
+          handleLeaves(whole)
+        }
+      case "_resSyncFrame":
+        handleFrame(msg)
       case "_alive?":
         // received an alive query - send back message to tell I'm still here
         // ISSUE: if i remove else if (just use if which I should logically), then
@@ -802,9 +831,19 @@ func maintainBackup() {
   }
 }
 
+/*
+* Keeps the frames replicated from a neighbour. StoreBackupFrame, if set, stores them within this node's storage
+* quota, frames that do not fit are skipped.
+*/
 func copyFiles(m map[string]VidFrames) {
   for _, vf := range m {
     for filename, data := range vf.Data {
+        if StoreBackupFrame != nil {
+          if err := StoreBackupFrame(vf.Name, filename, data); err != nil {
+            fmt.Println("Backup frame " + vf.Name + "/" + filename + " not kept: " + err.Error())
+          }
+          continue
+        }
         path := "FFMPEG/NodesData/" + nodename + "/sample/" + filename
         err := ioutil.WriteFile(path, data, 0644)
         checkError(err)
@@ -813,6 +852,61 @@ func copyFiles(m map[string]VidFrames) {
   }
 }
 
+/*
+* Takes over the folders of a failed predecessor, whose keys this node is now responsible for: our copy of its
+* frames is stored and served as this node's own.
+*/
+func takeOver(mirror map[string]VidFrames) {
+  if StoreBackupFrame == nil || TakeOverFolder == nil {
+    return
+  }
+  copyFiles(mirror)
+  for foldername := range mirror {
+    if err := TakeOverFolder(foldername); err != nil {
+      fmt.Println("Backup of " + foldername + " not taken over: " + err.Error())
+    }
+  }
+}
+
+/*
+* Removes the frames of an unpublished folder from this node and tells both neighbours to drop their copies
+*/
+func RemoveFolder(foldername string) {
+  for filename := range dataMap[foldername].Data {
+    dataTree.Delete(int(GetIdentifier(foldername)), frameKey(foldername, filename))
+  }
+  delete(dataMap, foldername)
+  for key := range store {
+    if key == foldername || strings.HasPrefix(key, foldername + " ") {
+      delete(store, key)
+    }
+  }
+  for _, addr := range []string{successorAddr, predecessorAddr} {
+    if addr != "" && addr != myAddr {
+      msg := CommandMessage{"_deleteFolder", myAddr, addr, foldername, "", nil, ""}
+      sendMessage(addr, getJSONBytes(msg))
+    }
+  }
+}
+
+/*
+* Drops a neighbour's folder from our copy of its frames, including the frames kept on disk
+*/
+func dropFolder(addr string, foldername string) {
+  mirror, tree := mirrorFor(addr)
+  if tree != nil {
+    for filename := range mirror[foldername].Data {
+      tree.Delete(int(GetIdentifier(foldername)), frameKey(foldername, filename))
+    }
+    delete(mirror, foldername)
+  }
+  if RemoveBackupFolder != nil {
+    if err := RemoveBackupFolder(foldername); err != nil {
+      fmt.Println("Backup of " + foldername + " not removed: " + err.Error())
+    }
+  }
+}
+
 // key is filename/foldername and val is the segment sequence number this node holds
 
 func SetStoreVal(filename string) {
@@ -879,6 +973,7 @@ func SaveToStore(foldername string, filename string, data []byte) {
     fmt.Println("Entry exists")
     dataMap[foldername].Data[filename] = data
   }
+  dataTree.Set(int(GetIdentifier(foldername)), frameKey(foldername, filename), merkle.Digest(data))
 }
 
 func GetStreamingServer(filename string) string {
@@ -887,6 +982,8 @@ func GetStreamingServer(filename string) string {
     return streamServerAddress
   }
   //arr := strings.Split(filename, " ")
+  streamServerLock.Lock()
+  defer streamServerLock.Unlock()
   iden := GetIdentifier(filename)
   getNodeInfo(myAddr, iden, "streamServer")
   fmt.Println("Sent node info message")
@@ -903,14 +1000,19 @@ func GetStreamingServer(filename string) string {
   return addr
 }
 
-func Start(thisAddr string, startNodeAddr string, ssa string, sca string, ftAddr string, name string) {
+/*
+* Starts the node. thisAddr is the local udp address to bind to and advertiseAddr the address other nodes use to
+* reach it (empty to advertise thisAddr). ssa, sca and ftAddr must already be advertised addresses.
+*/
+func Start(thisAddr string, advertiseAddr string, startNodeAddr string, ssa string, sca string, ftAddr string, name string) {
   // Handle the command line.
   //if len(os.Args) != 3 {
   // fmt.Println("Usage: go run node.go [node ip:port] [starter-node ip:port]")
   //  os.Exit(-1)
   //} else {
-    myAddr = thisAddr // ip:port of this node
-    startAddr := startNodeAddr // ip:port of initial node
+    bindAddr = thisAddr
+    myAddr = utility.AdvertiseAddr(thisAddr, advertiseAddr) // ip:port of this node
+    startAddr := utility.AdvertiseAddr(startNodeAddr, "") // ip:port of initial node
     streamServerAddress = ssa
     streamClientAddress = sca
     fileTransferAddr = ftAddr
@@ -920,6 +1022,7 @@ func Start(thisAddr string, startNodeAddr string, ssa string, sca string, ftAddr
     ftab = make(map[int64]string)
     dataMap = make(map[string]VidFrames)
     m = 3
+    initMerkleTrees()
     replicationFactor = 1
     successor = -1
     successorAddr = ""
@@ -936,7 +1039,7 @@ func Start(thisAddr string, startNodeAddr string, ssa string, sca string, ftAddr
 
     // fmt.Println("THIS NODE'S IDENTIFIER IS: ", identifier)
 
-    if (myAddr == startAddr) {
+    if (myAddr == startAddr || thisAddr == startNodeAddr) {
       // fmt.Println("First node in system. Listening for incoming connections...")
       go startUpSystem(myAddr)
     } else {
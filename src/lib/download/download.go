@@ -0,0 +1,410 @@
+package download
+
+import (
+	"../../consts"
+	"../catalog"
+	"../colorprint"
+	"../filemgmt"
+	"../kvstore"
+	"../manifest"
+	"../utility"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// State of a download
+type State string
+
+const (
+	Running   State = "running"
+	Paused    State = "paused"
+	Failed    State = "failed" // a segment could not be fetched from any holder, can be resumed
+	Complete  State = "complete"
+	Cancelled State = "cancelled"
+)
+
+// A file being fetched to this node. The progress is written to the manager's engine, so a download interrupted by
+// a restart resumes with the segments that are still missing.
+type Download struct {
+	Name       string
+	Manifest   manifest.Manifest // as published when the download started, segments are verified against it
+	From       int               // segment fetched first, the segments before it are fetched last
+	Background bool              // fetched rarest first to keep a copy, not in order for playing
+	Done       catalog.Bitmap    // verified segments stored on this node
+	Holders    map[int]string    // node each segment was fetched from
+	State      State
+	Error      string // why the download failed
+}
+
+// Fetches segments ids of a file and passes every segment to deliver with the address of the node it came from ("" if
+// unknown). Segments are fetched in the order of ids, or the ones held by the fewest nodes first with rarestFirst.
+// hints has the holders segments were fetched from before. Stops with the error of deliver if it fails.
+type Fetcher func(m manifest.Manifest, ids []int, hints map[int]string, rarestFirst bool, deliver func(utility.VidSegment, string) error) error
+
+// Runs the downloads of a node
+type Manager struct {
+	store     kvstore.Engine
+	fetch     Fetcher
+	downloads map[string]*Download
+	running   map[*Download]bool // downloads with a running fetch loop
+	changed   *sync.Cond         // signalled whenever a segment is done or a download stops
+	lock      sync.Mutex
+}
+
+// Returned for downloads the manager does not know
+var ErrNotFound = errors.New("download: no such download")
+
+// Returned by Segment once the download was cancelled
+var ErrCancelled = errors.New("download: cancelled")
+
+// Returned to the fetcher once the download was paused or cancelled
+var errStopped = errors.New("download: stopped")
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PUBLIC METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Loads the downloads stored in engine. Nothing is fetched until Start or ResumeInterrupted is called.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// store, err := kvstore.OpenLog("./lib/filesys/downloads.log", kvstore.DefaultOptions())
+// downloads, err := download.Open(store, fetch)
+// err = downloads.Start(m, 1)
+// vidSeg, err := downloads.Segment("sample.mp4", 1) // waits until segment 1 is stored
+func Open(store kvstore.Engine, fetch Fetcher) (*Manager, error) {
+	mgr := &Manager{
+		store:     store,
+		fetch:     fetch,
+		downloads: make(map[string]*Download),
+		running:   make(map[*Download]bool),
+	}
+	mgr.changed = sync.NewCond(&mgr.lock)
+	names, err := store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		data, err := store.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		var d Download
+		if err = json.Unmarshal(data, &d); err != nil {
+			return nil, err
+		}
+		mgr.downloads[name] = &d
+	}
+	return mgr, nil
+}
+
+// Starts fetching a file for playing, in order beginning with segment from. A download of the same file that was
+// interrupted, paused, failed or running in the background is resumed instead, unless the file was published again
+// since.
+func (mgr *Manager) Start(m manifest.Manifest, from int) error {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	return mgr.start(m, from, false)
+}
+
+// Starts fetching a whole file in the background, the segments held by the fewest nodes first, so that this node
+// keeps a copy of them should their holders leave. A download of the file for playing keeps its order.
+func (mgr *Manager) Fetch(m manifest.Manifest) error {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	if d, ok := mgr.downloads[m.Name]; ok && !d.Background && sameContent(d.Manifest, m) {
+		return mgr.resume(d)
+	}
+	return mgr.start(m, 1, true)
+}
+
+// Resumes a paused or failed download
+func (mgr *Manager) Resume(name string) error {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	d, ok := mgr.downloads[name]
+	if !ok {
+		return ErrNotFound
+	}
+	return mgr.resume(d)
+}
+
+// Resumes the downloads that were running when the node stopped. Call once the overlay is up.
+func (mgr *Manager) ResumeInterrupted() {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	for _, d := range mgr.downloads {
+		if d.State == Running {
+			colorprint.Info("Resuming download of " + d.Name + " (" + strconv.Itoa(d.Done.Count()) + " of " +
+				strconv.FormatInt(d.Manifest.SegNums, 10) + " segments done)")
+			mgr.resume(d)
+		}
+	}
+}
+
+// Stops a download once the segments being fetched arrive. It keeps its progress and can be resumed.
+func (mgr *Manager) Pause(name string) error {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	d, ok := mgr.downloads[name]
+	if !ok {
+		return ErrNotFound
+	}
+	if d.State != Running {
+		return errors.New("download: " + name + " is " + string(d.State))
+	}
+	d.State = Paused
+	mgr.changed.Broadcast()
+	return mgr.save(d)
+}
+
+// Stops a download and forgets its progress. The segments fetched so far stay in the local store as cached
+// segments, so they are evicted when the space is needed.
+func (mgr *Manager) Cancel(name string) error {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	d, ok := mgr.downloads[name]
+	if !ok {
+		return ErrNotFound
+	}
+	d.State = Cancelled
+	delete(mgr.downloads, name)
+	mgr.changed.Broadcast()
+	return mgr.store.Delete(name)
+}
+
+// Returns a copy of a download
+func (mgr *Manager) Get(name string) (Download, bool) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	d, ok := mgr.downloads[name]
+	if !ok {
+		return Download{}, false
+	}
+	return d.copy(), true
+}
+
+// Returns a copy of every download
+func (mgr *Manager) List() []Download {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	list := make([]Download, 0, len(mgr.downloads))
+	for _, d := range mgr.downloads {
+		list = append(list, d.copy())
+	}
+	return list
+}
+
+// Returns the published hash of a segment of a download, "" if the file is not being downloaded
+func (mgr *Manager) PublishedHash(name string, id int) string {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	if d, ok := mgr.downloads[name]; ok {
+		return d.Manifest.Hash(id)
+	}
+	return ""
+}
+
+// Waits until segment id of a download is stored and returns it. While the download is paused this keeps waiting,
+// so a player simply stalls. Returns an error if the download failed before the segment or was cancelled.
+func (mgr *Manager) Segment(name string, id int) (utility.VidSegment, error) {
+	mgr.lock.Lock()
+	for {
+		d, ok := mgr.downloads[name]
+		if !ok {
+			mgr.lock.Unlock()
+			return utility.VidSegment{}, ErrCancelled
+		}
+		if d.Done.Has(int64(id)) {
+			break
+		}
+		if d.State == Failed || d.State == Complete {
+			mgr.lock.Unlock()
+			return utility.VidSegment{}, errors.New("download: segment " + strconv.Itoa(id) + " of " + name +
+				" unavailable: " + d.Error)
+		}
+		mgr.changed.Wait()
+	}
+	mgr.lock.Unlock()
+	return filemgmt.ReadSegment(name, id)
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// HELPER METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Starts or restarts the download of a file. Must hold the lock.
+func (mgr *Manager) start(m manifest.Manifest, from int, background bool) error {
+	d, ok := mgr.downloads[m.Name]
+	if ok && !sameContent(d.Manifest, m) {
+		// the fetch loop of the old content stops
+		d.State = Cancelled
+		ok = false
+	}
+	if !ok {
+		d = &Download{Name: m.Name, Manifest: m, Holders: make(map[int]string)}
+		mgr.downloads[m.Name] = d
+	}
+	if from < 1 || from > int(m.SegNums) {
+		from = 1
+	}
+	d.From = from
+	d.Background = background
+	return mgr.resume(d)
+}
+
+// Marks a download as running and starts its fetch loop unless it is still running. A complete download is checked
+// again, since its segments may have been evicted since. Must hold the lock.
+func (mgr *Manager) resume(d *Download) error {
+	d.State = Running
+	d.Error = ""
+	if err := mgr.save(d); err != nil {
+		return err
+	}
+	if !mgr.running[d] {
+		mgr.running[d] = true
+		go mgr.run(d)
+	}
+	return nil
+}
+
+// Fetches the missing segments of a download, in order starting at d.From or rarest first in the background, until
+// every segment is done or the download stops. Segments already in the local store (e.g. fetched after the last
+// checkpoint) are not fetched again, segments marked done that are no longer stored are. The fetch starts over when
+// the download is started again with another order.
+func (mgr *Manager) run(d *Download) {
+	m := d.Manifest
+	mgr.lock.Lock()
+	from, background := d.From, d.Background
+	mgr.lock.Unlock()
+	fetched := 0
+	var missing []int
+	hints := make(map[int]string)
+	for n := 0; n < int(m.SegNums); n++ {
+		id := (from-1+n)%int(m.SegNums) + 1
+		mgr.lock.Lock()
+		hint := d.Holders[id]
+		mgr.lock.Unlock()
+		if filemgmt.SegmentHash(m.Name, id) == m.Hash(id) {
+			mgr.finish(d, id, hint, &fetched)
+			continue
+		}
+		mgr.lock.Lock()
+		d.Done = d.Done.Clear(int64(id))
+		mgr.lock.Unlock()
+		missing = append(missing, id)
+		if hint != "" {
+			hints[id] = hint
+		}
+	}
+
+	var err error
+	if len(missing) > 0 {
+		err = mgr.fetch(m, missing, hints, background, func(vidSeg utility.VidSegment, holder string) error {
+			mgr.lock.Lock()
+			running := d.State == Running
+			mgr.lock.Unlock()
+			if !running {
+				return errStopped
+			}
+			if vidSeg.Hash != m.Hash(vidSeg.Id) {
+				return errors.New("checksum mismatch of segment " + strconv.Itoa(vidSeg.Id))
+			}
+			if err := filemgmt.CacheVidSegment(m.Name, m.SegNums, vidSeg); err != nil {
+				return err
+			}
+			mgr.finish(d, vidSeg.Id, holder, &fetched)
+			mgr.lock.Lock()
+			defer mgr.lock.Unlock()
+			if d.From != from || d.Background != background {
+				return errStopped
+			}
+			return nil
+		})
+	}
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	switch {
+	case err == errStopped && d.State == Running:
+		// resumed or started again while the fetcher was stopping
+		go mgr.run(d)
+		return
+	case d.State != Running:
+	case err != nil:
+		colorprint.Alert("Download of " + d.Name + " failed: " + err.Error())
+		d.State = Failed
+		d.Error = err.Error()
+		mgr.save(d)
+	default:
+		d.State = Complete
+		mgr.save(d)
+		colorprint.Info("Download of " + d.Name + " complete")
+	}
+	delete(mgr.running, d)
+	mgr.changed.Broadcast()
+}
+
+// Records a stored segment and writes the progress every consts.DownloadCheckpoint segments
+func (mgr *Manager) finish(d *Download, id int, holder string, fetched *int) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	if d.Done.Has(int64(id)) {
+		return
+	}
+	d.Done = d.Done.Set(int64(id))
+	if holder != "" {
+		d.Holders[id] = holder
+	}
+	*fetched++
+	if *fetched%consts.DownloadCheckpoint == 0 && d.State == Running {
+		if err := mgr.save(d); err != nil {
+			colorprint.Warning("Progress of the download of " + d.Name + " not saved: " + err.Error())
+		}
+	}
+	mgr.changed.Broadcast()
+}
+
+// Writes a download to the engine. Must hold the lock.
+func (mgr *Manager) save(d *Download) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return mgr.store.Put(d.Name, data)
+}
+
+// Must hold the lock
+func (d *Download) copy() Download {
+	c := *d
+	c.Done = append(catalog.Bitmap(nil), d.Done...)
+	c.Holders = make(map[int]string, len(d.Holders))
+	for id, holder := range d.Holders {
+		c.Holders[id] = holder
+	}
+	return c
+}
+
+// Returns true if two manifests describe the same segments
+func sameContent(a manifest.Manifest, b manifest.Manifest) bool {
+	if a.SegNums != b.SegNums || len(a.Hashes) != len(b.Hashes) {
+		return false
+	}
+	for i := range a.Hashes {
+		if a.Hashes[i] != b.Hashes[i] {
+			return false
+		}
+	}
+	return true
+}
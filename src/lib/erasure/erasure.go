@@ -0,0 +1,239 @@
+package erasure
+
+import (
+	"errors"
+	"strconv"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Systematic Reed-Solomon code over GF(2^8). A group of data shards is extended by parity shards, and any data
+// shards of them are enough to get every shard back. The data shards are stored as they are, so they can be read
+// without decoding while they are available.
+//
+// The encoding matrix is the identity on top of a Cauchy matrix, so every square matrix made of its rows can be
+// inverted.
+type Codec struct {
+	data   int
+	parity int
+	matrix [][]byte // data+parity rows of data columns
+}
+
+// Returned by Reconstruct when fewer shards than data shards are present
+var ErrTooFewShards = errors.New("erasure: too few shards to reconstruct")
+
+// Returned by Encode and Reconstruct when the shards don't fit the codec
+var ErrShardSize = errors.New("erasure: shards must be of equal size")
+
+// GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1, the one used by most storage systems
+const polynomial = 0x11d
+
+var expTable [510]byte
+var logTable [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= polynomial
+		}
+	}
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PUBLIC METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Returns a codec extending groups of data shards by parity shards. data + parity must not exceed 256.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// codec, err := erasure.New(4, 2)
+// shards := [][]byte{d0, d1, d2, d3, nil, nil} // data shards of equal size
+// err = codec.Encode(shards)                  // fills shards[4] and shards[5]
+// shards[1], shards[4] = nil, nil             // any 2 shards may be lost
+// err = codec.Reconstruct(shards)
+func New(data int, parity int) (*Codec, error) {
+	if data < 1 || parity < 0 || data+parity > 256 {
+		return nil, errors.New("erasure: invalid code " + strconv.Itoa(data) + "+" + strconv.Itoa(parity))
+	}
+	matrix := make([][]byte, data+parity)
+	for i := range matrix {
+		matrix[i] = make([]byte, data)
+		if i < data {
+			matrix[i][i] = 1
+			continue
+		}
+		for j := 0; j < data; j++ {
+			// x = i and y = j are distinct for every row and column, so x ^ y is never 0
+			matrix[i][j] = inverse(byte(i) ^ byte(j))
+		}
+	}
+	return &Codec{data: data, parity: parity, matrix: matrix}, nil
+}
+
+// Returns the number of data shards per group
+func (c *Codec) DataShards() int {
+	return c.data
+}
+
+// Returns the number of parity shards per group
+func (c *Codec) ParityShards() int {
+	return c.parity
+}
+
+// Computes the parity shards of a group. shards holds the data shards, all of the same size, followed by the parity
+// shards, which are allocated if nil.
+func (c *Codec) Encode(shards [][]byte) error {
+	if len(shards) != c.data+c.parity {
+		return errors.New("erasure: expected " + strconv.Itoa(c.data+c.parity) + " shards")
+	}
+	size := len(shards[0])
+	for _, shard := range shards[:c.data] {
+		if len(shard) != size {
+			return ErrShardSize
+		}
+	}
+	for i := c.data; i < len(shards); i++ {
+		shards[i] = make([]byte, size)
+		c.combine(c.matrix[i], shards[:c.data], shards[i])
+	}
+	return nil
+}
+
+// Fills in the missing (nil) shards of a group from the others. At least DataShards shards must be present.
+func (c *Codec) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.data+c.parity {
+		return errors.New("erasure: expected " + strconv.Itoa(c.data+c.parity) + " shards")
+	}
+	var rows []int
+	size := -1
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return ErrShardSize
+		}
+		size = len(shard)
+		if len(rows) < c.data {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < c.data {
+		return ErrTooFewShards
+	}
+
+	// the present shards are the product of their encoding rows and the data shards, so the data shards are the
+	// product of the inverted rows and the present shards
+	sub := make([][]byte, c.data)
+	present := make([][]byte, c.data)
+	for i, row := range rows {
+		sub[i] = append([]byte(nil), c.matrix[row]...)
+		present[i] = shards[row]
+	}
+	decode, err := invert(sub)
+	if err != nil {
+		return err
+	}
+	data := make([][]byte, c.data)
+	for i := 0; i < c.data; i++ {
+		if shards[i] != nil {
+			data[i] = shards[i]
+			continue
+		}
+		data[i] = make([]byte, size)
+		c.combine(decode[i], present, data[i])
+	}
+	for i := range shards {
+		if shards[i] != nil {
+			continue
+		}
+		if i < c.data {
+			shards[i] = data[i]
+			continue
+		}
+		shards[i] = make([]byte, size)
+		c.combine(c.matrix[i], data, shards[i])
+	}
+	return nil
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// HELPER METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Writes the linear combination of inputs with the given coefficients to out
+func (c *Codec) combine(coefficients []byte, inputs [][]byte, out []byte) {
+	for i, coefficient := range coefficients {
+		if coefficient == 0 {
+			continue
+		}
+		logC := logTable[coefficient]
+		for j, b := range inputs[i] {
+			if b != 0 {
+				out[j] ^= expTable[logC+logTable[b]]
+			}
+		}
+	}
+}
+
+func multiply(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[logTable[a]+logTable[b]]
+}
+
+func inverse(a byte) byte {
+	return expTable[255-logTable[a]]
+}
+
+// Inverts a square matrix with Gauss-Jordan elimination. The matrix is modified.
+func invert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	result := make([][]byte, n)
+	for i := range result {
+		result[i] = make([]byte, n)
+		result[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && matrix[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("erasure: singular matrix")
+		}
+		matrix[col], matrix[pivot] = matrix[pivot], matrix[col]
+		result[col], result[pivot] = result[pivot], result[col]
+		scale := inverse(matrix[col][col])
+		for j := 0; j < n; j++ {
+			matrix[col][j] = multiply(matrix[col][j], scale)
+			result[col][j] = multiply(result[col][j], scale)
+		}
+		for row := 0; row < n; row++ {
+			factor := matrix[row][col]
+			if row == col || factor == 0 {
+				continue
+			}
+			for j := 0; j < n; j++ {
+				matrix[row][j] ^= multiply(factor, matrix[col][j])
+				result[row][j] ^= multiply(factor, result[col][j])
+			}
+		}
+	}
+	return result, nil
+}
@@ -2,92 +2,335 @@ package filemgmt
 
 import (
 	"../../consts"
+	"../castore"
+	"../catalog"
 	"../colorprint"
+	"../crypt"
+	"../kvstore"
+	"../lrucache"
+	"../manifest"
+	"../quota"
 	"../utility"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-// Converts a file into several json encoded segments
-func SplitFile(filename string) {
-	bytes, err := ioutil.ReadFile(consts.DirPath + "/downloaded/" + filename)
-	utility.CheckError(err)
-	var eightBSeg []byte
-	var vidSeg utility.VidSegment
-	counter := 1
-	foldername := procName(filename)
-	colorprint.Alert("VIDEO HAS " + strconv.Itoa(len(bytes)) + " bytes. These will be divided up into " + strconv.Itoa(len(bytes)/consts.Bytecount) + " segments.")
-	for index, element := range bytes {
-		// colorprint.Debug("INDEX: " + strconv.Itoa(index) + " COUNTER:" + strconv.Itoa(counter))
-		eightBSeg = append(eightBSeg, element)
-		ident := ((index / consts.Bytecount) + 1)
-		// colorprint.Debug(strconv.Itoa(index) + " " + strconv.Itoa(ident))
-		if counter == consts.Bytecount {
-			fmt.Printf("\rProcessing....")
-			counter = 0
-			vidSeg = utility.VidSegment{
-				Id:   ident,
-				Body: eightBSeg,
+var objects *castore.Store
+var objectsOnce sync.Once
+var files *catalog.Catalog
+var filesOnce sync.Once
+var quotas *quota.Quota
+var quotasOnce sync.Once
+var hot *lrucache.Cache
+var hotOnce sync.Once
+
+// Returns the content addressed store holding this node's segments. Segments are stored once per distinct content
+// and each file has a manifest mapping its segment ids to content hashes.
+func Objects() *castore.Store {
+	objectsOnce.Do(func() {
+		var err error
+		objects, err = castore.OpenFramed(consts.DirPath + consts.StorePath)
+		utility.CheckError(err)
+	})
+	return objects
+}
+
+// Returns the catalog of the files and segments held by this node. A localFiles.json left by earlier versions is
+// imported the first time.
+func Catalog() *catalog.Catalog {
+	filesOnce.Do(func() {
+		store, err := kvstore.OpenLog(consts.DirPath+consts.CatalogPath, kvstore.DefaultOptions())
+		utility.CheckError(err)
+		files, err = catalog.Open(store)
+		utility.CheckError(err)
+		err = files.Migrate(consts.DirPath + "/localFiles.json")
+		utility.CheckError(err)
+	})
+	return files
+}
+
+// Sets the disk budget of this node's segments in bytes (0 for no limit) and the order cached segments are evicted in
+// (lru or popularity). Call before the first segment is stored.
+func SetQuota(limit int64, policy string) {
+	consts.QuotaBytes = limit
+	consts.EvictionPolicy = policy
+}
+
+// Sets the bytes of hot segments kept in memory (0 to read every segment from the store). Call before the first
+// segment is read.
+func SetSegmentCache(limit int64) {
+	consts.SegmentCacheBytes = limit
+}
+
+// Returns the in memory cache of recently read segment content, keyed by content hash so that content shared by
+// several files is cached once
+func SegmentCache() *lrucache.Cache {
+	hotOnce.Do(func() {
+		hot = lrucache.New(consts.SegmentCacheBytes)
+	})
+	return hot
+}
+
+// Returns the disk budget of this node's segments. Usage is rebuilt from the catalog and the manifests the first time.
+// Published and placed segments are primary and never evicted, segments kept after streaming are cached.
+func Quota() *quota.Quota {
+	quotasOnce.Do(func() {
+		quotas = quota.New(consts.QuotaBytes, consts.EvictionPolicy, evictSegment)
+		for _, entry := range Catalog().Files() {
+			stored, err := Objects().LoadManifest(entry.Name)
+			if err != nil {
+				continue
 			}
-			data, err := json.Marshal(vidSeg)
-			utility.CheckError(err)
-			eightBSeg = []byte{}
-			// fmt.Println(foldername)
-			if _, err := os.Stat(consts.DirPath + consts.LocalPath + foldername); os.IsNotExist(err) {
-				colorprint.Warning("Creating folder " + foldername)
-				err := os.MkdirAll(consts.DirPath+consts.LocalPath+foldername, 0777)
-				utility.CheckError(err)
+			for _, id := range entry.Segments.IDs() {
+				hash, ok := stored.Segments[int(id)]
+				if !ok {
+					continue
+				}
+				size, err := Objects().Size(hash)
+				if err != nil {
+					continue
+				}
+				class := quota.Primary
+				if entry.Cached.Has(id) {
+					class = quota.Cached
+				}
+				quotas.Load(quota.Item{File: entry.Name, Segment: int(id), Hash: hash, Size: size, Class: class})
 			}
-			writeToFileHelper(foldername, ident, data)
-			addVidSegIntoFileSysJSON(filename, (foldername), (len(bytes) / consts.Bytecount), vidSeg)
 		}
-		counter++
+	})
+	return quotas
+}
+
+// Returned by SplitReader when ingestion is cancelled
+var ErrCancelled = errors.New("filemgmt: ingestion cancelled")
+
+// Converts a file into several segments in the content addressed store. The file's manifest and catalog entry are
+// written once all segments are stored.
+func SplitFile(filename string) error {
+	f, err := os.Open(consts.DirPath + "/downloaded/" + filename)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	colorprint.Alert("VIDEO HAS " + strconv.FormatInt(info.Size(), 10) + " bytes. These will be divided up into " + strconv.FormatInt((info.Size()+int64(consts.Bytecount)-1)/int64(consts.Bytecount), 10) + " segments.")
+	_, err = SplitReader(filename, f, info.Size(), printProgress, nil)
+	fmt.Println()
+	return err
+}
 
+// Splits everything read from r into segments of consts.Bytecount bytes (the last one may be shorter) stored as
+// segments of filename. Only one segment is held in memory at a time, so files of any size can be ingested.
+// progress, if not nil, is called after every segment with the bytes read so far and size (-1 if unknown).
+// Closing cancel stops the ingestion with ErrCancelled before the manifest and catalog are written; segments stored
+// so far are left to garbage collection, which keeps them while the ingestion runs. The quota accounts for no
+// segment of an ingestion that failed. Returns the number of segments.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// cancel := make(chan struct{})
+// segNums, err := filemgmt.SplitReader("sample.mp4", file, size, nil, cancel)
+func SplitReader(filename string, r io.Reader, size int64, progress func(done int64, size int64), cancel <-chan struct{}) (segNums int64, err error) {
+	folder, err := procName(filename)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, consts.Bytecount)
+	// keeps the segments from garbage collection until the manifest refers to them, however long the file takes
+	ingest := Objects().BeginIngest()
+	defer ingest.Done()
+	hashes := make(map[int]string)
+	var ids []int64
+	defer func() {
+		if err != nil {
+			for _, id := range ids {
+				Quota().Release(filename, int(id))
+			}
+		}
+	}()
+	var done int64
+	for id := 1; ; id++ {
+		select {
+		case <-cancel:
+			return 0, ErrCancelled
+		default:
+		}
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			hash := castore.Hash(buf[:n])
+			item := quota.Item{File: filename, Segment: id, Hash: hash, Size: Objects().StoredSize(n), Class: quota.Primary}
+			if qerr := Quota().Admit(item); qerr != nil {
+				return 0, qerr
+			}
+			if _, perr := ingest.PutSegment(id, buf[:n]); perr != nil {
+				Quota().Release(filename, id)
+				return 0, perr
+			}
+			hashes[id] = hash
+			ids = append(ids, int64(id))
+			done += int64(n)
+			if progress != nil {
+				progress(done, size)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	segNums = int64(len(ids))
+	if err = Objects().AddAllToManifest(filename, segNums, hashes); err != nil {
+		return 0, err
+	}
+	if err = Catalog().AddMany(filename, consts.DirPath+consts.LocalPath+folder+"/", segNums, ids); err != nil {
+		return 0, err
+	}
+	return segNums, nil
 }
 
-// Looks into the json for a filename and processes the segments into the filesystem.
+// Cuts a file at keyframes into segments of about duration each with ffmpeg's segment muxer. Every segment is an
+// mpegts stream that can be decoded on its own, so playback can start at any segment. The start and duration of
+// each segment are recorded in the catalog. Like SplitReader, the quota accounts for no segment of a failed cut.
+func SplitFileAtKeyframes(filename string, duration time.Duration) (err error) {
+	folder, err := procName(filename)
+	if err != nil {
+		return err
+	}
+	source := consts.DirPath + "/downloaded/" + filename
+	tmp, err := ioutil.TempDir(consts.DirPath, ".segments-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	list := filepath.Join(tmp, "segments.csv")
+	colorprint.Alert("Cutting " + filename + " at keyframes into segments of about " + duration.String())
+	// -c copy only cuts at keyframes, timestamps are kept so that consecutive segments play as one stream
+	cmd := exec.Command("ffmpeg", "-v", "error", "-i", source, "-map", "0", "-c", "copy", "-f", "segment",
+		"-segment_time", strconv.FormatFloat(duration.Seconds(), 'f', 3, 64), "-segment_format", "mpegts",
+		"-segment_list", list, "-segment_list_type", "csv", filepath.Join(tmp, "%05d.ts"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.New("ffmpeg: " + err.Error() + ": " + string(out))
+	}
+	f, err := os.Open(list)
+	if err != nil {
+		return err
+	}
+	records, err := csv.NewReader(f).ReadAll()
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	ingest := Objects().BeginIngest()
+	defer ingest.Done()
+	hashes := make(map[int]string)
+	var ids []int64
+	defer func() {
+		if err != nil {
+			for _, id := range ids {
+				Quota().Release(filename, int(id))
+			}
+		}
+	}()
+	var timings []catalog.Timing
+	for i, record := range records {
+		if len(record) < 3 {
+			return errors.New("unexpected segment list entry " + strings.Join(record, ","))
+		}
+		start, err := strconv.ParseFloat(record[1], 64)
+		if err != nil {
+			return err
+		}
+		end, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadFile(filepath.Join(tmp, record[0]))
+		if err != nil {
+			return err
+		}
+		err = Quota().Admit(quota.Item{File: filename, Segment: i + 1, Hash: castore.Hash(body),
+			Size: Objects().StoredSize(len(body)), Class: quota.Primary})
+		if err != nil {
+			return err
+		}
+		if hashes[i+1], err = ingest.PutSegment(i+1, body); err != nil {
+			Quota().Release(filename, i+1)
+			return err
+		}
+		ids = append(ids, int64(i+1))
+		timings = append(timings, catalog.Timing{Start: start, Duration: end - start})
+		fmt.Printf("\rProcessing segment %d (%.2fs - %.2fs)", i+1, start, end)
+	}
+	fmt.Println()
+	segNums := int64(len(records))
+	if err = Objects().AddAllToManifest(filename, segNums, hashes); err != nil {
+		return err
+	}
+	if err = Catalog().AddMany(filename, consts.DirPath+consts.LocalPath+folder+"/", segNums, ids); err != nil {
+		return err
+	}
+	return Catalog().SetTimings(filename, timings)
+}
+
+// Looks into the catalog for the locally held files and indexes their segments in the filesystem. Only the index is
+// kept in memory, segments are read from the store when they are requested (see ReadSegment).
 // NOTE: A POINTER TO THE LOCAL FILESYSTEM MUST BE INPUT
 func ProcessLocalFiles(localFileSys *utility.FileSys) {
-	locFiles, err := ioutil.ReadFile(consts.DirPath + "/localFiles.json")
-	utility.CheckError(err)
-	var filePaths utility.FilePath
-	files := make([]utility.File, 0)
-	filePaths.Files = files
-	err = json.Unmarshal(locFiles, &filePaths)
-	utility.CheckError(err)
+	MigrateSegmentFolders()
 	fmt.Println("======================    PROCESSING LOCAL FILES INTO FILE SYSTEM    =====================")
 	fmt.Println("==========================================================================================")
-	for index, value := range filePaths.Files {
+	for index, value := range Catalog().Files() {
 		colorprint.Info("---------------------------------------------------------------------------")
 		fmt.Println((index + 1), ">> PROCESSING:", value.Name, "at "+value.Path)
-		substrind := strings.Index(value.Name, ".")
-		substr := value.Name[:substrind]
-		var vidmap map[int]utility.VidSegment
-		vidmap = make(map[int]utility.VidSegment)
+		manifest, _ := Objects().LoadManifest(value.Name)
+		var segsAvail []int64
+		var dropped []int64
 		// var vidBytes []byte
-		for i := 0; i < len(value.SegsAvail); i++ {
-			pathname := value.Path + substr + "_" + strconv.Itoa(int(value.SegsAvail[i]))
-			fmt.Printf("\rProcessing segment %s for %s out of %d segments", strconv.Itoa(int(value.SegsAvail[i])), value.Name, value.SegNums)
-			dat, err := ioutil.ReadFile(pathname)
-			utility.CheckError(err)
-			var vidSeg utility.VidSegment
-			err = json.Unmarshal(dat, &vidSeg)
-			utility.CheckError(err)
-			vidmap[int(value.SegsAvail[i])] = vidSeg
+		for _, id := range value.Segments.IDs() {
+			fmt.Printf("\rProcessing segment %s for %s out of %d segments", strconv.Itoa(int(id)), value.Name, value.SegNums)
+			hash, ok := manifest.Segments[int(id)]
+			if !ok {
+				colorprint.Alert("\nSegment " + strconv.Itoa(int(id)) + " of " + value.Name + " dropped: not stored")
+				dropped = append(dropped, id)
+				continue
+			}
+			if !Objects().Has(hash) {
+				// missing, leave it out so that it is fetched again from another node. Corrupt segments are
+				// found when they are read
+				colorprint.Alert("\nSegment " + strconv.Itoa(int(id)) + " of " + value.Name + " dropped: not stored")
+				dropped = append(dropped, id)
+				continue
+			}
+			segsAvail = append(segsAvail, id)
 			// for j := 0; j < len(vidSeg.Body); j++ {
 			// 	vidBytes = append(vidBytes, vidSeg.Body[j])
 			// }
 		}
+		if len(dropped) > 0 {
+			err := Catalog().Drop(value.Name, dropped)
+			utility.CheckError(err)
+		}
 		vid := utility.Video{
 			Name:      value.Name,
 			SegNums:   value.SegNums,
-			SegsAvail: value.SegsAvail,
-			Segments:  vidmap,
+			SegsAvail: segsAvail,
 		}
 		localFileSys.Lock()
 		colorprint.Alert("\nLOCKING FILESYSTEM")
@@ -103,19 +346,303 @@ func ProcessLocalFiles(localFileSys *utility.FileSys) {
 	fmt.Println("===============================    PROCESSING COMPLETE    ================================\n\n\n")
 }
 
-// This method writes the downloaded file into a file of its own in the filesys/downloaded folder
-func writeToFileHelper(foldername string, ident int, data []byte) {
-	str := consts.DirPath + consts.LocalPath + foldername + "/" + foldername + "_" + strconv.Itoa(ident)
-	err := ioutil.WriteFile(str, data, 0777)
+// Moves segments written by earlier versions as json encoded VidSegments (one file per segment in the file's folder)
+// into the content addressed store. The json files are removed once the file's manifest records their content, so
+// an interrupted migration is picked up again on the next start.
+func MigrateSegmentFolders() {
+	ingest := Objects().BeginIngest()
+	defer ingest.Done()
+	for _, entry := range Catalog().Files() {
+		manifest, _ := Objects().LoadManifest(entry.Name)
+		hashes := make(map[int]string)
+		var migrated []string
+		for _, id := range entry.Segments.IDs() {
+			if _, ok := manifest.Segments[int(id)]; ok {
+				continue
+			}
+			pathname := entry.Path + strings.Split(entry.Name, ".")[0] + "_" + strconv.Itoa(int(id))
+			dat, err := ioutil.ReadFile(pathname)
+			if err != nil {
+				continue
+			}
+			var vidSeg utility.VidSegment
+			if err = json.Unmarshal(dat, &vidSeg); err != nil {
+				colorprint.Alert("Segment file " + pathname + " is corrupt: " + err.Error())
+				continue
+			}
+			hashes[int(id)], err = ingest.PutSegment(int(id), vidSeg.Body)
+			utility.CheckError(err)
+			migrated = append(migrated, pathname)
+		}
+		if len(hashes) == 0 {
+			continue
+		}
+		colorprint.Info("Migrating " + strconv.Itoa(len(hashes)) + " json segments of " + entry.Name + " into the store")
+		err := Objects().AddAllToManifest(entry.Name, entry.SegNums, hashes)
+		utility.CheckError(err)
+		for id, hash := range hashes {
+			size, _ := Objects().Size(hash)
+			class := quota.Primary
+			if entry.Cached.Has(int64(id)) {
+				class = quota.Cached
+			}
+			Quota().Load(quota.Item{File: entry.Name, Segment: id, Hash: hash, Size: size, Class: class})
+		}
+		for _, pathname := range migrated {
+			os.Remove(pathname)
+		}
+		// only succeeds once the folder is empty
+		os.Remove(entry.Path)
+	}
+}
+
+// This method stores the body of a segment in the content addressed store and records it in the file's manifest and
+// the catalog.
+// A body that is already stored (for this or any other file) is not written again. Returns the quota's error, and
+// stores nothing, if the segment does not fit into this node's budget.
+func storeSegment(filename string, segNums int64, vidSeg utility.VidSegment, class quota.Class) error {
+	folder, err := procName(filename)
+	if err != nil {
+		return err
+	}
+	hash := castore.Hash(vidSeg.Body)
+	if vidSeg.Hash != "" && vidSeg.Hash != hash {
+		return errors.New("checksum mismatch for segment " + strconv.Itoa(vidSeg.Id) + " of " + filename)
+	}
+	if held, ok := Quota().Class(filename, vidSeg.Id); ok && SegmentHash(filename, vidSeg.Id) == hash {
+		// already stored, a cached segment placed on this node becomes primary
+		if held == quota.Cached && class == quota.Primary {
+			Quota().Admit(quota.Item{File: filename, Segment: vidSeg.Id, Hash: hash, Class: class})
+			return Catalog().MarkCached(filename, []int64{int64(vidSeg.Id)}, false)
+		}
+		return nil
+	}
+	err = Quota().Admit(quota.Item{File: filename, Segment: vidSeg.Id, Hash: hash,
+		Size: Objects().StoredSize(len(vidSeg.Body)), Class: class})
+	if err != nil {
+		return err
+	}
+	if _, err = Objects().PutSegment(vidSeg.Id, vidSeg.Body); err != nil {
+		Quota().Release(filename, vidSeg.Id)
+		return err
+	}
+	err = Objects().AddToManifest(filename, vidSeg.Id, segNums, hash)
+	utility.CheckError(err)
+	err = Catalog().Add(filename, consts.DirPath+consts.LocalPath+folder+"/", segNums, int64(vidSeg.Id))
 	utility.CheckError(err)
+	return Catalog().MarkCached(filename, []int64{int64(vidSeg.Id)}, class == quota.Cached)
+}
+
+// Removes a cached segment evicted by the quota from the catalog, the file's manifest and, if no other file shares
+// its content, the store
+func evictSegment(item quota.Item, unreferenced bool) {
+	colorprint.Warning("Evicting cached segment " + strconv.Itoa(item.Segment) + " of " + item.File + " to free space")
+	if err := Catalog().Drop(item.File, []int64{int64(item.Segment)}); err != nil {
+		colorprint.Alert("Could not drop segment from the catalog: " + err.Error())
+	}
+	if err := Objects().RemoveFromManifest(item.File, item.Segment); err != nil {
+		colorprint.Alert("Could not remove segment from the manifest: " + err.Error())
+	}
+	if unreferenced {
+		SegmentCache().Remove(item.Hash)
+		Objects().Remove(item.Hash)
+	}
+}
+
+// Removes a file from this node: its segments leave the catalog, the quota and the file's manifest. The segment
+// content itself is reclaimed by CollectGarbage once no other file shares it.
+func DeleteFile(filename string) error {
+	if entry, ok := Catalog().Get(filename); ok {
+		for _, id := range entry.Segments.IDs() {
+			Quota().Release(filename, int(id))
+		}
+	}
+	if err := Catalog().Remove(filename); err != nil {
+		return err
+	}
+	if err := Objects().RemoveManifest(filename); err != nil {
+		return err
+	}
+	colorprint.Info("Deleted " + filename + " from this node")
+	return nil
 }
 
-// Processes the filename into the appropriate folder name for the segments to be stored
-func procName(filename string) string {
+// Reclaims the space of deleted files: segment content no manifest refers to and segment folders of files that
+// are no longer in the catalog. Anything written within grace is kept, since it may belong to a file that is still
+// being stored. Returns the number of bytes reclaimed.
+func CollectGarbage(grace time.Duration) (int64, error) {
+	_, freed, err := Objects().Collect(grace)
+	if err != nil {
+		return 0, err
+	}
+	held := make(map[string]bool)
+	for _, entry := range Catalog().Files() {
+		if folder, err := procName(entry.Name); err == nil {
+			held[folder] = true
+		}
+	}
+	folders, err := ioutil.ReadDir(consts.DirPath + consts.LocalPath)
+	if err != nil {
+		return freed, nil
+	}
+	cutoff := time.Now().Add(-grace)
+	for _, folder := range folders {
+		if !folder.IsDir() || held[folder.Name()] || folder.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(consts.DirPath + consts.LocalPath + folder.Name()); err != nil {
+			return freed, err
+		}
+		colorprint.Info("Removed orphaned segment folder " + folder.Name())
+	}
+	return freed, nil
+}
+
+// Replaces the stored segments of a file by the segments sealed with key (see crypt.Seal), so that the nodes they are
+// placed on only hold ciphertext. The plaintext content is reclaimed by CollectGarbage. If a segment fails, the
+// quota accounts for the plaintext segments again.
+func EncryptFile(filename string, key []byte) (err error) {
+	stored, err := Objects().LoadManifest(filename)
+	if err != nil {
+		return err
+	}
+	ingest := Objects().BeginIngest()
+	defer ingest.Done()
+	hashes := make(map[int]string)
+	var replaced []quota.Item
+	defer func() {
+		if err != nil {
+			for _, item := range replaced {
+				Quota().Load(item)
+			}
+		}
+	}()
+	for id := 1; id <= int(stored.SegNums); id++ {
+		vidSeg, err := ReadSegment(filename, id)
+		if err != nil {
+			return err
+		}
+		sealed, err := crypt.Seal(key, filename, id, vidSeg.Body)
+		if err != nil {
+			return err
+		}
+		class, _ := Quota().Class(filename, id)
+		plain := quota.Item{File: filename, Segment: id, Hash: vidSeg.Hash, Size: Objects().StoredSize(len(vidSeg.Body)),
+			Class: class}
+		err = Quota().Admit(quota.Item{File: filename, Segment: id, Hash: castore.Hash(sealed),
+			Size: Objects().StoredSize(len(sealed)), Class: quota.Primary})
+		if err != nil {
+			return err
+		}
+		replaced = append(replaced, plain)
+		if hashes[id], err = ingest.PutSegment(id, sealed); err != nil {
+			return err
+		}
+	}
+	return Objects().AddAllToManifest(filename, stored.SegNums, hashes)
+}
+
+// Reads a segment of a file from the segment cache, or else from the content addressed store. The body is shared
+// with the cache and must not be modified.
+func ReadSegment(filename string, id int) (utility.VidSegment, error) {
+	hash, err := Objects().SegmentHash(filename, id)
+	if err != nil {
+		return utility.VidSegment{}, err
+	}
+	body, ok := SegmentCache().Get(hash)
+	if !ok {
+		if body, err = Objects().Get(hash); err != nil {
+			return utility.VidSegment{Id: id, Hash: hash}, err
+		}
+		SegmentCache().Add(hash, body)
+	}
+	Quota().Touch(filename, id)
+	return utility.VidSegment{Id: id, Body: body, Hash: hash}, nil
+}
+
+// Returns the length of every segment of a file stored on this node, in segment order
+func SegmentLengths(filename string, segNums int64) ([]int, error) {
+	lengths := make([]int, segNums)
+	for id := 1; id <= int(segNums); id++ {
+		vidSeg, err := ReadSegment(filename, id)
+		if err != nil {
+			return nil, err
+		}
+		lengths[id-1] = len(vidSeg.Body)
+	}
+	return lengths, nil
+}
+
+// Verifies a segment against its hash. Segments without a hash (written before checksums) always pass.
+func VerifySegment(vidSeg utility.VidSegment) bool {
+	return vidSeg.Hash == "" || castore.Hash(vidSeg.Body) == vidSeg.Hash
+}
+
+// Returns the content hash of a segment of a file, or "" if the segment is not stored
+func SegmentHash(filename string, id int) string {
+	hash, _ := Objects().SegmentHash(filename, id)
+	return hash
+}
+
+// Builds the manifest published for a file split with SplitFile or SplitFileAtKeyframes: segment layout and hashes
+// from the local store, segment start times from the catalog and media info from the source file. Every segment is
+// a stripe of its own, placed by the key "<name>_<segment id>".
+func VideoManifest(filename string) (manifest.Manifest, error) {
+	stored, err := Objects().LoadManifest(filename)
+	if err != nil {
+		return manifest.Manifest{}, err
+	}
+	m := manifest.Manifest{
+		Name:        filename,
+		SegNums:     stored.SegNums,
+		SegmentSize: consts.Bytecount,
+	}
+	if entry, ok := Catalog().Get(filename); ok && len(entry.Timings) > 0 {
+		// cut at keyframes, segments vary in size
+		m.SegmentSize = 0
+		for _, timing := range entry.Timings {
+			m.Starts = append(m.Starts, timing.Start)
+		}
+	}
+	source := consts.DirPath + "/downloaded/" + filename
+	if info, err := os.Stat(source); err == nil {
+		m.Size = info.Size()
+	}
+	m.Duration, m.FrameRate, m.Codec, err = manifest.Probe(source)
+	if err != nil {
+		colorprint.Warning("No media info for " + filename + ": " + err.Error())
+	}
+	name := strings.Split(filename, ".")[0]
+	for i := 1; i <= int(stored.SegNums); i++ {
+		hash, ok := stored.Segments[i]
+		if !ok {
+			return manifest.Manifest{}, errors.New("segment " + strconv.Itoa(i) + " of " + filename + " is not stored")
+		}
+		m.Hashes = append(m.Hashes, hash)
+		m.Stripes = append(m.Stripes, manifest.Stripe{Key: name + "_" + strconv.Itoa(i), First: int64(i), Last: int64(i)})
+	}
+	return m, nil
+}
+
+// Prints the progress of SplitReader on a single line
+func printProgress(done int64, size int64) {
+	if size > 0 {
+		fmt.Printf("\rProcessing.... %d%%", done*100/size)
+	} else {
+		fmt.Printf("\rProcessing.... %d bytes", done)
+	}
+}
+
+// Processes the filename into the appropriate folder name for the segments to be stored. Names come from peers as
+// well, so a name without an extension is an error rather than a panic.
+func procName(filename string) (string, error) {
 	str := strings.Split(filename, "/")
 	foldername := str[len(str)-1]
 	dotindex := strings.Index(foldername, ".")
-	return filename[:dotindex]
+	if dotindex < 0 {
+		return "", errors.New("file name " + filename + " has no extension")
+	}
+	return foldername[:dotindex], nil
 }
 
 // Print the filesystem contents
@@ -144,8 +671,9 @@ func PrintFileSysContents(localFileSys *utility.FileSys) {
 	colorprint.Warning("======================================================================================================")
 }
 
-// Adds the video segment info into localFiles.json. Call this function after adding a new video segment to the file system
-func AddVidSegIntoFileSys(filename string, segNums int64, vidSeg utility.VidSegment, localFileSys *utility.FileSys) {
+// Stores a received video segment and adds it to the catalog. Call this function after receiving a new video segment
+// placed on this node. Returns an error if the segment does not fit into this node's storage quota.
+func AddVidSegIntoFileSys(filename string, segNums int64, vidSeg utility.VidSegment, localFileSys *utility.FileSys) error {
 	// localFileSys.RLock()
 	// // colorprint.Debug("LOCK")
 	// _, ok := localFileSys.Files[filename]
@@ -168,41 +696,12 @@ func AddVidSegIntoFileSys(filename string, segNums int64, vidSeg utility.VidSegm
 	// 	localFileSys.Unlock()
 
 	// }
-	foldername := procName(filename)
-	data, err := json.Marshal(vidSeg)
-	utility.CheckError(err)
-	writeToFileHelper(foldername, vidSeg.Id, data)
+	return storeSegment(filename, segNums, vidSeg, quota.Primary)
 	// colorprint.Debug("UNLOCK")
 }
 
-// Adds the video segment info into localFiles.json. Call this function after adding a new video segment to the file system
-func addVidSegIntoFileSysJSON(filename string, path string, segNums int, vidSeg utility.VidSegment) {
-	vidSegId := int64(vidSeg.Id)
-	locFiles, err := ioutil.ReadFile(consts.DirPath + "/localFiles.json")
-	utility.CheckError(err)
-	var filePaths utility.FilePath
-	files := make([]utility.File, 0)
-	filePaths.Files = files
-	err = json.Unmarshal(locFiles, &filePaths)
-	utility.CheckError(err)
-	var filefound bool = false
-	for index, value := range filePaths.Files {
-		if value.Name == filename {
-			value.SegsAvail = append(value.SegsAvail, vidSegId)
-			filePaths.Files[index].SegsAvail = value.SegsAvail
-			filefound = true
-			break
-		}
-	}
-	if !filefound {
-		var file utility.File
-		file.Name = filename
-		file.Path = consts.DirPath + consts.LocalPath + path + "/"
-		file.SegNums = int64(segNums)
-		file.SegsAvail = append(file.SegsAvail, vidSegId)
-		filePaths.Files = append(filePaths.Files, file)
-	}
-	dat, err := json.Marshal(filePaths)
-	utility.CheckError(err)
-	utility.SaveFileInfoToJson(dat)
+// Keeps a copy of a segment fetched for streaming. Cached segments make room for segments placed on this node when
+// the storage quota runs out, and are not kept at all if they do not fit.
+func CacheVidSegment(filename string, segNums int64, vidSeg utility.VidSegment) error {
+	return storeSegment(filename, segNums, vidSeg, quota.Cached)
 }
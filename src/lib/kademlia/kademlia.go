@@ -0,0 +1,671 @@
+package kademlia
+
+import (
+	"../../consts"
+	"../utility"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Number of bits in a node or key identifier (SHA1)
+const idBits = 160
+
+type (
+	// rpc service type
+	KademliaService int
+
+	// 160 bit identifier of a node or a key
+	NodeID [idBits / 8]byte
+
+	// A node as seen by the routing table. Address is the advertised kademlia rpc address, FtAddr and StreamAddr
+	// are the advertised file transfer and streaming server addresses of the same node.
+	Contact struct {
+		ID         NodeID
+		Address    string
+		FtAddr     string
+		StreamAddr string
+	}
+
+	// Argument of the PING rpc
+	PingArgs struct {
+		Sender Contact
+	}
+
+	// Argument of the FIND_NODE rpc
+	FindNodeArgs struct {
+		Sender Contact
+		Target NodeID
+	}
+
+	// Reply of the FIND_NODE rpc. Holds the k closest contacts to the target known by the callee
+	FindNodeReply struct {
+		Contacts []Contact
+	}
+
+	// Argument of the FIND_VALUE rpc
+	FindValueArgs struct {
+		Sender Contact
+		Key    string
+	}
+
+	// Reply of the FIND_VALUE rpc. If Found is false, Contacts holds the k closest contacts to the key instead
+	FindValueReply struct {
+		Found    bool
+		Value    []byte
+		Contacts []Contact
+	}
+
+	// Argument of the STORE rpc
+	StoreArgs struct {
+		Sender Contact
+		Key    string
+		Value  []byte
+	}
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// GLOBAL VARS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+var (
+	bindAddress string  // local address the rpc listener binds to
+	self        Contact // this node, as advertised to peers
+
+	// k-buckets, bucket i holds contacts whose distance to self has its highest set bit at position i.
+	// Each bucket is ordered from least recently seen (head) to most recently seen (tail).
+	buckets     [idBits][]Contact
+	pinging     [idBits]bool // the head of the bucket is being pinged, see seen
+	bucketsLock sync.Mutex
+
+	// set up before Start, which runs in its own goroutine while Put and Get may already be called
+	datamap     = make(map[string][]byte)
+	datamapLock sync.RWMutex
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// INBOUND RPC CALL METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// PING: replies with this node's contact so that the caller learns our identifier
+func (this *KademliaService) Ping(args *PingArgs, reply *Contact) error {
+	seen(args.Sender)
+	*reply = self
+	return nil
+}
+
+// FIND_NODE: replies with the k closest contacts to the target in our routing table
+func (this *KademliaService) FindNode(args *FindNodeArgs, reply *FindNodeReply) error {
+	seen(args.Sender)
+	reply.Contacts = closestContacts(args.Target, consts.KademliaK, args.Sender.ID)
+	return nil
+}
+
+// FIND_VALUE: replies with the value if it is stored on this node, otherwise behaves like FIND_NODE
+func (this *KademliaService) FindValue(args *FindValueArgs, reply *FindValueReply) error {
+	seen(args.Sender)
+	datamapLock.RLock()
+	value, ok := datamap[args.Key]
+	datamapLock.RUnlock()
+	if ok {
+		reply.Found = true
+		reply.Value = value
+		return nil
+	}
+	reply.Contacts = closestContacts(KeyID(args.Key), consts.KademliaK, args.Sender.ID)
+	return nil
+}
+
+// STORE: saves the key/value pair on this node
+func (this *KademliaService) Store(args *StoreArgs, reply *bool) error {
+	seen(args.Sender)
+	datamapLock.Lock()
+	datamap[args.Key] = args.Value
+	datamapLock.Unlock()
+	*reply = true
+	return nil
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PUBLIC METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Starts the kademlia node. bindAddr is the local address the rpc service listens on while advertiseAddr is the
+// address other nodes use to reach it (empty to advertise bindAddr). fileTransAddr and streamAddr must be the
+// advertised addresses of this node's file transfer and streaming services (either may be empty). When peerAddr
+// is this node's own address, the node starts a new network.
+func Start(bindAddr string, advertiseAddr string, peerAddr string, fileTransAddr string, streamAddr string) {
+	bindAddress = bindAddr
+	address := utility.AdvertiseAddr(bindAddr, advertiseAddr)
+	self = Contact{KeyID(address), address, fileTransAddr, streamAddr}
+	sectionedPrint(fmt.Sprintf("This node's kademlia identifier is %s", self.ID))
+
+	go launchRPCService()
+
+	peer := utility.AdvertiseAddr(peerAddr, "")
+	if peer == self.Address || bindAddr == peerAddr {
+		sectionedPrint(fmt.Sprintf("First node %s joining the system", self.Address))
+	} else {
+		join(peer)
+	}
+
+	go maintain()
+	select {}
+}
+
+// Returns the k closest live nodes to key found by an iterative FIND_NODE lookup, closest first
+func Lookup(key string) []Contact {
+	contacts, _, _ := iterativeLookup(KeyID(key), key, false)
+	return contacts
+}
+
+// Stores a key/value pair on the k closest nodes to the key
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// Call kademlia.Put("{KEY}", {VALUE BYTES}). Returns the number of nodes that acknowledged the store.
+func Put(key string, value []byte) int {
+	stored := 0
+	for _, contact := range Lookup(key) {
+		if contact.ID == self.ID {
+			datamapLock.Lock()
+			datamap[key] = value
+			datamapLock.Unlock()
+			stored++
+			continue
+		}
+		var ok bool
+		if call(contact, "KademliaService.Store", &StoreArgs{self, key, value}, &ok) == nil && ok {
+			stored++
+		}
+	}
+	return stored
+}
+
+// Looks up the value stored under key with an iterative FIND_VALUE lookup. The second return value is false if
+// no node holds the key.
+func Get(key string) ([]byte, bool) {
+	datamapLock.RLock()
+	value, ok := datamap[key]
+	datamapLock.RUnlock()
+	if ok {
+		return value, true
+	}
+	_, value, ok = iterativeLookup(KeyID(key), key, true)
+	return value, ok
+}
+
+// Returns the file transfer address of the node responsible for a segment, ie. the node closest to the
+// segment's key. Same surface as chordRPC.GetAddressForSegment.
+func GetAddressForSegment(filename string) string {
+	for _, contact := range Lookup(filename) {
+		if contact.FtAddr != "" {
+			return contact.FtAddr
+		}
+	}
+	fmt.Println("No node with a file transfer address found. Returning own ftAddress")
+	return self.FtAddr
+}
+
+// Returns the file transfer addresses of all nodes close to a file part, closest first
+func GetAddressesForSegment(filename string) []string {
+	var addresses []string
+	for _, contact := range Lookup(filename) {
+		if contact.FtAddr != "" {
+			addresses = append(addresses, contact.FtAddr)
+		}
+	}
+	return addresses
+}
+
+// Returns the file transfer addresses of count distinct nodes holding the shards of a group, closest to key
+// first. Same surface as chordRPC.GetAddressesForShards.
+func GetAddressesForShards(key string, count int) []string {
+	addresses := GetAddressesForSegment(key)
+	if len(addresses) > count {
+		addresses = addresses[:count]
+	}
+	return addresses
+}
+
+// Returns the streaming server address of the node responsible for a file part, ie. the node closest to the key
+func GetStreamingServer(filename string) string {
+	for _, contact := range Lookup(filename) {
+		if contact.StreamAddr != "" {
+			return contact.StreamAddr
+		}
+	}
+	return self.StreamAddr
+}
+
+// Stores data under filename in the network. Same surface as chordRPC.SaveToMap.
+func SaveToMap(filename string, data []byte) {
+	if Put(filename, data) == 0 {
+		sectionedPrint("Unable to store " + filename + " on any node")
+	}
+}
+
+// Replaces the value of filename with an empty value on the k closest nodes. Same surface as
+// chordRPC.RemoveFromMap.
+func RemoveFromMap(filename string) {
+	if Put(filename, nil) == 0 {
+		sectionedPrint("Unable to remove " + filename + " from any node")
+	}
+}
+
+// Returns the identifier of a key (or of a canonical node address)
+func KeyID(key string) NodeID {
+	return NodeID(sha1.Sum([]byte(key)))
+}
+
+// Prints the identifier as hex
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// ROUTING TABLE METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// XOR distance between two identifiers
+func distance(a NodeID, b NodeID) NodeID {
+	var d NodeID
+	for i := range a {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// Returns true if a is closer to target than b
+func closer(target NodeID, a NodeID, b NodeID) bool {
+	da, db := distance(a, target), distance(b, target)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// Index of the k-bucket an identifier falls into, -1 for our own identifier
+func bucketIndex(id NodeID) int {
+	d := distance(self.ID, id)
+	for i := 0; i < len(d); i++ {
+		for j := 7; j >= 0; j-- {
+			if d[i]&(1<<uint(j)) != 0 {
+				return (len(d)-i-1)*8 + j
+			}
+		}
+	}
+	return -1
+}
+
+// Updates the routing table after hearing from a contact. Known contacts move to the tail of their bucket. New
+// contacts are appended if the bucket has room, otherwise the least recently seen contact is pinged and only
+// evicted if it does not answer. One ping per bucket is in flight at a time, new contacts of a bucket whose head is
+// being pinged are dropped.
+func seen(contact Contact) {
+	index := bucketIndex(contact.ID)
+	if index < 0 || contact.Address == "" {
+		return
+	}
+	bucketsLock.Lock()
+	bucket := buckets[index]
+	for i, c := range bucket {
+		if c.ID == contact.ID {
+			buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), contact)
+			bucketsLock.Unlock()
+			return
+		}
+	}
+	if len(bucket) < consts.KademliaK {
+		buckets[index] = append(bucket, contact)
+		bucketsLock.Unlock()
+		return
+	}
+	if pinging[index] {
+		bucketsLock.Unlock()
+		return
+	}
+	pinging[index] = true
+	head := bucket[0]
+	bucketsLock.Unlock()
+
+	go func() {
+		var reply Contact
+		err := call(head, "KademliaService.Ping", &PingArgs{self}, &reply)
+		bucketsLock.Lock()
+		defer bucketsLock.Unlock()
+		pinging[index] = false
+		bucket := buckets[index]
+		for i, c := range bucket {
+			if c.ID != head.ID {
+				continue
+			}
+			if err != nil {
+				buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), contact)
+			} else {
+				buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), head)
+			}
+			return
+		}
+	}()
+}
+
+// Removes an unresponsive contact from the routing table
+func forget(contact Contact) {
+	index := bucketIndex(contact.ID)
+	if index < 0 {
+		return
+	}
+	bucketsLock.Lock()
+	defer bucketsLock.Unlock()
+	bucket := buckets[index]
+	for i, c := range bucket {
+		if c.ID == contact.ID {
+			buckets[index] = append(bucket[:i:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+// Returns up to count contacts from the routing table closest to target, excluding the given identifier
+func closestContacts(target NodeID, count int, exclude NodeID) []Contact {
+	bucketsLock.Lock()
+	var all []Contact
+	for _, bucket := range buckets {
+		for _, c := range bucket {
+			if c.ID != exclude {
+				all = append(all, c)
+			}
+		}
+	}
+	bucketsLock.Unlock()
+	sortByDistance(all, target)
+	if len(all) > count {
+		all = all[:count]
+	}
+	return all
+}
+
+func sortByDistance(contacts []Contact, target NodeID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return closer(target, contacts[i].ID, contacts[j].ID)
+	})
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// LOOKUP METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Result of querying one contact during a lookup
+type lookupResult struct {
+	contact  Contact
+	err      error
+	found    bool
+	value    []byte
+	contacts []Contact
+}
+
+// Iterative lookup of the k closest nodes to target. Each round queries the alpha closest contacts that have not
+// been queried yet in parallel. When a round does not bring us closer to the target, every unqueried contact
+// among the k closest is queried. The lookup ends once the k closest contacts have all answered.
+// If findValue is set, FIND_VALUE is used and the lookup stops as soon as a node returns the value, which is
+// then cached on the closest node that did not have it.
+func iterativeLookup(target NodeID, key string, findValue bool) ([]Contact, []byte, bool) {
+	shortlist := closestContacts(target, consts.KademliaK, self.ID)
+	shortlist = append(shortlist, self)
+	sortByDistance(shortlist, target)
+	queried := map[NodeID]bool{self.ID: true}
+	failed := map[NodeID]bool{}
+	var missing []Contact
+
+	stalled := false
+	for {
+		var round []Contact
+		closestBefore := shortlist[0]
+		limit := consts.KademliaAlpha
+		if stalled {
+			limit = consts.KademliaK
+		}
+		for _, c := range shortlist {
+			if !queried[c.ID] {
+				round = append(round, c)
+			}
+			if len(round) == limit {
+				break
+			}
+		}
+		if len(round) == 0 {
+			break
+		}
+
+		results := make(chan lookupResult, len(round))
+		for _, c := range round {
+			queried[c.ID] = true
+			go func(c Contact) {
+				res := lookupResult{contact: c}
+				if findValue {
+					var reply FindValueReply
+					res.err = call(c, "KademliaService.FindValue", &FindValueArgs{self, key}, &reply)
+					res.found, res.value, res.contacts = reply.Found, reply.Value, reply.Contacts
+				} else {
+					var reply FindNodeReply
+					res.err = call(c, "KademliaService.FindNode", &FindNodeArgs{self, target}, &reply)
+					res.contacts = reply.Contacts
+				}
+				results <- res
+			}(c)
+		}
+
+		for range round {
+			res := <-results
+			if res.err != nil {
+				failed[res.contact.ID] = true
+				forget(res.contact)
+				continue
+			}
+			seen(res.contact)
+			if res.found {
+				sortByDistance(missing, target)
+				if len(missing) > 0 {
+					var ok bool
+					go call(missing[0], "KademliaService.Store", &StoreArgs{self, key, res.value}, &ok)
+				}
+				return shortlist, res.value, true
+			}
+			if findValue {
+				missing = append(missing, res.contact)
+			}
+			for _, c := range res.contacts {
+				if !containsContact(shortlist, c.ID) && !failed[c.ID] {
+					shortlist = append(shortlist, c)
+				}
+			}
+		}
+
+		shortlist = removeFailed(shortlist, failed)
+		sortByDistance(shortlist, target)
+		if len(shortlist) > consts.KademliaK {
+			shortlist = shortlist[:consts.KademliaK]
+		}
+		// no progress, query everyone left in the k closest in the next round
+		stalled = len(shortlist) > 0 && shortlist[0].ID == closestBefore.ID
+	}
+	return shortlist, nil, false
+}
+
+func containsContact(contacts []Contact, id NodeID) bool {
+	for _, c := range contacts {
+		if c.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func removeFailed(contacts []Contact, failed map[NodeID]bool) []Contact {
+	alive := contacts[:0]
+	for _, c := range contacts {
+		if !failed[c.ID] {
+			alive = append(alive, c)
+		}
+	}
+	return alive
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// CONNECTION METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Joins the network through a known peer: ping it to learn its identifier, look ourselves up to populate the
+// buckets close to us and refresh every bucket farther away than our closest neighbour
+func join(peerAddr string) {
+	fmt.Printf("Connecting to peer %s\n", peerAddr)
+	var peer Contact
+	for call(Contact{Address: peerAddr}, "KademliaService.Ping", &PingArgs{self}, &peer) != nil {
+		sectionedPrint("Unable to reach peer " + peerAddr + ". Retrying in 2 seconds...")
+		time.Sleep(2 * time.Second)
+	}
+	seen(peer)
+	neighbours := Lookup(self.Address)
+	closest := idBits
+	for _, c := range neighbours {
+		if i := bucketIndex(c.ID); i >= 0 && i < closest {
+			closest = i
+		}
+	}
+	for i := closest + 1; i < idBits; i++ {
+		refreshBucket(i)
+	}
+	printRoutingTable()
+}
+
+// Looks up a random identifier in the range of bucket i so that the bucket gets populated
+func refreshBucket(i int) {
+	var id NodeID
+	rand.Read(id[:])
+	d := distance(self.ID, id)
+	// keep only the bits below position i and force bit i, then translate back from distance to identifier
+	byteIndex := len(d) - 1 - i/8
+	for j := 0; j < byteIndex; j++ {
+		d[j] = 0
+	}
+	d[byteIndex] = (d[byteIndex] & byte(1<<uint(i%8)-1)) | byte(1<<uint(i%8))
+	iterativeLookup(distance(self.ID, d), "", false)
+}
+
+// Periodically refreshes the buckets and republishes the values stored on this node so that they survive churn
+func maintain() {
+	for {
+		time.Sleep(consts.KademliaRefresh)
+		bucketsLock.Lock()
+		var nonEmpty []int
+		for i, bucket := range buckets {
+			if len(bucket) > 0 {
+				nonEmpty = append(nonEmpty, i)
+			}
+		}
+		bucketsLock.Unlock()
+		for _, i := range nonEmpty {
+			refreshBucket(i)
+		}
+
+		datamapLock.RLock()
+		values := make(map[string][]byte, len(datamap))
+		for k, v := range datamap {
+			values[k] = v
+		}
+		datamapLock.RUnlock()
+		for k, v := range values {
+			Put(k, v)
+		}
+	}
+}
+
+/*
+* Set up the listener for RPC requests, serve the connections when required.
+ */
+func launchRPCService() {
+	server := new(KademliaService)
+	rpc.Register(server)
+	rpcAddr, err := net.ResolveTCPAddr("tcp", bindAddress)
+	utility.CheckError(err)
+	rpcListener, err := net.ListenTCP("tcp", rpcAddr)
+	utility.CheckError(err)
+
+	// Listen for RPC requests and serve concurrently
+	for {
+		conn, err := rpcListener.AcceptTCP()
+		if err != nil {
+			continue
+		}
+		go rpc.ServeConn(conn)
+	}
+}
+
+// Calls an rpc method on a contact. Unlike chordRPC this never exits the process, dial and call failures are
+// returned so that lookups can route around dead nodes.
+func call(contact Contact, method string, args interface{}, reply interface{}) error {
+	conn, err := net.DialTimeout("tcp", contact.Address, consts.KademliaTimeout)
+	if err != nil {
+		return err
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	done := client.Go(method, args, reply, make(chan *rpc.Call, 1)).Done
+	select {
+	case res := <-done:
+		return res.Error
+	case <-time.After(consts.KademliaTimeout):
+		return errors.New("kademlia: " + method + " to " + contact.Address + " timed out")
+	}
+}
+
+func sectionedPrint(str string) {
+	fmt.Println("=====================================================")
+	fmt.Println(str)
+	fmt.Println("=====================================================")
+}
+
+/* Prints the non empty k-buckets to standard output.
+ */
+func printRoutingTable() {
+	fmt.Println(" -+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+ ")
+	fmt.Printf(" Routing table for this node: %s\n", self.ID)
+	fmt.Println(" -+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+ ")
+	fmt.Printf("| BUCKET | CONTACTS\n")
+	bucketsLock.Lock()
+	for i, bucket := range buckets {
+		if len(bucket) == 0 {
+			continue
+		}
+		var addrs []string
+		for _, c := range bucket {
+			addrs = append(addrs, c.Address)
+		}
+		fmt.Printf("| %6d | %v\n", i, addrs)
+	}
+	bucketsLock.Unlock()
+	fmt.Println(" -+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+ ")
+}
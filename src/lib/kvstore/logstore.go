@@ -0,0 +1,375 @@
+package kvstore
+
+import (
+	"../../consts"
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// When a LogStore flushes writes to disk
+const (
+	SyncAlways   = "always"   // fsync after every write
+	SyncInterval = "interval" // fsync every Options.SyncInterval, a crash loses at most that much
+	SyncNever    = "never"    // leave it to the operating system
+)
+
+// Record operations
+const (
+	opPut    = 1
+	opDelete = 2
+)
+
+// crc32 (4 bytes), op (1 byte), key length (4 bytes), value length (4 bytes)
+const headerSize = 13
+
+// Tunables of a LogStore
+type Options struct {
+	Sync           string        // SyncAlways, SyncInterval or SyncNever
+	SyncInterval   time.Duration // used with SyncInterval
+	CompactRatio   float64       // compact once this fraction of the log is garbage ...
+	CompactMinSize int64         // ... and the garbage is at least this many bytes
+}
+
+// Durable engine. Every write is appended to a single log file as a checksummed record and an in-memory index
+// maps each key to the position of its latest value. Overwritten and deleted records become garbage which is
+// dropped by compaction, which rewrites the live records to a new log and atomically replaces the old one.
+//
+// On open the log is replayed to rebuild the index. A torn record at the end of the log (a crash in the middle
+// of a write) is truncated away.
+type LogStore struct {
+	path    string
+	opts    Options
+	file    *os.File
+	size    int64            // bytes in the log
+	garbage int64            // bytes of records that are no longer live
+	index   map[string]entry // key -> latest value
+	dirty   bool             // writes since the last fsync
+	closed  bool
+	stop    chan bool
+	lock    sync.RWMutex
+}
+
+// Position of a live value in the log
+type entry struct {
+	record int64 // offset of the record
+	offset int64 // offset of the value
+	length int64 // length of the value
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PUBLIC METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Returns the options set in consts
+func DefaultOptions() Options {
+	return Options{
+		Sync:           consts.KVSync,
+		SyncInterval:   consts.KVSyncInterval,
+		CompactRatio:   consts.KVCompactRatio,
+		CompactMinSize: consts.KVCompactMinSize,
+	}
+}
+
+// Opens the log at path, creating it (and its directory) if needed, and replays it
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// store, err := kvstore.OpenLog("chordstore/node.log", kvstore.DefaultOptions())
+// err = store.Put("key", []byte("value"))
+// value, err := store.Get("key")
+func OpenLog(path string, opts Options) (*LogStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &LogStore{path: path, opts: opts, file: file, index: make(map[string]entry), stop: make(chan bool)}
+	if err := s.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if opts.Sync == SyncInterval {
+		go s.syncLoop()
+	}
+	return s, nil
+}
+
+func (s *LogStore) Get(key string) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	e, ok := s.index[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	value := make([]byte, e.length)
+	if _, err := s.file.ReadAt(value, e.offset); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (s *LogStore) Put(key string, value []byte) error {
+	return s.write(opPut, key, value)
+}
+
+func (s *LogStore) Delete(key string) error {
+	s.lock.RLock()
+	_, ok := s.index[key]
+	s.lock.RUnlock()
+	if !ok {
+		return nil
+	}
+	return s.write(opDelete, key, nil)
+}
+
+func (s *LogStore) Keys() ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Flushes the log to disk
+func (s *LogStore) Sync() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.sync()
+}
+
+// Rewrites the live records to a new log and replaces the old log with it. Runs automatically once enough of
+// the log is garbage (see Options).
+func (s *LogStore) Compact() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.compact()
+}
+
+func (s *LogStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	err := s.sync()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PRIVATE METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Appends a record and updates the index
+func (s *LogStore) write(op byte, key string, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	record := encodeRecord(op, key, value)
+	if _, err := s.file.WriteAt(record, s.size); err != nil {
+		return err
+	}
+	s.apply(op, key, s.size, int64(len(record)), int64(len(value)))
+	s.size += int64(len(record))
+	s.dirty = true
+
+	if s.opts.Sync == SyncAlways {
+		if err := s.sync(); err != nil {
+			return err
+		}
+	}
+	if s.garbage >= s.opts.CompactMinSize && float64(s.garbage) >= s.opts.CompactRatio*float64(s.size) {
+		return s.compact()
+	}
+	return nil
+}
+
+// Updates the index and garbage count for a record at offset
+func (s *LogStore) apply(op byte, key string, offset int64, recordLen int64, valueLen int64) {
+	if old, ok := s.index[key]; ok {
+		s.garbage += old.offset + old.length - old.record
+	}
+	if op == opPut {
+		s.index[key] = entry{offset, offset + recordLen - valueLen, valueLen}
+	} else {
+		delete(s.index, key)
+		s.garbage += recordLen
+	}
+}
+
+// Rebuilds the index from the log and truncates a torn tail
+func (s *LogStore) replay() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(s.file)
+	header := make([]byte, headerSize)
+	var offset int64
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		op := header[4]
+		keyLen := int64(binary.BigEndian.Uint32(header[5:9]))
+		valueLen := int64(binary.BigEndian.Uint32(header[9:13]))
+		if offset+headerSize+keyLen+valueLen > info.Size() {
+			break
+		}
+		body := make([]byte, keyLen+valueLen)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			break
+		}
+		crc := crc32.NewIEEE()
+		crc.Write(header[4:])
+		crc.Write(body)
+		if crc.Sum32() != binary.BigEndian.Uint32(header[:4]) || (op != opPut && op != opDelete) {
+			break
+		}
+		recordLen := headerSize + keyLen + valueLen
+		s.apply(op, string(body[:keyLen]), offset, recordLen, valueLen)
+		offset += recordLen
+	}
+
+	if info.Size() > offset {
+		// torn or corrupt tail, drop it
+		if err := s.file.Truncate(offset); err != nil {
+			return err
+		}
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+	}
+	s.size = offset
+	return nil
+}
+
+func (s *LogStore) compact() error {
+	tmpPath := s.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	index := make(map[string]entry, len(s.index))
+	var offset int64
+	for key, e := range s.index {
+		value := make([]byte, e.length)
+		if _, err = s.file.ReadAt(value, e.offset); err != nil {
+			break
+		}
+		record := encodeRecord(opPut, key, value)
+		if _, err = writer.Write(record); err != nil {
+			break
+		}
+		index[key] = entry{offset, offset + int64(len(record)) - e.length, e.length}
+		offset += int64(len(record))
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(s.path))
+
+	s.file.Close()
+	s.file = tmp
+	s.index = index
+	s.size = offset
+	s.garbage = 0
+	s.dirty = false
+	return nil
+}
+
+func (s *LogStore) sync() error {
+	if !s.dirty {
+		return nil
+	}
+	s.dirty = false
+	return s.file.Sync()
+}
+
+func (s *LogStore) syncLoop() {
+	ticker := time.NewTicker(s.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.lock.Lock()
+			if !s.closed {
+				s.sync()
+			}
+			s.lock.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func encodeRecord(op byte, key string, value []byte) []byte {
+	record := make([]byte, headerSize+len(key)+len(value))
+	record[4] = op
+	binary.BigEndian.PutUint32(record[5:9], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[9:13], uint32(len(value)))
+	copy(record[headerSize:], key)
+	copy(record[headerSize+len(key):], value)
+	binary.BigEndian.PutUint32(record[:4], crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// Persists a rename in dir. Errors are ignored, not every platform can sync directories.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,108 @@
+package lrucache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// In memory cache of byte values bounded by the total length of the values. The least recently used values are
+// dropped once the limit is reached. Safe for concurrent use.
+type Cache struct {
+	limit   int64
+	size    int64
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+	hits    int64
+	misses  int64
+	lock    sync.Mutex
+}
+
+type entry struct {
+	key   string
+	value []byte
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PUBLIC METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Returns a cache holding up to limit bytes of values. Nothing is cached when limit is 0.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// c := lrucache.New(64 << 20)
+// c.Add(hash, body)
+// body, ok := c.Get(hash)
+func New(limit int64) *Cache {
+	return &Cache{limit: limit, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Returns the value cached under key and marks it as recently used. The value is shared and must not be modified.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*entry).value, true
+}
+
+// Caches a value, dropping the least recently used values until it fits. Values larger than the limit are not
+// cached.
+func (c *Cache) Add(key string, value []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
+	if int64(len(value)) > c.limit {
+		return
+	}
+	for c.size+int64(len(value)) > c.limit {
+		c.removeElement(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&entry{key, value})
+	c.size += int64(len(value))
+}
+
+// Drops the value cached under key, if any
+func (c *Cache) Remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
+}
+
+// Returns the number of cached values, their total length in bytes and the hits and misses of Get so far
+func (c *Cache) Stats() (int, int64, int64, int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries), c.size, c.hits, c.misses
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// HELPER METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Must hold the lock
+func (c *Cache) removeElement(element *list.Element) {
+	e := element.Value.(*entry)
+	c.order.Remove(element)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.value))
+}
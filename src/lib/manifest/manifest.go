@@ -0,0 +1,240 @@
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Describes a shared video. The publisher stores it in the DHT under the video's key (see Key) so that readers
+// know how many segments (or frames) to fetch, how to verify them and where they are placed without asking the
+// publisher.
+type Manifest struct {
+	Name        string
+	Size        int64     // size of the source file in bytes
+	SegNums     int64     // total number of segments, or frames for frame manifests
+	SegmentSize int       // bytes per segment, the last one may be shorter. 0 for frame manifests
+	Hashes      []string  // SHA-256 (hex) of every segment or frame, Hashes[i] belongs to segment i+1
+	Duration    float64   // seconds
+	FrameRate   float64   // frames per second of the source
+	Codec       string    // video codec of the source
+	Starts      []float64 // start time in seconds of every segment, only for files cut at keyframes
+	Stripes     []Stripe  // placement of the segments, in segment order
+	Deleted     bool      // set by Tombstone once the video was unpublished
+	DeletedAt   int64     // unix time of the unpublish
+	Encrypted   bool      // segments are sealed with a key of the video (see crypt), viewers get it from the share link
+
+	// Erasure coding. Segments are coded in groups of DataShards segments, each extended by ParityShards parity
+	// shards. Shard i of a group is placed on the i-th node of the successor list of the group's ShardKey and
+	// stored as segment ShardId of ShardFile. Any DataShards shards of a group are enough to get its segments.
+	DataShards   int      // 0 if the segments are not erasure coded
+	ParityShards int      // parity shards per group
+	Lengths      []int    // length of every segment, decoded shards are cut to it
+	ShardHashes  []string // SHA-256 (hex) of every shard in ShardId order, "" for the padding of the last group
+}
+
+// A run of consecutive segments (or frames) placed on the node responsible for Key
+type Stripe struct {
+	Key    string
+	First  int64
+	Last   int64
+	Holder string `json:",omitempty"` // streaming server keeping the frames when no node took them, "" if placed by Key
+}
+
+// Returned by Decode for data that is not a manifest
+var ErrInvalid = errors.New("manifest: invalid manifest")
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PUBLIC METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Returns the DHT key the manifest of a video is published under
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// data, err := manifest.Encode(m)
+// chordRPC.Put(manifest.Key("sample.mp4"), data)
+func Key(filename string) string {
+	return "manifest:" + filename
+}
+
+// Encodes a manifest for storage in the DHT
+func Encode(m Manifest) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Decodes a manifest read from the DHT
+func Decode(data []byte) (Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil || m.Name == "" {
+		return Manifest{}, ErrInvalid
+	}
+	return m, nil
+}
+
+// Returns the manifest published in place of an unpublished video. Holders that missed the deletion find it
+// when they check the manifests of the files they hold, and remove the video then.
+func Tombstone(filename string) Manifest {
+	return Manifest{Name: filename, Deleted: true, DeletedAt: time.Now().Unix()}
+}
+
+// Returns the name the shards of an erasure coded file are stored under
+func ShardFile(filename string) string {
+	return "shards:" + filename
+}
+
+// Returns the file the shards stored under name belong to, or name itself if it is not a ShardFile
+func SourceFile(name string) string {
+	return strings.TrimPrefix(name, ShardFile(""))
+}
+
+// Returns the key placing the shards of a group of an erasure coded file
+func ShardKey(filename string, group int) string {
+	return ShardFile(filename) + "_" + strconv.Itoa(group)
+}
+
+// Returns true if the segments of the file are erasure coded
+func (m Manifest) Coded() bool {
+	return m.DataShards > 0
+}
+
+// Returns the number of shard groups of an erasure coded file
+func (m Manifest) Groups() int {
+	return (int(m.SegNums) + m.DataShards - 1) / m.DataShards
+}
+
+// Returns the group of segment id (1 based) and the index of its data shard in the group
+func (m Manifest) GroupOf(id int) (int, int) {
+	return (id - 1) / m.DataShards, (id - 1) % m.DataShards
+}
+
+// Returns the segment id stored in data shard index of a group, 0 for the padding of the last group
+func (m Manifest) SegmentOf(group int, index int) int {
+	id := group*m.DataShards + index + 1
+	if index >= m.DataShards || id > int(m.SegNums) {
+		return 0
+	}
+	return id
+}
+
+// Returns the id of shard index of a group within ShardFile
+func (m Manifest) ShardId(group int, index int) int {
+	return group*(m.DataShards+m.ParityShards) + index + 1
+}
+
+// Returns the number of nodes asked for the shards of a group: the nodes the shards are placed on and ParityShards
+// more. Shards stay on their node when nodes join or leave, so they are found up to ParityShards positions away.
+func (m Manifest) ShardNodes() int {
+	return m.DataShards + 2*m.ParityShards
+}
+
+// Returns the published hash of shard index of a group
+func (m Manifest) ShardHash(group int, index int) string {
+	id := m.ShardId(group, index)
+	if id > len(m.ShardHashes) {
+		return ""
+	}
+	return m.ShardHashes[id-1]
+}
+
+// Returns the size of the shards of a group, the length of its longest segment
+func (m Manifest) ShardSize(group int) int {
+	size := 0
+	for index := 0; index < m.DataShards; index++ {
+		if id := m.SegmentOf(group, index); id > 0 && m.Lengths[id-1] > size {
+			size = m.Lengths[id-1]
+		}
+	}
+	return size
+}
+
+// Returns the published hash of segment id (1 based), or "" if the manifest has none
+func (m Manifest) Hash(id int) string {
+	if id < 1 || id > len(m.Hashes) {
+		return ""
+	}
+	return m.Hashes[id-1]
+}
+
+// Returns the segment playing at the given second, 1 if the file was not cut at keyframes
+func (m Manifest) SegmentAt(seconds float64) int {
+	id := 1
+	for i, start := range m.Starts {
+		if start > seconds {
+			break
+		}
+		id = i + 1
+	}
+	return id
+}
+
+// Returns the stripe holding segment id
+func (m Manifest) StripeOf(id int64) (Stripe, bool) {
+	for _, stripe := range m.Stripes {
+		if id >= stripe.First && id <= stripe.Last {
+			return stripe, true
+		}
+	}
+	return Stripe{}, false
+}
+
+// Reads the duration, frame rate and codec of the first video stream of a file with ffprobe
+func Probe(path string) (duration float64, frameRate float64, codec string, err error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=codec_name,r_frame_rate:format=duration", "-of", "json", path).Output()
+	if err != nil {
+		return 0, 0, "", err
+	}
+	var probe struct {
+		Streams []struct {
+			CodecName  string `json:"codec_name"`
+			RFrameRate string `json:"r_frame_rate"`
+		}
+		Format struct {
+			Duration string
+		}
+	}
+	if err = json.Unmarshal(out, &probe); err != nil {
+		return 0, 0, "", err
+	}
+	duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	if len(probe.Streams) > 0 {
+		codec = probe.Streams[0].CodecName
+		frameRate = parseRate(probe.Streams[0].RFrameRate)
+	}
+	return duration, frameRate, codec, nil
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// HELPER METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// ffprobe reports frame rates as fractions, e.g. 30000/1001
+func parseRate(rate string) float64 {
+	parts := strings.Split(rate, "/")
+	num, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0
+	}
+	if len(parts) == 2 {
+		den, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || den == 0 {
+			return 0
+		}
+		return num / den
+	}
+	return num
+}
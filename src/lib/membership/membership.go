@@ -0,0 +1,522 @@
+package membership
+
+import (
+	"../../consts"
+	"../utility"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Member states. Suspect members are still considered live until the suspicion is confirmed.
+const (
+	Alive   = "alive"
+	Suspect = "suspect"
+	Dead    = "dead"
+	Left    = "left"
+)
+
+// A node of the cluster. Address is the advertised gossip (udp) address and identifies the member. Incarnation
+// is only ever incremented by the member itself, to refute suspicions or to announce that it is leaving.
+type Member struct {
+	Address     string
+	StreamAddr  string
+	FtAddr      string
+	Capacity    int64 // advertised storage capacity in bytes
+	Incarnation uint64
+	State       string
+}
+
+// Message exchanged over udp. Every message piggybacks membership updates.
+//
+//	ping     : direct probe of Target, answered with an ack
+//	ping-req : asks the receiver to probe Target on behalf of Source
+//	ack      : answer to a ping, Target is the probed member. Relayed back to the requester for ping-req probes
+//	join     : sent by a new member to its seed, answered with a sync holding the full member list
+//	sync     : full member list
+type Message struct {
+	Type    string
+	Seq     uint64
+	Source  string
+	Target  string
+	Updates []Member
+}
+
+// An update waiting to be piggybacked, with the number of times it has been sent so far
+type broadcast struct {
+	member    Member
+	transmits int
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// GLOBAL VARS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+var (
+	self string // advertised gossip address of this node
+	conn *net.UDPConn
+
+	members    map[string]*Member
+	suspects   map[string]time.Time // when each suspect member was first suspected
+	down       map[string]time.Time // when each dead or left member was declared so, forgotten after SwimDeadExpiry
+	joined     bool                 // the seed answered the join with the member list
+	broadcasts []*broadcast
+	lock       sync.Mutex
+
+	seq      uint64
+	acks     map[uint64]chan bool // pending probes by sequence number
+	acksLock sync.Mutex
+
+	probeOrder []string // round robin probe order, reshuffled after every full pass
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PUBLIC METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Starts the membership service and joins the cluster through seedAddr. bindAddr is the local udp address to
+// listen on and advertiseAddr the address other members use to reach it (empty to advertise bindAddr). When
+// seedAddr is this node's own address, a new cluster is started. streamAddr, ftAddr and capacity are
+// disseminated to the other members as is. Returns once the listener is up.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// go membership.Start(":1600", "", ":1600", streamingServerAddress, ftAddr, 1<<30)
+// ...
+// for _, m := range membership.Members() { ... }
+func Start(bindAddr string, advertiseAddr string, seedAddr string, streamAddr string, ftAddr string, capacity int64) {
+	self = utility.AdvertiseAddr(bindAddr, advertiseAddr)
+	members = make(map[string]*Member)
+	suspects = make(map[string]time.Time)
+	down = make(map[string]time.Time)
+	acks = make(map[uint64]chan bool)
+	members[self] = &Member{self, streamAddr, ftAddr, capacity, 0, Alive}
+	me := *members[self]
+
+	udpAddr, err := net.ResolveUDPAddr("udp", bindAddr)
+	utility.CheckError(err)
+	conn, err = net.ListenUDP("udp", udpAddr)
+	utility.CheckError(err)
+	go listen()
+
+	seed := utility.AdvertiseAddr(seedAddr, "")
+	if seed != self && seedAddr != bindAddr {
+		go join(seed, me)
+	}
+	go probeLoop()
+}
+
+// Sends the join to the seed until it answers with the member list. The seed may not be up yet, and a udp datagram
+// may get lost.
+func join(seed string, me Member) {
+	for {
+		send(seed, Message{Type: "join", Source: self, Updates: []Member{me}})
+		time.Sleep(consts.SwimPeriod)
+		lock.Lock()
+		done := joined
+		lock.Unlock()
+		if done {
+			return
+		}
+		fmt.Println("No answer from seed " + seed + ". Retrying...")
+	}
+}
+
+// Returns the live (alive or suspect) members of the cluster including this node, sorted by address
+func Members() []Member {
+	lock.Lock()
+	defer lock.Unlock()
+	var live []Member
+	for _, m := range members {
+		if m.State == Alive || m.State == Suspect {
+			live = append(live, *m)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].Address < live[j].Address })
+	return live
+}
+
+// Returns the number of live members of the cluster including this node
+func LiveCount() int {
+	return len(Members())
+}
+
+// Updates the capacity this node advertises. The change is disseminated like any other update.
+func SetCapacity(capacity int64) {
+	lock.Lock()
+	defer lock.Unlock()
+	me := members[self]
+	me.Capacity = capacity
+	me.Incarnation++
+	enqueue(*me)
+}
+
+// Gracefully leaves the cluster. The leave is gossiped for a few protocol periods before returning.
+func Leave() {
+	lock.Lock()
+	me := members[self]
+	me.Incarnation++
+	me.State = Left
+	enqueue(*me)
+	lock.Unlock()
+	time.Sleep(3 * consts.SwimPeriod)
+}
+
+// Prints the live members to standard output
+func PrintMembers() {
+	fmt.Println(" -+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+ ")
+	fmt.Printf(" Cluster members seen by: %s\n", self)
+	fmt.Println(" -+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+ ")
+	fmt.Printf("| %-21s | %-7s | %-21s | %-21s | %s\n", "GOSSIP", "STATE", "STREAM", "TRANSFER", "CAPACITY")
+	for _, m := range Members() {
+		fmt.Printf("| %-21s | %-7s | %-21s | %-21s | %d\n", m.Address, m.State, m.StreamAddr, m.FtAddr, m.Capacity)
+	}
+	fmt.Println(" -+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+ ")
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// FAILURE DETECTION METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Runs one probe per protocol period. A member that does not ack a direct ping within the ack timeout is probed
+// indirectly through SwimIndirect other members. If none of them gets an ack before the end of the period, the
+// member is suspected. Suspicions that are not refuted within SwimSuspectTimeout are confirmed as dead.
+func probeLoop() {
+	for {
+		start := time.Now()
+		if target := nextProbeTarget(); target != "" {
+			probe(target)
+		}
+		confirmSuspects()
+		if elapsed := time.Since(start); elapsed < consts.SwimPeriod {
+			time.Sleep(consts.SwimPeriod - elapsed)
+		}
+	}
+}
+
+func probe(target string) {
+	id, ack := newProbe()
+	defer dropProbe(id)
+
+	send(target, Message{Type: "ping", Seq: id, Source: self, Target: target})
+	select {
+	case <-ack:
+		return
+	case <-time.After(consts.SwimAckTimeout):
+	}
+
+	for _, helper := range randomMembers(consts.SwimIndirect, target) {
+		send(helper, Message{Type: "ping-req", Seq: id, Source: self, Target: target})
+	}
+	select {
+	case <-ack:
+		return
+	case <-time.After(consts.SwimPeriod - consts.SwimAckTimeout):
+	}
+
+	lock.Lock()
+	if m, ok := members[target]; ok && m.State == Alive {
+		m.State = Suspect
+		suspects[target] = time.Now()
+		enqueue(*m)
+		fmt.Println("Suspecting member " + target)
+	}
+	lock.Unlock()
+}
+
+func confirmSuspects() {
+	lock.Lock()
+	defer lock.Unlock()
+	for addr, since := range suspects {
+		m := members[addr]
+		if m.State != Suspect {
+			delete(suspects, addr)
+			continue
+		}
+		if time.Since(since) > consts.SwimSuspectTimeout {
+			m.State = Dead
+			delete(suspects, addr)
+			down[addr] = time.Now()
+			enqueue(*m)
+			fmt.Println("Member " + addr + " confirmed dead")
+		}
+	}
+	for addr, since := range down {
+		if m, ok := members[addr]; !ok || (m.State != Dead && m.State != Left) {
+			delete(down, addr)
+			continue
+		}
+		if time.Since(since) > consts.SwimDeadExpiry {
+			// updates about unknown dead members are ignored, so stale gossip can't bring it back
+			delete(members, addr)
+			delete(down, addr)
+		}
+	}
+}
+
+// Returns the next member to probe. Members are probed in a round robin order that is reshuffled after every
+// pass so that each member is probed within a bounded time.
+func nextProbeTarget() string {
+	lock.Lock()
+	defer lock.Unlock()
+	for {
+		if len(probeOrder) == 0 {
+			for addr, m := range members {
+				if addr != self && (m.State == Alive || m.State == Suspect) {
+					probeOrder = append(probeOrder, addr)
+				}
+			}
+			if len(probeOrder) == 0 {
+				return ""
+			}
+			rand.Shuffle(len(probeOrder), func(i, j int) {
+				probeOrder[i], probeOrder[j] = probeOrder[j], probeOrder[i]
+			})
+		}
+		target := probeOrder[0]
+		probeOrder = probeOrder[1:]
+		if m, ok := members[target]; ok && (m.State == Alive || m.State == Suspect) {
+			return target
+		}
+	}
+}
+
+// Returns up to count random live members other than this node and the excluded one
+func randomMembers(count int, exclude string) []string {
+	lock.Lock()
+	defer lock.Unlock()
+	var candidates []string
+	for addr, m := range members {
+		if addr != self && addr != exclude && (m.State == Alive || m.State == Suspect) {
+			candidates = append(candidates, addr)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > count {
+		candidates = candidates[:count]
+	}
+	return candidates
+}
+
+func newProbe() (uint64, chan bool) {
+	acksLock.Lock()
+	defer acksLock.Unlock()
+	seq++
+	ack := make(chan bool, 1)
+	acks[seq] = ack
+	return seq, ack
+}
+
+func dropProbe(id uint64) {
+	acksLock.Lock()
+	delete(acks, id)
+	acksLock.Unlock()
+}
+
+func receivedAck(id uint64) {
+	acksLock.Lock()
+	if ack, ok := acks[id]; ok {
+		select {
+		case ack <- true:
+		default:
+		}
+	}
+	acksLock.Unlock()
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// DISSEMINATION METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Applies a membership update using the SWIM precedence rules:
+//
+//	alive(i)   overrides everything with a smaller incarnation j < i
+//	suspect(i) overrides alive(j) for i >= j and suspect(j) for i > j
+//	dead/left  overrides everything with a smaller or equal incarnation
+//
+// Suspicions about this node, and its death or leave announced before it restarted, are refuted by incrementing
+// our incarnation. A member we remember as dead or left that announces itself with an older incarnation (it
+// restarted from 0) is told so again, so that it refutes. Applied updates are re-gossiped.
+// Must be called with lock held.
+func apply(update Member) {
+	if update.Address == self {
+		me := members[self]
+		if update.State != Alive && update.Incarnation >= me.Incarnation && me.State != Left {
+			me.Incarnation = update.Incarnation + 1
+			enqueue(*me)
+		}
+		return
+	}
+	current, known := members[update.Address]
+	if !known {
+		if update.State == Dead || update.State == Left {
+			return
+		}
+		m := update
+		members[update.Address] = &m
+		if m.State == Suspect {
+			suspects[m.Address] = time.Now()
+		}
+		enqueue(m)
+		fmt.Println("Member " + update.Address + " joined")
+		return
+	}
+	newer := false
+	switch update.State {
+	case Alive:
+		newer = update.Incarnation > current.Incarnation
+	case Suspect:
+		newer = (current.State == Alive && update.Incarnation >= current.Incarnation) ||
+			(current.State == Suspect && update.Incarnation > current.Incarnation)
+	case Dead, Left:
+		newer = (current.State != Dead && current.State != Left && update.Incarnation >= current.Incarnation) ||
+			update.Incarnation > current.Incarnation
+	}
+	if !newer {
+		if update.State == Alive && (current.State == Dead || current.State == Left) {
+			enqueue(*current)
+		}
+		return
+	}
+	if update.State == Suspect && current.State != Suspect {
+		suspects[update.Address] = time.Now()
+	}
+	if update.State == Dead || update.State == Left {
+		down[update.Address] = time.Now()
+		fmt.Println("Member " + update.Address + " " + update.State)
+	} else if current.State == Dead || current.State == Left {
+		fmt.Println("Member " + update.Address + " rejoined")
+	}
+	*current = update
+	enqueue(update)
+}
+
+// Queues an update for piggybacking, replacing any pending update about the same member. Must be called with lock
+// held.
+func enqueue(m Member) {
+	for i, b := range broadcasts {
+		if b.member.Address == m.Address {
+			broadcasts = append(broadcasts[:i], broadcasts[i+1:]...)
+			break
+		}
+	}
+	broadcasts = append(broadcasts, &broadcast{member: m})
+}
+
+// Returns the updates to piggyback on the next message. Each update is sent SwimRetransmit * log(n+1) times,
+// least transmitted first.
+func piggyback() []Member {
+	lock.Lock()
+	defer lock.Unlock()
+	limit := int(math.Ceil(float64(consts.SwimRetransmit) * math.Log(float64(len(members)+1))))
+	sort.SliceStable(broadcasts, func(i, j int) bool { return broadcasts[i].transmits < broadcasts[j].transmits })
+	var updates []Member
+	kept := broadcasts[:0]
+	for _, b := range broadcasts {
+		if len(updates) < consts.SwimMaxPiggyback {
+			updates = append(updates, b.member)
+			b.transmits++
+		}
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	broadcasts = kept
+	return updates
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// CONNECTION METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Reads and handles incoming messages
+func listen() {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			continue
+		}
+		lock.Lock()
+		if msg.Type == "sync" {
+			joined = true
+		}
+		for _, update := range msg.Updates {
+			apply(update)
+		}
+		lock.Unlock()
+
+		switch msg.Type {
+		case "ping":
+			send(msg.Source, Message{Type: "ack", Seq: msg.Seq, Source: self, Target: self})
+		case "ping-req":
+			go func(msg Message) {
+				id, ack := newProbe()
+				defer dropProbe(id)
+				send(msg.Target, Message{Type: "ping", Seq: id, Source: self, Target: msg.Target})
+				select {
+				case <-ack:
+					send(msg.Source, Message{Type: "ack", Seq: msg.Seq, Source: self, Target: msg.Target})
+				case <-time.After(consts.SwimPeriod):
+				}
+			}(msg)
+		case "ack":
+			receivedAck(msg.Seq)
+		case "join":
+			send(msg.Source, Message{Type: "sync", Source: self, Updates: snapshot()})
+		}
+	}
+}
+
+// Returns every known member, used to bring a joining member up to date
+func snapshot() []Member {
+	lock.Lock()
+	defer lock.Unlock()
+	all := make([]Member, 0, len(members))
+	for _, m := range members {
+		all = append(all, *m)
+	}
+	return all
+}
+
+// Sends a message to addr, piggybacking pending updates on everything but sync messages
+func send(addr string, msg Message) {
+	if msg.Type != "sync" {
+		msg.Updates = append(msg.Updates, piggyback()...)
+	}
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+	conn.WriteToUDP(buf, udpAddr)
+}
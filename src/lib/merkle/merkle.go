@@ -0,0 +1,235 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"sort"
+	"sync"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// A Merkle tree over a fixed number of leaves. Every leaf is a bucket of keys (e.g. all keys hashing to the same
+// ring identifier) and its hash covers the sorted keys and their digests. Nodes are numbered heap style: 1 is the
+// root, the children of node i are 2i and 2i+1 and leaf l is node Leaves()+l.
+//
+// Hashes are recomputed lazily, so updating a key costs one map write until the next hash is read.
+type Tree struct {
+	leaves  int
+	hashes  [][]byte
+	dirty   []bool
+	buckets []map[string][]byte
+	lock    sync.Mutex
+}
+
+// Returns the hashes of the given nodes of a remote tree, in the same order
+type RemoteHashes func(nodes []int) ([][]byte, error)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PUBLIC METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Returns an empty tree with at least the given number of leaves (rounded up to a power of two). Two trees can
+// only be compared if they have the same number of leaves.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// tree := merkle.New(128)
+// tree.Set(identifier, key, merkle.Digest(value))
+// leaves, err := merkle.Diff(tree, tree.Cover(first, last), remoteHashes)
+func New(leaves int) *Tree {
+	size := 1
+	for size < leaves {
+		size *= 2
+	}
+	tree := &Tree{
+		leaves:  size,
+		hashes:  make([][]byte, 2*size),
+		dirty:   make([]bool, 2*size),
+		buckets: make([]map[string][]byte, size),
+	}
+	for i := range tree.dirty {
+		tree.dirty[i] = true
+	}
+	return tree
+}
+
+// Returns the SHA1 digest of data
+func Digest(data []byte) []byte {
+	sum := sha1.Sum(data)
+	return sum[:]
+}
+
+// Returns the number of leaves of the tree
+func (t *Tree) Leaves() int {
+	return t.leaves
+}
+
+// Sets the digest of key, which belongs to the given leaf
+func (t *Tree) Set(leaf int, key string, digest []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.buckets[leaf] == nil {
+		t.buckets[leaf] = make(map[string][]byte)
+	}
+	if old, ok := t.buckets[leaf][key]; ok && bytes.Equal(old, digest) {
+		return
+	}
+	t.buckets[leaf][key] = digest
+	t.invalidate(leaf)
+}
+
+// Removes key from the given leaf
+func (t *Tree) Delete(leaf int, key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.buckets[leaf][key]; !ok {
+		return
+	}
+	delete(t.buckets[leaf], key)
+	t.invalidate(leaf)
+}
+
+// Returns a copy of the keys and digests of a leaf
+func (t *Tree) Keys(leaf int) map[string][]byte {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	keys := make(map[string][]byte, len(t.buckets[leaf]))
+	for key, digest := range t.buckets[leaf] {
+		keys[key] = digest
+	}
+	return keys
+}
+
+// Returns the root hash of the tree
+func (t *Tree) Root() []byte {
+	return t.Hashes([]int{1})[0]
+}
+
+// Returns the hashes of the given nodes. Out of range node numbers get a nil hash.
+func (t *Tree) Hashes(nodes []int) [][]byte {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	hashes := make([][]byte, len(nodes))
+	for i, node := range nodes {
+		if node >= 1 && node < 2*t.leaves {
+			hashes[i] = t.hash(node)
+		}
+	}
+	return hashes
+}
+
+// Returns the smallest set of nodes whose leaves are exactly the leaves first to last (inclusive). If first is
+// greater than last the range wraps around, i.e. it is first to the last leaf followed by leaf 0 to last. The
+// hashes of these nodes act as the roots of the range.
+func (t *Tree) Cover(first int, last int) []int {
+	if first > last {
+		return append(t.cover(1, 0, t.leaves-1, first, t.leaves-1), t.cover(1, 0, t.leaves-1, 0, last)...)
+	}
+	return t.cover(1, 0, t.leaves-1, first, last)
+}
+
+// Compares the local tree with a remote one, starting from the given nodes (see Cover) and only descending into
+// nodes whose hashes differ. Returns the leaves that differ. The number of remote calls is bounded by the height
+// of the tree and the amount of hashes transferred is proportional to the number of differing leaves.
+func Diff(local *Tree, start []int, remote RemoteHashes) ([]int, error) {
+	var leaves []int
+	nodes := start
+	for len(nodes) > 0 {
+		remoteHashes, err := remote(nodes)
+		if err != nil {
+			return nil, err
+		}
+		localHashes := local.Hashes(nodes)
+		var next []int
+		for i, node := range nodes {
+			if i < len(remoteHashes) && bytes.Equal(localHashes[i], remoteHashes[i]) {
+				continue
+			}
+			if node >= local.leaves {
+				leaves = append(leaves, node-local.leaves)
+			} else {
+				next = append(next, 2*node, 2*node+1)
+			}
+		}
+		nodes = next
+	}
+	sort.Ints(leaves)
+	return leaves, nil
+}
+
+// Compares the keys of a local and a remote leaf. Returns the keys that are missing on either side or have
+// different digests.
+func DiffKeys(local map[string][]byte, remote map[string][]byte) []string {
+	var keys []string
+	for key, digest := range local {
+		if other, ok := remote[key]; !ok || !bytes.Equal(digest, other) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range remote {
+		if _, ok := local[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PRIVATE METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Marks a leaf and all of its ancestors for rehashing. Must be called with the lock held.
+func (t *Tree) invalidate(leaf int) {
+	for node := t.leaves + leaf; node >= 1; node /= 2 {
+		t.dirty[node] = true
+	}
+}
+
+// Returns the hash of a node, recomputing it if needed. Must be called with the lock held.
+func (t *Tree) hash(node int) []byte {
+	if !t.dirty[node] {
+		return t.hashes[node]
+	}
+	h := sha1.New()
+	if node >= t.leaves {
+		bucket := t.buckets[node-t.leaves]
+		keys := make([]string, 0, len(bucket))
+		for key := range bucket {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			h.Write([]byte(key))
+			h.Write([]byte{0})
+			h.Write(bucket[key])
+		}
+	} else {
+		h.Write(t.hash(2 * node))
+		h.Write(t.hash(2*node + 1))
+	}
+	t.hashes[node] = h.Sum(nil)
+	t.dirty[node] = false
+	return t.hashes[node]
+}
+
+// Returns the nodes below node (spanning leaves lo to hi) that exactly cover leaves first to last
+func (t *Tree) cover(node int, lo int, hi int, first int, last int) []int {
+	if last < lo || first > hi || first > last {
+		return nil
+	}
+	if first <= lo && hi <= last {
+		return []int{node}
+	}
+	mid := (lo + hi) / 2
+	return append(t.cover(2*node, lo, mid, first, last), t.cover(2*node+1, mid+1, hi, first, last)...)
+}
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	// "fmt"
 	"net/http"
+	"sync"
 	// "time"
 	// "os/exec"
 	// "runtime"
@@ -23,6 +24,7 @@ var Filepath string
 var Filename string
 var ByteChan chan byte
 var CloseStream chan int
+var channelsOnce sync.Once
 
 // =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
 // =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
@@ -70,12 +72,35 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	colorprint.Debug("VIDEO STREAM COMPLETED. CLOSING STREAM")
 	w.Write([]byte("Video Completed"))
 	colorprint.Debug("CLOSING")
-	close(ByteChan)
+	// ByteChan was closed by Stop
 	close(CloseStream)
 	for {}
 
 }
 
+// Stop()
+// --------------------------------------------------------------------------------------------
+// DESCRIPTION:
+// -------------------
+// This method ends the stream, e.g. when the video can't be fetched any further. The bytes already passed in are
+// still streamed.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// call player.Stop() once, after the last byte was passed into player.ByteChan
+func Stop() {
+	makeChannels()
+	close(ByteChan)
+}
+
+// The channels are made by whichever of Run and Stop is called first
+func makeChannels() {
+	channelsOnce.Do(func() {
+		ByteChan = make(chan byte, consts.WindowSize*100000)
+		CloseStream = make(chan int)
+	})
+}
+
 // Run()
 // --------------------------------------------------------------------------------------------
 // DESCRIPTION:
@@ -87,8 +112,7 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // call player.Run()
 func Run() {
 	colorprint.Warning("Starting Player")
-	ByteChan = make(chan byte, consts.WindowSize*100000)
-	CloseStream = make(chan int)
+	makeChannels()
 	http.HandleFunc("/", ServeHTTP)
 	http.ListenAndServe(":8080", nil)
 	// colorprint.Blue("The video " + Filename + " is streaming at http://localhost:8080/" + Filename)
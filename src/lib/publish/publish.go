@@ -0,0 +1,198 @@
+package publish
+
+import (
+	"../catalog"
+	"../kvstore"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Stage of a file being shared
+type Stage string
+
+const (
+	Splitting    Stage = "splitting"    // being cut into segments (and encrypted), redone from scratch when interrupted
+	Distributing Stage = "distributing" // segments being placed on the nodes responsible for them
+	Published    Stage = "published"    // manifest published
+)
+
+// A file shared by this node. Placed has bit id set for every segment (or erasure coded group, counted from 1)
+// placed so far, so an interrupted distribution only places the rest.
+type Record struct {
+	Name    string
+	Size    int64 // size and modification time (unix nanoseconds) of the source when it was shared
+	ModTime int64
+	Stage   Stage
+	Placed  catalog.Bitmap
+	Layout  string // what Placed counts: "" for segments, the erasure code (e.g. "4+2") for groups
+	Key     []byte // key the segments are sealed with, nil if not encrypted. Never leaves this node
+}
+
+// Tracks the files shared by this node. Records are kept in memory and written through to an engine, one record
+// per file.
+type Tracker struct {
+	store   kvstore.Engine
+	records map[string]*Record
+	lock    sync.Mutex
+}
+
+// Returned for files the tracker has no record of
+var ErrNotFound = errors.New("publish: no such file")
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PUBLIC METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Loads the records stored in engine
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// store, err := kvstore.OpenLog("./lib/filesys/publish.log", kvstore.DefaultOptions())
+// tracker, err := publish.Open(store)
+// rec, err := tracker.Begin("sample.mp4", info.Size(), info.ModTime().UnixNano(), nil)
+// err = tracker.SetStage("sample.mp4", publish.Distributing)
+// err = tracker.Place("sample.mp4", 1)
+func Open(store kvstore.Engine) (*Tracker, error) {
+	t := &Tracker{store: store, records: make(map[string]*Record)}
+	names, err := store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		data, err := store.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		var rec Record
+		if err = json.Unmarshal(data, &rec); err != nil {
+			return nil, err
+		}
+		t.records[name] = &rec
+	}
+	return t, nil
+}
+
+// Starts a new record for a file, replacing any previous one
+func (t *Tracker) Begin(name string, size int64, modTime int64, key []byte) (Record, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	rec := &Record{Name: name, Size: size, ModTime: modTime, Stage: Splitting, Key: key}
+	if err := t.save(rec); err != nil {
+		return Record{}, err
+	}
+	t.records[name] = rec
+	return rec.copy(), nil
+}
+
+// Returns a copy of the record of a file
+func (t *Tracker) Get(name string) (Record, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	rec, ok := t.records[name]
+	if !ok {
+		return Record{}, false
+	}
+	return rec.copy(), true
+}
+
+// Returns true if the record of a file was made for a source of the given size and modification time
+func (t *Tracker) Unchanged(name string, size int64, modTime int64) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	rec, ok := t.records[name]
+	return ok && rec.Size == size && rec.ModTime == modTime
+}
+
+// Moves a file to the next stage
+func (t *Tracker) SetStage(name string, stage Stage) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	rec, ok := t.records[name]
+	if !ok {
+		return ErrNotFound
+	}
+	rec.Stage = stage
+	return t.save(rec)
+}
+
+// Records that segment (or group) id of a file was placed
+func (t *Tracker) Place(name string, id int64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	rec, ok := t.records[name]
+	if !ok {
+		return ErrNotFound
+	}
+	rec.Placed = rec.Placed.Set(id)
+	return t.save(rec)
+}
+
+// Sets what the placed ids of a file count. The ids placed so far are forgotten when the layout changes, e.g. when
+// a share is resumed with another erasure code.
+func (t *Tracker) SetLayout(name string, layout string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	rec, ok := t.records[name]
+	if !ok {
+		return ErrNotFound
+	}
+	if rec.Layout == layout {
+		return nil
+	}
+	rec.Layout, rec.Placed = layout, nil
+	return t.save(rec)
+}
+
+// Forgets a file, e.g. once it was unpublished. Removing a file without a record is not an error.
+func (t *Tracker) Remove(name string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := t.store.Delete(name); err != nil {
+		return err
+	}
+	delete(t.records, name)
+	return nil
+}
+
+// Returns the files whose sharing was interrupted before the manifest was published
+func (t *Tracker) Pending() []Record {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var pending []Record
+	for _, rec := range t.records {
+		if rec.Stage != Published {
+			pending = append(pending, rec.copy())
+		}
+	}
+	return pending
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// HELPER METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Must hold the lock
+func (t *Tracker) save(rec *Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return t.store.Put(rec.Name, data)
+}
+
+func (rec *Record) copy() Record {
+	c := *rec
+	c.Placed = append(catalog.Bitmap(nil), rec.Placed...)
+	return c
+}
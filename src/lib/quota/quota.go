@@ -0,0 +1,269 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Kind of a stored segment
+type Class int
+
+const (
+	Primary Class = iota // placed on this node by the overlay (or published by it), never evicted
+	Cached               // replicas and copies kept for streaming, evicted when space runs out
+)
+
+// A segment (or frame) of a file stored on this node. Segments with the same content share their storage, so
+// Size is only counted once per Hash.
+type Item struct {
+	File     string
+	Segment  int
+	Hash     string
+	Size     int64
+	Class    Class
+	LastUsed time.Time
+	Hits     int64
+}
+
+// Disk budget of a node. Tracks the segments stored per file and, when an item does not fit, evicts cached items
+// in LRU order ("lru") or least popular first ("popularity", fewest reads since startup).
+type Quota struct {
+	limit  int64
+	policy string
+	used   int64
+	items  map[itemKey]*Item
+	refs   map[string]int // items per content hash
+	evict  func(item Item, unreferenced bool)
+	lock   sync.Mutex
+}
+
+type itemKey struct {
+	file    string
+	segment int
+}
+
+// Returned by Admit, wrapped with the space free and needed, when an item does not fit even after every cached
+// item was evicted. Match it with errors.Is.
+var ErrQuotaExceeded = errors.New("quota: storage quota exceeded")
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PUBLIC METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Returns a quota of limit bytes (0 for no limit). evict is called for every evicted item, after the item was
+// removed from the quota, with unreferenced set when no other item shares its content so the content can be deleted.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// q := quota.New(1<<30, "lru", func(item quota.Item, unreferenced bool) { ... })
+// err := q.Admit(quota.Item{File: "sample.mp4", Segment: 3, Hash: hash, Size: 1024, Class: quota.Primary})
+// q.Touch("sample.mp4", 3)
+func New(limit int64, policy string, evict func(item Item, unreferenced bool)) *Quota {
+	return &Quota{
+		limit:  limit,
+		policy: policy,
+		items:  make(map[itemKey]*Item),
+		refs:   make(map[string]int),
+		evict:  evict,
+	}
+}
+
+// Accounts for a new item, evicting cached items if needed. Returns ErrQuotaExceeded (and stores nothing) if the
+// item does not fit. Admitting an item that is already accounted for updates it; a primary item stays primary.
+// An item with new content replaces the old one only once it fits, counting the space the old content frees.
+func (q *Quota) Admit(item Item) error {
+	q.lock.Lock()
+	key := itemKey{item.File, item.Segment}
+	need := item.Size
+	if q.refs[item.Hash] > 0 {
+		need = 0
+	}
+	old, replaced := q.items[key]
+	if replaced {
+		if old.Hash == item.Hash {
+			if item.Class == Primary {
+				old.Class = Primary
+			}
+			old.LastUsed = time.Now()
+			q.lock.Unlock()
+			return nil
+		}
+		// the old item stays accounted for until the new one is known to fit
+		if q.refs[old.Hash] == 1 {
+			need -= old.Size
+		}
+	}
+	var victims []Item
+	var unreferenced []bool
+	if q.limit > 0 && q.used+need > q.limit && q.used+need-q.evictable(item.Hash, key) <= q.limit {
+		for _, victim := range q.candidates(item.Hash, key) {
+			if q.used+need <= q.limit {
+				break
+			}
+			victims = append(victims, *victim)
+			unreferenced = append(unreferenced, q.remove(itemKey{victim.File, victim.Segment}))
+		}
+	}
+	if q.limit > 0 && q.used+need > q.limit {
+		// nothing is evicted for an item that does not fit anyway
+		q.lock.Unlock()
+		return fmt.Errorf("%w: %d of %d bytes free, %d needed", ErrQuotaExceeded, q.Free(), q.limit, need)
+	}
+	if replaced {
+		q.remove(key)
+	}
+	if q.refs[item.Hash] == 0 {
+		q.used += item.Size
+	}
+	item.LastUsed = time.Now()
+	q.items[key] = &item
+	q.refs[item.Hash]++
+	q.lock.Unlock()
+	q.notify(victims, unreferenced)
+	return nil
+}
+
+// Accounts for an item stored before the quota was set up. The limit is not checked, so a node restarted with a
+// smaller budget keeps its data and only evicts once new items are admitted.
+func (q *Quota) Load(item Item) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	key := itemKey{item.File, item.Segment}
+	if _, ok := q.items[key]; ok {
+		q.remove(key)
+	}
+	if q.refs[item.Hash] == 0 {
+		q.used += item.Size
+	}
+	item.LastUsed = time.Now()
+	q.items[key] = &item
+	q.refs[item.Hash]++
+}
+
+// Returns the class of an item and whether it is accounted for
+func (q *Quota) Class(file string, segment int) (Class, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if item, ok := q.items[itemKey{file, segment}]; ok {
+		return item.Class, true
+	}
+	return Primary, false
+}
+
+// Records a read of an item, for the eviction policy
+func (q *Quota) Touch(file string, segment int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if item, ok := q.items[itemKey{file, segment}]; ok {
+		item.LastUsed = time.Now()
+		item.Hits++
+	}
+}
+
+// Removes an item that was deleted. Returns true if no other item shares its content.
+func (q *Quota) Release(file string, segment int) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.items[itemKey{file, segment}]; !ok {
+		return false
+	}
+	return q.remove(itemKey{file, segment})
+}
+
+// Returns the bytes in use and the limit (0 for no limit)
+func (q *Quota) Usage() (int64, int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.used, q.limit
+}
+
+// Returns the bytes still free, -1 for no limit
+func (q *Quota) Free() int64 {
+	used, limit := q.Usage()
+	if limit == 0 {
+		return -1
+	}
+	return limit - used
+}
+
+// Returns the bytes stored per file. Content shared by several files is counted for each of them.
+func (q *Quota) Files() map[string]int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	usage := make(map[string]int64)
+	for _, item := range q.items {
+		usage[item.File] += item.Size
+	}
+	return usage
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// HELPER METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Returns the cached items in eviction order, leaving out items with the given content and the item being
+// replaced. Must hold the lock.
+func (q *Quota) candidates(hash string, skip itemKey) []*Item {
+	var cached []*Item
+	for key, item := range q.items {
+		if item.Class == Cached && item.Hash != hash && key != skip {
+			cached = append(cached, item)
+		}
+	}
+	sort.Slice(cached, func(i, j int) bool {
+		if q.policy == "popularity" && cached[i].Hits != cached[j].Hits {
+			return cached[i].Hits < cached[j].Hits
+		}
+		return cached[i].LastUsed.Before(cached[j].LastUsed)
+	})
+	return cached
+}
+
+// Returns the bytes freed by evicting every cached item, leaving out items with the given content and the item
+// being replaced. Content shared with a primary item is not freed. Must hold the lock.
+func (q *Quota) evictable(hash string, skip itemKey) int64 {
+	refs := make(map[string]int)
+	var freed int64
+	for _, item := range q.candidates(hash, skip) {
+		refs[item.Hash]++
+		if refs[item.Hash] == q.refs[item.Hash] {
+			freed += item.Size
+		}
+	}
+	return freed
+}
+
+// Removes an item and returns true if its content is no longer referenced. Must hold the lock.
+func (q *Quota) remove(key itemKey) bool {
+	item := q.items[key]
+	delete(q.items, key)
+	q.refs[item.Hash]--
+	if q.refs[item.Hash] > 0 {
+		return false
+	}
+	delete(q.refs, item.Hash)
+	q.used -= item.Size
+	return true
+}
+
+func (q *Quota) notify(victims []Item, unreferenced []bool) {
+	if q.evict == nil {
+		return
+	}
+	for i, victim := range victims {
+		q.evict(victim, unreferenced[i])
+	}
+}
@@ -0,0 +1,203 @@
+package search
+
+import (
+	"../manifest"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Inverted index of the published videos kept in the DHT. Every token of a video's title and metadata is stored
+// under Key(token) with the sorted manifest keys (postings) of the videos it appears in.
+//
+// Postings are updated by reading, merging and writing them back, so two nodes publishing videos with a token in
+// common at the same moment may drop one of the postings. Sharing the video again adds it back.
+type Index struct {
+	put     func(string, []byte) error
+	get     func(string) ([]byte, error)
+	seeders func(manifest.Manifest) int
+}
+
+// A video matching a query
+type Result struct {
+	Name      string
+	Size      int64   // bytes
+	Duration  float64 // seconds
+	Seeders   int     // nodes holding segments of the video
+	Encrypted bool    // can only be streamed with the share link
+}
+
+// Tokens shorter than this are not indexed
+var MinTokenLength = 2
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PUBLIC METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Returns an index stored with the DHT's put and get. seeders counts the nodes holding a video for search results.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// index := search.New(chordRPC.Put, chordRPC.Get, countSeeders)
+// err := index.Add(m)
+// results, err := index.Search("big buck bunny")
+func New(put func(string, []byte) error, get func(string) ([]byte, error), seeders func(manifest.Manifest) int) *Index {
+	return &Index{put: put, get: get, seeders: seeders}
+}
+
+// Returns the DHT key the postings of a token are stored under
+func Key(token string) string {
+	return "index:" + token
+}
+
+// Splits texts into lower case words of letters and digits, without duplicates
+func Tokens(texts ...string) []string {
+	var tokens []string
+	seen := make(map[string]bool)
+	for _, text := range texts {
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, word := range words {
+			if len(word) >= MinTokenLength && !seen[word] {
+				seen[word] = true
+				tokens = append(tokens, word)
+			}
+		}
+	}
+	return tokens
+}
+
+// Returns the tokens a video is indexed by: the words of its title (the file name without extension), the
+// extension and the codec
+func ManifestTokens(m manifest.Manifest) []string {
+	ext := filepath.Ext(m.Name)
+	return Tokens(strings.TrimSuffix(m.Name, ext), ext, m.Codec)
+}
+
+// Adds a published video to the postings of its tokens
+func (index *Index) Add(m manifest.Manifest) error {
+	key := manifest.Key(m.Name)
+	for _, token := range ManifestTokens(m) {
+		postings := index.postings(token)
+		if contains(postings, key) {
+			continue
+		}
+		if err := index.store(token, append(postings, key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes an unpublished video from the postings of its tokens
+func (index *Index) Remove(m manifest.Manifest) error {
+	key := manifest.Key(m.Name)
+	for _, token := range ManifestTokens(m) {
+		postings := index.postings(token)
+		if !contains(postings, key) {
+			continue
+		}
+		var kept []string
+		for _, posting := range postings {
+			if posting != key {
+				kept = append(kept, posting)
+			}
+		}
+		if err := index.store(token, kept); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the published videos whose tokens include every token of query, sorted by name. Videos unpublished since
+// they were indexed are left out.
+func (index *Index) Search(query string) ([]Result, error) {
+	tokens := Tokens(query)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	matches := index.postings(tokens[0])
+	for _, token := range tokens[1:] {
+		if len(matches) == 0 {
+			break
+		}
+		matches = intersect(matches, index.postings(token))
+	}
+	var results []Result
+	for _, key := range matches {
+		data, err := index.get(key)
+		if err != nil {
+			continue
+		}
+		m, err := manifest.Decode(data)
+		if err != nil || m.Deleted {
+			continue
+		}
+		results = append(results, Result{Name: m.Name, Size: m.Size, Duration: m.Duration, Seeders: index.seeders(m), Encrypted: m.Encrypted})
+	}
+	return results, nil
+}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// HELPER METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Returns the sorted postings of a token, none if the token is not indexed or can't be read
+func (index *Index) postings(token string) []string {
+	data, err := index.get(Key(token))
+	if err != nil {
+		return nil
+	}
+	var postings []string
+	if json.Unmarshal(data, &postings) != nil {
+		return nil
+	}
+	sort.Strings(postings)
+	return postings
+}
+
+func (index *Index) store(token string, postings []string) error {
+	sort.Strings(postings)
+	data, err := json.Marshal(postings)
+	if err != nil {
+		return err
+	}
+	return index.put(Key(token), data)
+}
+
+// Returns the keys in both sorted lists
+func intersect(a []string, b []string) []string {
+	var both []string
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			both = append(both, a[i])
+			i++
+			j++
+		}
+	}
+	return both
+}
+
+func contains(sorted []string, key string) bool {
+	i := sort.SearchStrings(sorted, key)
+	return i < len(sorted) && sorted[i] == key
+}
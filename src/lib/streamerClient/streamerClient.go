@@ -6,6 +6,9 @@ import (
 	"net/rpc"
 	"fmt"
 	"os"
+	"bytes"
+	"errors"
+	"../castore"
 )
 
 // type StreamNode struct {
@@ -24,6 +27,7 @@ type Msg struct {
   Val string
   Address string
   Data []byte
+  Hash string // content hash of Data. Data is left out when the server already stores the content
 }
 var nodeAddr string
 type NodeRPCService int
@@ -46,26 +50,112 @@ func GetRpcHandler(rpcAddr string) (*rpc.Client) {
 	//var err error
 	var nodeRPCHandler *rpc.Client
 	nodeRPCHandler, err := rpc.Dial("tcp", rpcAddr)
-	
-	checkError(err)
+	if err != nil {
+		// callers try again
+		log.Printf("Unable to reach %s: %v", rpcAddr, err)
+		return nil
+	}
 	//defer nodeRPCHandler.Close()
 	return nodeRPCHandler
 }
 
 func StartStreaming(handler *rpc.Client, filename string, iden int64, startFrame string, addr string) {
-	msg := Msg {iden, filename, startFrame, addr, nil}
+	msg := Msg {iden, filename, startFrame, addr, nil, ""}
 	var reply Reply
 	err := handler.Call("NodeRPCService.StartStreaming", &msg, &reply) // returns id in msg.Id, and ip:port in msg.Val
 	checkError(err)
 	fmt.Println("Reply received: ", reply.Val)
 }
 
-func SaveToServer(handler *rpc.Client, nodename string, folderFilePath string, data []byte, addr string) {
-	msg := Msg {0, folderFilePath, nodename, addr, data}
+func SaveToServer(handler *rpc.Client, nodename string, folderFilePath string, data []byte, addr string) error {
+	msg := Msg {0, folderFilePath, nodename, addr, data, castore.Hash(data)}
 	var reply Reply
-	err := handler.Call("NodeRPCService.SaveToServer", &msg, &reply) // returns id in msg.Id, and ip:port in msg.Val
+	// leave the frame out if the server already stores the same content
+	err := handler.Call("NodeRPCService.HasObject", &msg, &reply)
 	checkError(err)
+	if reply.Val == "yes" {
+		msg.Data = nil
+	}
+	// refused if the frame does not fit into the server's storage quota
+	err = handler.Call("NodeRPCService.SaveToServer", &msg, &reply) // returns id in msg.Id, and ip:port in msg.Val
+	if err != nil {
+		return err
+	}
 	fmt.Println("Reply received: ", reply.Val)
+	return nil
+}
+
+// Returns a frame ("<video> <frame>") stored on the server, e.g. "sample 00001.png"
+func FetchFrame(handler *rpc.Client, videoFrame string) ([]byte, error) {
+	msg := Msg {0, videoFrame, "", "", nil, ""}
+	var reply Reply
+	err := handler.Call("NodeRPCService.GetFrame", &msg, &reply)
+	return []byte(reply.Val), err
+}
+
+// Streams the frames (png images) received on frames to addr, in the order received, until frames is closed.
+// Encrypted videos are played this way while their frames are fetched and decrypted, since the servers can't read
+// them.
+func StreamFrames(frames <-chan []byte, addr string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("ffmpeg", "-re", "-f", "image2pipe", "-vcodec", "png", "-i", "-", "-r", "10",
+		"-vcodec", "mpeg4", "-f", "mpegts", addr)
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	for frame := range frames {
+		if err != nil {
+			// ffmpeg stopped reading, the sender still has to finish
+			continue
+		}
+		_, err = stdin.Write(frame)
+	}
+	stdin.Close()
+	if waitErr := cmd.Wait(); waitErr != nil {
+		return errors.New(waitErr.Error() + ": " + stderr.String())
+	}
+	return err
+}
+
+// Asks the server at addr whether it stores frames of a video. A server that can't be reached returns an error.
+func HoldsVideo(addr string, filename string) (bool, error) {
+	handler, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		return false, err
+	}
+	defer handler.Close()
+	msg := Msg {0, filename, "", "", nil, ""}
+	var reply Reply
+	err = handler.Call("NodeRPCService.HoldsVideo", &msg, &reply)
+	return reply.Val == "yes", err
+}
+
+// Asks the server to delete the frames of an unpublished video
+func DeleteVideo(handler *rpc.Client, filename string) error {
+	msg := Msg {0, filename, "", "", nil, ""}
+	var reply Reply
+	return handler.Call("NodeRPCService.DeleteVideo", &msg, &reply)
+}
+
+// Stores the manifest of a video on the server responsible for its key
+func PublishManifest(handler *rpc.Client, key string, data []byte) {
+	msg := Msg {0, key, "", "", data, ""}
+	var reply Reply
+	err := handler.Call("NodeRPCService.PutManifest", &msg, &reply)
+	checkError(err)
+}
+
+// Returns the manifest stored under key, or an error if the video was not published
+func FetchManifest(handler *rpc.Client, key string) ([]byte, error) {
+	msg := Msg {0, key, "", "", nil, ""}
+	var reply Reply
+	err := handler.Call("NodeRPCService.GetManifest", &msg, &reply)
+	return []byte(reply.Val), err
 }
 
 func checkError(err error) {
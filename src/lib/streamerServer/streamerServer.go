@@ -2,7 +2,7 @@ package streamerServer
 
 import (
 	"net"
-	//"os"
+	"os"
 	"net/rpc"
 	"log"
 	"os/exec"
@@ -11,6 +11,13 @@ import (
 	//"strconv"
 	"io/ioutil"
 	"strings"
+	"strconv"
+	"errors"
+	"time"
+	"../../consts"
+	"../castore"
+	"../crypt"
+	"../quota"
 	//"../customChord"
 )
 
@@ -23,19 +30,44 @@ type Msg struct {
   Val string
   Address string
   Data []byte
+  Hash string // content hash of Data. Data is left out when this node already stores the content
 }
 
 var nodeAddr string
 var nodeName string
 var dest string
+var objects *castore.Store // frames of every video, stored once per distinct content
+var frames *quota.Quota // disk budget of the stored frames
+var quotaLimit int64
+var quotaPolicy string = "lru"
+var OnRemove func(video string) // called after a video was removed, e.g. to drop it from the overlay's store
 type NodeRPCService int
 
+// frames of a video kept as backup for another node are recorded under this manifest name prefix
+const replicaPrefix = "replica:"
+
 func (this *NodeRPCService) SaveToServer(msg *Msg, reply *Reply) error {
 	fmt.Println("FILEFOLDERSHIT: ", msg.Filename)
 	pathArr := strings.Split(msg.Filename, " ")
 
-	path := "FFMPEG/NodesData/" + nodeName + "/" + pathArr[0] + "/" + pathArr[1]
-	err := ioutil.WriteFile(path, msg.Data, 0644)
+	hash := msg.Hash
+	if len(msg.Data) > 0 {
+		if hash != "" && castore.Hash(msg.Data) != hash {
+			return errors.New("frame " + msg.Filename + " rejected: checksum mismatch")
+		}
+		hash = castore.Hash(msg.Data)
+	} else if !objects.Has(hash) {
+		return errors.New("frame content " + hash + " unavailable")
+	}
+	// the sender places frames this node has no room for on another node
+	if err := admitFrame(pathArr[0], pathArr[1], hash, len(msg.Data), quota.Primary); err != nil {
+		return errors.New("storage quota exceeded on " + nodeAddr + ": " + err.Error())
+	}
+	if len(msg.Data) > 0 {
+		_, err := objects.Put(msg.Data)
+		checkError(err)
+	}
+	err := storeFrame(pathArr[0], pathArr[1], 0, hash)
 	checkError(err)
 	reply.Val = "OKiE"
 
@@ -59,6 +91,16 @@ func (this *NodeRPCService) StartStreaming(msg *Msg, reply *Reply) error {
 	// _ = cmd0.Wait()
 	// fmt.Println("PWD: ", out.String())
 	fnArr := strings.Split(msg.Filename, ".")
+	// the first frame may only be held as backup of a failed neighbour
+	start, _ := strconv.Atoi(msg.Val)
+	if _, err := os.Stat(dest + fnArr[0] + "/" + fmt.Sprintf("%05d.png", start)); os.IsNotExist(err) {
+		if err := PromoteReplicas(fnArr[0]); err != nil {
+			return err
+		}
+	}
+	if err := verifyFrames(fnArr[0]); err != nil {
+		return err
+	}
 	path := dest + fnArr[0] + "/%05d.png"
 	cmd := exec.Command("ffmpeg", "-start_number", msg.Val, "-re", "-i", path, "-r", "10", 
 	"-vcodec", "mpeg4", "-f", "mpegts", msg.Address)
@@ -87,6 +129,460 @@ func (this *NodeRPCService) StartStreaming(msg *Msg, reply *Reply) error {
 	return nil
 }
 
+func (this *NodeRPCService) PutManifest(msg *Msg, reply *Reply) error {
+	err := ioutil.WriteFile(manifestPath(msg.Filename) + ".tmp", msg.Data, 0644)
+	if err != nil {
+		return err
+	}
+	reply.Val = "ok"
+	return os.Rename(manifestPath(msg.Filename) + ".tmp", manifestPath(msg.Filename))
+}
+
+func (this *NodeRPCService) GetManifest(msg *Msg, reply *Reply) error {
+	data, err := ioutil.ReadFile(manifestPath(msg.Filename))
+	if os.IsNotExist(err) {
+		return errors.New("no manifest published under " + msg.Filename)
+	}
+	reply.Val = string(data)
+	return err
+}
+
+func (this *NodeRPCService) DeleteVideo(msg *Msg, reply *Reply) error {
+	if err := RemoveVideo(strings.Split(msg.Filename, ".")[0]); err != nil {
+		return err
+	}
+	reply.Val = "ok"
+	return nil
+}
+
+func (this *NodeRPCService) HasObject(msg *Msg, reply *Reply) error {
+	if objects.Has(msg.Hash) {
+		reply.Val = "yes"
+	}
+	return nil
+}
+
+/*
+* Replies "yes" if frames of the video msg.Filename are stored on this node, including frames taken over from a
+* failed neighbour
+*/
+func (this *NodeRPCService) HoldsVideo(msg *Msg, reply *Reply) error {
+	manifest, err := objects.LoadManifest(strings.Split(msg.Filename, ".")[0])
+	if err == castore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(manifest.Segments) > 0 {
+		reply.Val = "yes"
+	}
+	return nil
+}
+
+/*
+* Returns a stored frame, msg.Filename is "<video> <frame>". Used by viewers of encrypted videos, which decrypt
+* and play the frames themselves.
+*/
+func (this *NodeRPCService) GetFrame(msg *Msg, reply *Reply) error {
+	pathArr := strings.Split(msg.Filename, " ")
+	if len(pathArr) != 2 {
+		return errors.New("invalid frame " + msg.Filename)
+	}
+	number, err := strconv.Atoi(strings.TrimSuffix(pathArr[1], ".png"))
+	if err != nil {
+		return err
+	}
+	manifest, err := objects.LoadManifest(pathArr[0])
+	if err != nil {
+		return err
+	}
+	hash, ok := manifest.Segments[number]
+	if !ok {
+		return errors.New("frame " + msg.Filename + " is not stored on " + nodeAddr)
+	}
+	data, err := objects.Get(hash)
+	if err != nil {
+		return err
+	}
+	frames.Touch(pathArr[0], number)
+	reply.Val = string(data)
+	return nil
+}
+
+/*
+* Sets the disk budget of the stored frames in bytes (0 for no limit) and the order backup frames are evicted in
+* (lru or popularity). Call before Start.
+*/
+func SetQuota(limit int64, policy string) {
+	quotaLimit = limit
+	quotaPolicy = policy
+}
+
+/*
+* Keeps a frame of a video as backup for another node. Backup frames are evicted when frames placed on this node
+* need the space, and are not kept at all if they do not fit.
+*/
+func StoreReplica(video string, frame string, data []byte) error {
+	for frames == nil {
+		// the store is opened by Start
+		time.Sleep(100 * time.Millisecond)
+	}
+	number, err := strconv.Atoi(strings.TrimSuffix(frame, ".png"))
+	if err != nil {
+		return err
+	}
+	hash := castore.Hash(data)
+	if err = admitFrame(replicaPrefix + video, frame, hash, len(data), quota.Cached); err != nil {
+		return err
+	}
+	if _, err = objects.Put(data); err != nil {
+		frames.Release(replicaPrefix + video, number)
+		return err
+	}
+	return objects.AddToManifest(replicaPrefix + video, number, 0, hash)
+}
+
+/*
+* Serves the backup frames kept by StoreReplica for a video as frames of this node, once it takes over the part of
+* a failed neighbour. The frames are linked into the video's frame folder, where ffmpeg reads them from.
+*/
+func PromoteReplicas(video string) error {
+	for frames == nil {
+		// the store is opened by Start
+		time.Sleep(100 * time.Millisecond)
+	}
+	manifest, err := objects.LoadManifest(replicaPrefix + video)
+	if err == castore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hashes := make(map[int]string)
+	for number, hash := range manifest.Segments {
+		frame := fmt.Sprintf("%05d.png", number)
+		frames.Release(replicaPrefix + video, number)
+		if err = admitFrame(video, frame, hash, 0, quota.Primary); err != nil {
+			return err
+		}
+		if err = objects.Link(hash, dest + video + "/" + frame); err != nil {
+			return err
+		}
+		hashes[number] = hash
+	}
+	if err = objects.AddAllToManifest(video, 0, hashes); err != nil {
+		return err
+	}
+	log.Printf("Took over %d backup frames of %s", len(hashes), video)
+	return objects.RemoveManifest(replicaPrefix + video)
+}
+
+/*
+* Replaces the frames extracted by GetFrames by the frames sealed with key (see crypt.Seal), so that the nodes they
+* are placed on only hold ciphertext. The plain frames are reclaimed by CollectGarbage.
+*/
+func EncryptVideo(video string, key []byte) error {
+	manifest, err := objects.LoadManifest(video)
+	if err != nil {
+		return err
+	}
+	for number, hash := range manifest.Segments {
+		data, err := objects.Get(hash)
+		if err != nil {
+			return err
+		}
+		sealed, err := crypt.Seal(key, video, number, data)
+		if err != nil {
+			return err
+		}
+		frame := fmt.Sprintf("%05d.png", number)
+		if hash, err = objects.Put(sealed); err != nil {
+			return err
+		}
+		if err = storeFrame(video, frame, manifest.SegNums, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+* Accounts for the frames first to last of a video extracted by GetFrames as frames placed on this node. Extracted
+* frames don't count against the quota until then, the frames of parts placed on other nodes are dropped instead
+* (see DropFrames).
+*/
+func KeepFrames(video string, first int, last int) error {
+	manifest, err := objects.LoadManifest(video)
+	if err != nil {
+		return err
+	}
+	for number := first; number <= last; number++ {
+		hash, ok := manifest.Segments[number]
+		if !ok {
+			return errors.New("frame " + strconv.Itoa(number) + " of " + video + " is not stored")
+		}
+		if err = admitFrame(video, fmt.Sprintf("%05d.png", number), hash, 0, quota.Primary); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+* Drops the frames first to last of a video extracted by GetFrames once another node took them. The frame content
+* is reclaimed by CollectGarbage.
+*/
+func DropFrames(video string, first int, last int) error {
+	for number := first; number <= last; number++ {
+		frames.Release(video, number)
+		if err := objects.RemoveFromManifest(video, number); err != nil {
+			return err
+		}
+		os.Remove(dest + video + "/" + fmt.Sprintf("%05d.png", number))
+	}
+	return nil
+}
+
+/*
+* Deletes the frames of an unpublished video from this node, including the frames kept as backup for a neighbour.
+* The frame content is reclaimed by CollectGarbage once no other video shares it.
+*/
+func RemoveVideo(video string) error {
+	for frames == nil {
+		// the store is opened by Start
+		time.Sleep(100 * time.Millisecond)
+	}
+	manifest, err := objects.LoadManifest(video)
+	if err != nil && err != castore.ErrNotFound {
+		return err
+	}
+	for number := range manifest.Segments {
+		frames.Release(video, number)
+	}
+	if err = objects.RemoveManifest(video); err != nil {
+		return err
+	}
+	if err = RemoveReplicas(video); err != nil {
+		return err
+	}
+	if OnRemove != nil {
+		OnRemove(video)
+	}
+	log.Printf("Removed %s from this node", video)
+	return os.RemoveAll(dest + video)
+}
+
+/*
+* Deletes the videos with frames (or backup frames) on this node that were unpublished after the frames were stored,
+* e.g. while this node was offline. deletedAt returns when a video was unpublished, the zero time if it was not.
+*/
+func RemoveUnpublished(deletedAt func(video string) time.Time) error {
+	for frames == nil {
+		// the store is opened by Start
+		time.Sleep(100 * time.Millisecond)
+	}
+	names, err := objects.Manifests()
+	if err != nil {
+		return err
+	}
+	videos := make(map[string]bool)
+	for _, name := range names {
+		videos[strings.TrimPrefix(name, replicaPrefix)] = true
+	}
+	for video := range videos {
+		at := deletedAt(video)
+		if at.IsZero() {
+			continue
+		}
+		// frames stored since belong to a video published again under the same name
+		if info, err := os.Stat(dest + video); err == nil && info.ModTime().After(at) {
+			continue
+		}
+		if err := RemoveVideo(video); err != nil {
+			log.Printf("Unable to remove unpublished %s: %v", video, err)
+		}
+	}
+	return nil
+}
+
+/*
+* Deletes the backup frames of a video kept by StoreReplica
+*/
+func RemoveReplicas(video string) error {
+	manifest, err := objects.LoadManifest(replicaPrefix + video)
+	if err == castore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for number := range manifest.Segments {
+		frames.Release(replicaPrefix + video, number)
+	}
+	return objects.RemoveManifest(replicaPrefix + video)
+}
+
+/*
+* Reclaims the space of deleted videos: frame content no manifest refers to and frame folders of videos without
+* a manifest. Anything written within grace is kept, since it may belong to a video that is still being stored.
+*/
+func CollectGarbage(grace time.Duration) (int64, error) {
+	_, freed, err := objects.Collect(grace)
+	if err != nil {
+		return 0, err
+	}
+	folders, err := ioutil.ReadDir(dest)
+	if err != nil {
+		return freed, err
+	}
+	cutoff := time.Now().Add(-grace)
+	for _, folder := range folders {
+		name := folder.Name()
+		if !folder.IsDir() || strings.HasPrefix(name, ".") || name == "source" || folder.ModTime().After(cutoff) {
+			continue
+		}
+		if _, err := objects.LoadManifest(name); err != castore.ErrNotFound {
+			continue
+		}
+		if err := os.RemoveAll(dest + name); err != nil {
+			return freed, err
+		}
+		log.Printf("Removed orphaned frame folder %s", name)
+	}
+	return freed, nil
+}
+
+/*
+* Periodically reclaims the space of deleted videos
+*/
+func collectGarbage() {
+	for {
+		time.Sleep(consts.GCInterval)
+		freed, err := CollectGarbage(consts.GCGrace)
+		if err != nil {
+			log.Printf("Garbage collection failed: %v", err)
+		} else if freed > 0 {
+			log.Printf("Garbage collection reclaimed %d bytes", freed)
+		}
+	}
+}
+
+/*
+* Accounts for a frame in the quota. length is 0 when the content is already stored.
+*/
+func admitFrame(video string, frame string, hash string, length int, class quota.Class) error {
+	number, err := strconv.Atoi(strings.TrimSuffix(frame, ".png"))
+	if err != nil {
+		return err
+	}
+	size := objects.StoredSize(length)
+	if stored, err := objects.Size(hash); err == nil {
+		size = stored
+	}
+	return frames.Admit(quota.Item{File: video, Segment: number, Hash: hash, Size: size, Class: class})
+}
+
+/*
+* Removes a backup frame evicted by the quota
+*/
+func evictFrame(item quota.Item, unreferenced bool) {
+	log.Printf("Evicting backup frame %d of %s to free space", item.Segment, strings.TrimPrefix(item.File, replicaPrefix))
+	objects.RemoveFromManifest(item.File, item.Segment)
+	if unreferenced {
+		objects.Remove(item.Hash)
+	}
+}
+
+/*
+* Rebuilds the usage of the quota from the manifests of the stored frames
+*/
+func loadQuota() {
+	frames = quota.New(quotaLimit, quotaPolicy, evictFrame)
+	names, err := objects.Manifests()
+	checkError(err)
+	for _, name := range names {
+		manifest, err := objects.LoadManifest(name)
+		if err != nil {
+			continue
+		}
+		class := quota.Primary
+		if strings.HasPrefix(name, replicaPrefix) {
+			class = quota.Cached
+		}
+		for number, hash := range manifest.Segments {
+			size, err := objects.Size(hash)
+			if err != nil {
+				continue
+			}
+			frames.Load(quota.Item{File: name, Segment: number, Hash: hash, Size: size, Class: class})
+		}
+	}
+}
+
+/*
+* Records a stored frame in the manifest of its video and links it into the video's frame folder, where ffmpeg
+* reads the frames from
+*/
+func storeFrame(video string, frame string, totalFrames int64, hash string) error {
+	number, err := strconv.Atoi(strings.TrimSuffix(frame, ".png"))
+	if err != nil {
+		return err
+	}
+	if err = objects.AddToManifest(video, number, totalFrames, hash); err != nil {
+		return err
+	}
+	return objects.Link(hash, dest + video + "/" + frame)
+}
+
+/*
+* Manifests published to this node are kept as files named after their escaped key
+*/
+func manifestPath(key string) string {
+	return dest + ".manifests/" + strings.NewReplacer("%", "%25", "/", "%2F").Replace(key)
+}
+
+/*
+* Returns the hashes of the frames extracted by GetFrames, in frame order
+*/
+func FrameHashes(video string, totalFrames int64) ([]string, error) {
+	manifest, err := objects.LoadManifest(video)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, totalFrames)
+	for i := 1; i <= int(totalFrames); i++ {
+		hash, ok := manifest.Segments[i]
+		if !ok {
+			return nil, errors.New("frame " + strconv.Itoa(i) + " of " + video + " is not stored")
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+/*
+* Verifies every frame of a video against the hash in its manifest before it is streamed. Corrupt frames are
+* unlinked so that they are sent again.
+*/
+func verifyFrames(video string) error {
+	manifest, err := objects.LoadManifest(video)
+	if err == castore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for number, hash := range manifest.Segments {
+		if _, err := objects.Get(hash); err != nil {
+			frame := fmt.Sprintf("%05d.png", number)
+			os.Remove(dest + video + "/" + frame)
+			return errors.New("frame " + video + "/" + frame + " unavailable: " + err.Error())
+		}
+	}
+	return nil
+}
+
 /* 
 * Set up the listener for RPC requests, serve the connections when required.
 */
@@ -108,7 +604,7 @@ func launchRPCService(addr string) {
   rpcListener.Close()
 }
 
-func GetFrames(filename string) int64 {
+func GetFrames(filename string) (int64, error) {
 	// ffmpeg -i sample.mp4 -r 100 -f image2 output/%05d.png
 	fnArr := strings.Split(filename, ".")
 	// destPath := "FFMPEG/NodesData/" + nodeName + "/output/%05d.png"
@@ -119,7 +615,9 @@ func GetFrames(filename string) int64 {
 	cmd := exec.Command("ffmpeg", "-i", sourcePath, "-r", "100", "-f",
 		"image2", destPath)
 	err := cmd.Start()
-	checkError(err)
+	if err != nil {
+		return 0, err
+	}
 	log.Printf("Waiting for video to finish processing into individual frames...")
 	err = cmd.Wait()
 	log.Printf("Frame processing finished with error: %v", err)
@@ -127,8 +625,27 @@ func GetFrames(filename string) int64 {
 	path := "FFMPEG/NodesData/" + nodeName + "/" + fnArr[0] + "/"
 	files,_ := ioutil.ReadDir(path)
 	numFrames := int64(len(files))
+	if numFrames == 0 {
+		return 0, errors.New("no frames extracted from " + filename)
+	}
+
+	// move the extracted frames into the object store, identical frames are then stored once. They only count
+	// against the quota once they are kept (see KeepFrames)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(path + file.Name())
+		if err != nil {
+			return 0, err
+		}
+		hash, err := objects.Put(data)
+		if err != nil {
+			return 0, err
+		}
+		if err = storeFrame(fnArr[0], file.Name(), numFrames, hash); err != nil {
+			return 0, err
+		}
+	}
 
-    return numFrames-1
+    return numFrames-1, nil
 }
 
 func Start(rpcServerAddr string, name string) {
@@ -138,6 +655,13 @@ func Start(rpcServerAddr string, name string) {
 	//createDirectories() TODO
 
 	dest = "FFMPEG/NodesData/" + nodeName + "/"
+	var err error
+	objects, err = castore.Open(dest + ".store")
+	checkError(err)
+	loadQuota()
+	go collectGarbage()
+	err = os.MkdirAll(dest + ".manifests", 0755)
+	checkError(err)
 	//getFrames(dest)
 	log.Println("Launching rpc service to serve stream requests...")
 	launchRPCService(nodeAddr)
@@ -0,0 +1,200 @@
+package transfer
+
+import (
+	"../../consts"
+	"../colorprint"
+	"../utility"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// CHOKING
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Decides which peers this node uploads segments to (tit-for-tat). Every consts.ChokeInterval the interested peers
+// (the ones that asked for segments) that uploaded to this node the fastest are unchoked, one slot less than
+// consts.UploadSlots. The last slot goes to a random other interested peer for consts.OptimisticRounds intervals
+// (optimistic unchoke), so that new peers get segments to upload in return. Unchoked peers are always served.
+// Choked peers are served only while fewer than consts.UploadSlots uploads are running. Peers are told apart by
+// the address their requests name, or else by the host they come from (see requester).
+type choker struct {
+	received   map[string]int64 // bytes received from each peer since the last decision
+	interested map[string]bool  // peers that asked for segments since the last decision
+	unchoked   map[string]bool
+	optimistic string
+	rounds     int // decisions so far
+	uploads    int // segments being uploaded
+	lock       sync.Mutex
+}
+
+var chokes = &choker{
+	received:   make(map[string]int64),
+	interested: make(map[string]bool),
+	unchoked:   make(map[string]bool),
+}
+
+// Records the bytes of a segment received from a peer
+func (c *choker) receivedFrom(addr string, bytes int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.received[addr] += int64(bytes)
+}
+
+// Records a request of a peer and returns true if it is served now, counting it as a running upload until
+// release is called
+func (c *choker) admit(addr string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if addr != "" {
+		c.interested[addr] = true
+	}
+	if !c.unchoked[addr] && c.uploads >= consts.UploadSlots {
+		return false
+	}
+	c.uploads++
+	return true
+}
+
+// Ends an upload admitted before
+func (c *choker) release() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.uploads--
+}
+
+// Unchokes the interested peers that uploaded the most to this node since the last decision, and picks a new
+// optimistic unchoke every consts.OptimisticRounds decisions
+func (c *choker) rechoke() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var peers []string
+	for addr := range c.interested {
+		peers = append(peers, addr)
+	}
+	// ties, e.g. peers that never uploaded anything, are broken at random
+	for i := range peers {
+		j := rand.Intn(i + 1)
+		peers[i], peers[j] = peers[j], peers[i]
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		return c.received[peers[i]] > c.received[peers[j]]
+	})
+	unchoked := make(map[string]bool)
+	for _, addr := range peers {
+		if len(unchoked) == consts.UploadSlots-1 {
+			break
+		}
+		unchoked[addr] = true
+	}
+	if c.rounds%consts.OptimisticRounds == 0 || !c.interested[c.optimistic] || unchoked[c.optimistic] {
+		c.optimistic = ""
+		for _, addr := range peers {
+			// peers is shuffled among equal rates, the first choked one is random enough
+			if !unchoked[addr] {
+				c.optimistic = addr
+				break
+			}
+		}
+	}
+	if c.optimistic != "" {
+		unchoked[c.optimistic] = true
+	}
+	for addr := range unchoked {
+		if !c.unchoked[addr] {
+			colorprint.Info("Unchoking " + addr)
+		}
+	}
+	c.unchoked = unchoked
+	c.received = make(map[string]int64)
+	c.interested = make(map[string]bool)
+	c.rounds++
+}
+
+// Takes the choke decisions every consts.ChokeInterval, for as long as the node runs
+func runChoker() {
+	for {
+		time.Sleep(consts.ChokeInterval)
+		chokes.rechoke()
+	}
+}
+
+// Returns the peer a request is accounted to. Requests name the file transfer address of their node, which is
+// trusted only if its host is the host the connection comes from, so that a peer can't pass for another one.
+// Requests that don't match are accounted to the host of the connection.
+func requester(from string, remote string) string {
+	if remote == "" {
+		return from
+	}
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return remote
+	}
+	if claimed, _, err := net.SplitHostPort(from); err == nil && sameHost(claimed, host) {
+		return from
+	}
+	return host
+}
+
+// Returns true if host (an ip, a name or "" for this machine) is the address ip
+func sameHost(host string, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	if host == "" || host == "localhost" {
+		return addr.IsLoopback()
+	}
+	if parsed := net.ParseIP(host); parsed != nil {
+		return parsed.Equal(addr) || (parsed.IsUnspecified() && addr.IsLoopback())
+	}
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if a.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if a holder refused a request because it chokes this node
+func isChoked(err error) bool {
+	return err != nil && err.Error() == "Choked."
+}
+
+// Runs a request to holder, and runs it again while the holder refuses it as choked: after consts.ChokeBackoff,
+// doubling up to consts.ChokeInterval, at most consts.ChokeRetries times. Used outside swarms, which ask other
+// holders in the meantime.
+func retryChoked(holder string, request func() error) error {
+	wait := consts.ChokeBackoff
+	err := request()
+	for retry := 0; retry < consts.ChokeRetries && isChoked(err); retry++ {
+		colorprint.Info(holder + " choked this node, asking again in " + wait.String())
+		time.Sleep(wait)
+		if wait *= 2; wait > consts.ChokeInterval {
+			wait = consts.ChokeInterval
+		}
+		err = request()
+	}
+	return err
+}
+
+// Gets a segment from holder like fetchSegment, asking again while the holder chokes this node (see retryChoked)
+func fetchUnchoked(holder string, nodeService *rpc.Client, segReq *utility.ReqStruct) (utility.VidSegment, error) {
+	var vidSeg utility.VidSegment
+	err := retryChoked(holder, func() error {
+		var err error
+		vidSeg, err = fetchSegment(nodeService, segReq)
+		return err
+	})
+	return vidSeg, err
+}
@@ -0,0 +1,260 @@
+package transfer
+
+import (
+	"../../consts"
+	"../castore"
+	"../colorprint"
+	"../erasure"
+	"../filemgmt"
+	"../manifest"
+	"../utility"
+	"errors"
+	"net/rpc"
+	"strconv"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// ERASURE CODED SEGMENTS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Returns the file transfer addresses of count distinct nodes for the shards of a group, shard i is placed on the
+// i-th node. Fewer addresses are returned when there are fewer nodes. Unreachable nodes are "". Set by main
+// to the lookup of the overlay in use.
+var ShardHolders func(key string, count int) []string
+
+// This method encodes a group of segments of a file stored on this node into its data and parity shards. The
+// shards are returned as segments of manifest.ShardFile with their id and hash set. The padding of the last group
+// is returned as an empty segment, it is never stored.
+func EncodeGroup(m manifest.Manifest, group int) ([]utility.VidSegment, error) {
+	codec, err := erasure.New(m.DataShards, m.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	size := m.ShardSize(group)
+	shards := make([][]byte, m.DataShards+m.ParityShards)
+	for index := 0; index < m.DataShards; index++ {
+		shards[index] = make([]byte, size)
+		if id := m.SegmentOf(group, index); id > 0 {
+			vidSeg, err := filemgmt.ReadSegment(m.Name, id)
+			if err != nil {
+				return nil, err
+			}
+			copy(shards[index], vidSeg.Body)
+		}
+	}
+	if err = codec.Encode(shards); err != nil {
+		return nil, err
+	}
+	vidSegs := make([]utility.VidSegment, len(shards))
+	for index, shard := range shards {
+		vidSegs[index].Id = m.ShardId(group, index)
+		if index < m.DataShards && m.SegmentOf(group, index) == 0 {
+			continue
+		}
+		vidSegs[index].Body = shard
+		vidSegs[index].Hash = castore.Hash(shard)
+	}
+	return vidSegs, nil
+}
+
+// This method returns a segment of an erasure coded file. The segment's data shard holds the segment as it is, so
+// nothing has to be decoded while its holder is up. Otherwise any DataShards shards of the group are fetched from
+// the nodes holding them and the segment is reconstructed. The segment is kept in the local cache.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// vidSeg, err := transfer.GetCodedSegment(m, 3)
+func GetCodedSegment(m manifest.Manifest, segId int) (utility.VidSegment, error) {
+	vidSeg := utility.VidSegment{Id: segId, Hash: m.Hash(segId)}
+	if local, err := filemgmt.ReadSegment(m.Name, segId); err == nil && local.Hash == vidSeg.Hash {
+		return local, nil
+	}
+	group, index := m.GroupOf(segId)
+	holders := ShardHolders(manifest.ShardKey(m.Name, group), m.ShardNodes())
+	shard, err := fetchShard(m, group, index, holders)
+	if err != nil {
+		colorprint.Alert("Shard of segment " + strconv.Itoa(segId) + " unavailable (" + err.Error() + "), reconstructing it")
+		shards, rerr := reconstructGroup(m, group, holders, index)
+		if rerr != nil {
+			return vidSeg, rerr
+		}
+		shard = shards[index]
+	}
+	vidSeg.Body = shard[:m.Lengths[segId-1]]
+	if !filemgmt.VerifySegment(vidSeg) {
+		return vidSeg, errors.New("Segment checksum mismatch.")
+	}
+	if err = filemgmt.CacheVidSegment(m.Name, m.SegNums, vidSeg); err != nil {
+		colorprint.Warning("Segment " + strconv.Itoa(segId) + " of " + m.Name + " not cached: " + err.Error())
+	}
+	return vidSeg, nil
+}
+
+// This method restores the shards of the groups this node is the first reachable holder of, so that every group
+// is repaired by one node. Missing or corrupt shards are rebuilt from the others and sent to their holder again.
+// Groups that can't be rebuilt are skipped. Returns the number of shards restored.
+func RepairShards(m manifest.Manifest) (int, error) {
+	restored := 0
+	count := m.DataShards + m.ParityShards
+	for group := 0; group < m.Groups(); group++ {
+		holders := ShardHolders(manifest.ShardKey(m.Name, group), m.ShardNodes())
+		if firstHolder(holders) != rpcAddress {
+			continue
+		}
+		var missing []int
+		for index := 0; index < count; index++ {
+			holder := shardHolder(holders, index)
+			if m.ShardHash(group, index) == "" || holder == "" {
+				continue
+			}
+			// shards are only sent to holders that answer, since sending waits for the holder
+			if hash, err := shardHashOn(holder, m, group, index); err == nil && hash != m.ShardHash(group, index) {
+				missing = append(missing, index)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		shards, err := reconstructGroup(m, group, holders, -1)
+		if err != nil {
+			colorprint.Alert("Unable to repair group " + strconv.Itoa(group) + " of " + m.Name + ": " + err.Error())
+			continue
+		}
+		for _, index := range missing {
+			holder := shardHolder(holders, index)
+			vidSeg := utility.VidSegment{Id: m.ShardId(group, index), Body: shards[index], Hash: m.ShardHash(group, index)}
+			if holder == rpcAddress {
+				err = filemgmt.AddVidSegIntoFileSys(manifest.ShardFile(m.Name), int64(len(m.ShardHashes)), vidSeg, &localFileSys)
+			} else {
+				err = SendVideoSegment(manifest.ShardFile(m.Name), holder, len(m.ShardHashes), vidSeg)
+			}
+			if err != nil {
+				colorprint.Alert("Unable to restore shard " + strconv.Itoa(vidSeg.Id) + " of " + m.Name + " on " + holder + ": " + err.Error())
+				continue
+			}
+			restored++
+		}
+	}
+	return restored, nil
+}
+
+// This method fetches shards of a group until DataShards of them are present and reconstructs the others. The
+// shard at skip (-1 for none) is known to be unavailable and not asked for again.
+func reconstructGroup(m manifest.Manifest, group int, holders []string, skip int) ([][]byte, error) {
+	codec, err := erasure.New(m.DataShards, m.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	shards := make([][]byte, m.DataShards+m.ParityShards)
+	present := 0
+	for index := range shards {
+		if present == m.DataShards {
+			break
+		}
+		if index == skip {
+			continue
+		}
+		shard, err := fetchShard(m, group, index, holders)
+		if err != nil {
+			colorprint.Warning("Shard " + strconv.Itoa(m.ShardId(group, index)) + " of " + m.Name + " unavailable: " + err.Error())
+			continue
+		}
+		shards[index] = shard
+		present++
+	}
+	if present < m.DataShards {
+		return nil, errors.New("Group " + strconv.Itoa(group) + " of " + m.Name + " has " + strconv.Itoa(present) +
+			" of the " + strconv.Itoa(m.DataShards) + " shards needed: " + erasure.ErrTooFewShards.Error())
+	}
+	if err = codec.Reconstruct(shards); err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// This method gets a shard from the local store or the nodes of holders and verifies it against the published hash.
+// The node at the shard's index is asked first, then the others, which hold it once nodes joined or left since it
+// was placed. The padding of the last group is all zeros and never fetched.
+func fetchShard(m manifest.Manifest, group int, index int, holders []string) ([]byte, error) {
+	hash := m.ShardHash(group, index)
+	if hash == "" {
+		return make([]byte, m.ShardSize(group)), nil
+	}
+	if body, err := filemgmt.Objects().Get(hash); err == nil {
+		return body, nil
+	}
+	candidates := []string{shardHolder(holders, index)}
+	for _, holder := range holders {
+		if holder != candidates[0] {
+			candidates = append(candidates, holder)
+		}
+	}
+	err := errors.New("Shard holder unreachable.")
+	for _, holder := range candidates {
+		if holder == "" || holder == rpcAddress {
+			continue
+		}
+		var body []byte
+		if body, err = fetchShardFrom(holder, m, group, index); err == nil {
+			return body, nil
+		}
+	}
+	return nil, err
+}
+
+// This method gets a shard from a node and verifies it against the published hash
+func fetchShardFrom(holder string, m manifest.Manifest, group int, index int) ([]byte, error) {
+	nodeService, err := rpc.Dial(consts.TransProtocol, holder)
+	if err != nil {
+		return nil, err
+	}
+	defer nodeService.Close()
+	segReq := &utility.ReqStruct{Filename: manifest.ShardFile(m.Name), SegmentId: m.ShardId(group, index), From: rpcAddress}
+	var vidSeg utility.VidSegment
+	err = retryChoked(holder, func() error {
+		return nodeService.Call("Service.GetFileSegment", segReq, &vidSeg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if castore.Hash(vidSeg.Body) != m.ShardHash(group, index) {
+		return nil, errors.New("Segment checksum mismatch.")
+	}
+	return vidSeg.Body, nil
+}
+
+// This method asks a holder for the hash of the shard it stores, "" if it has none
+func shardHashOn(holder string, m manifest.Manifest, group int, index int) (string, error) {
+	if holder == rpcAddress {
+		return filemgmt.SegmentHash(manifest.ShardFile(m.Name), m.ShardId(group, index)), nil
+	}
+	nodeService, err := rpc.Dial(consts.TransProtocol, holder)
+	if err != nil {
+		return "", err
+	}
+	defer nodeService.Close()
+	var hash string
+	segReq := &utility.ReqStruct{Filename: manifest.ShardFile(m.Name), SegmentId: m.ShardId(group, index)}
+	err = nodeService.Call("Service.GetSegmentHash", segReq, &hash)
+	return hash, err
+}
+
+// Shards past the end of holders are left unplaced rather than put next to another shard of their group. They are
+// restored once enough nodes joined.
+func shardHolder(holders []string, index int) string {
+	if index >= len(holders) {
+		return ""
+	}
+	return holders[index]
+}
+
+func firstHolder(holders []string) string {
+	for _, holder := range holders {
+		if holder != "" {
+			return holder
+		}
+	}
+	return ""
+}
@@ -0,0 +1,562 @@
+package transfer
+
+import (
+	"../../consts"
+	"../catalog"
+	"../colorprint"
+	"../utility"
+	"errors"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// MULTI-SOURCE DOWNLOADS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Order Swarm assigns segments in
+type Order int
+
+const (
+	InOrder     Order = iota // in the order given, for streaming
+	RarestFirst              // segments held by the fewest peers first, so they are saved before their holders leave
+)
+
+// A node holding segments of a file, as found by FindPeers
+type Peer struct {
+	Addr        string
+	Segs        catalog.Bitmap // segments the node holds
+	Downloading bool           // listed as downloading the file, it announces the segments it stores
+}
+
+// State of a peer during a swarm
+type swarmPeer struct {
+	Peer
+	failures int          // failed requests since the last segment the peer delivered
+	rejected map[int]bool // segments the peer sent a corrupt copy of
+	workers  int          // workers requesting segments from the peer
+	choked   time.Time    // the peer refused a request as choked, asked again after this
+}
+
+// Segments of a file being fetched by Swarm
+type swarm struct {
+	fname    string
+	order    Order
+	pending  []int                   // segments not done yet, in order of priority
+	holders  map[int]int             // peers holding each segment, without dropped peers and corrupt copies
+	fetching map[int]map[string]bool // peers each segment is requested from
+	peers    map[string]*swarmPeer
+	workers  int       // running workers, the swarm ends with the last one
+	finding  bool      // peers are still being looked up, see Swarm
+	stored   []int     // segments delivered since the last HAVE announcement
+	lastHave time.Time // last announcement of a downloading peer, or the start of the swarm
+	ended    bool
+	deliver  func(utility.VidSegment, string) error
+	err      error      // error of deliver, stops the swarm
+	changed  *sync.Cond // signalled whenever a request or a worker ends
+	lock     sync.Mutex
+}
+
+// Swarms running on this node by file. HAVE announcements for the file are passed to them.
+var swarms = make(map[string]map[*swarm]bool)
+
+// Nodes that announced they are downloading a file by file, with the time of their last announcement
+var downloaders = make(map[string]map[string]time.Time)
+var swarmsLock sync.Mutex
+
+// This method responds to a HAVE announcement of a node downloading a file. The node is listed to the nodes asking
+// this one for the file (see LocalFileAvailability), and the swarms of this node fetching the file learn of the
+// announced segments, so they can request them from the node without polling it.
+func (service *Service) Have(msg *utility.HaveMsg, ok *bool) error {
+	swarmsLock.Lock()
+	if downloaders[msg.Filename] == nil {
+		downloaders[msg.Filename] = make(map[string]time.Time)
+	}
+	downloaders[msg.Filename][msg.From] = time.Now()
+	var running []*swarm
+	for s := range swarms[msg.Filename] {
+		running = append(running, s)
+	}
+	swarmsLock.Unlock()
+	var segs catalog.Bitmap
+	for _, id := range msg.Ids {
+		segs = segs.Set(int64(id))
+	}
+	for _, s := range running {
+		s.have(msg.From, segs)
+	}
+	*ok = true
+	return nil
+}
+
+// This method asks every candidate node which segments of a file it holds and returns the nodes holding any. The
+// nodes the candidates list as downloading the file are asked too and are returned even if they hold nothing yet,
+// so that they learn of this node from its HAVE announcements. Nodes are asked in parallel, the ones that can't be
+// reached are left out.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// peers := transfer.FindPeers("sample.mp4", []string{":3000", ":3001"})
+func FindPeers(fname string, candidates []string) []Peer {
+	var peers []Peer
+	asked := map[string]bool{rpcAddress: true}
+	listed := make(map[string]bool)
+	for len(candidates) > 0 {
+		var next []string
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		for _, addr := range candidates {
+			if addr == "" || asked[addr] {
+				continue
+			}
+			asked[addr] = true
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				segs, downloading, err := segmentsOn(addr, fname)
+				if err != nil {
+					return
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				if segs.Count() > 0 || listed[addr] {
+					peers = append(peers, Peer{Addr: addr, Segs: segs, Downloading: listed[addr]})
+				}
+				next = append(next, downloading...)
+			}(addr)
+		}
+		wg.Wait()
+		for _, addr := range next {
+			listed[addr] = true
+		}
+		candidates = next
+	}
+	return peers
+}
+
+// This method fetches segments ids of a file from peers in parallel and passes every verified segment to deliver,
+// with the address of the peer it came from. Every peer gets up to consts.SwarmInFlight requests at a time, for the
+// segments it holds that nobody is fetching yet: the first ones in ids, or with RarestFirst the ones the fewest
+// peers hold (the first ones in ids among equally rare segments). A request that fails or takes longer than
+// consts.SwarmTimeout leaves its segment to the other holders, and a peer failing consts.SwarmMaxFailures requests
+// in a row is dropped. Once nothing is left to assign, idle peers request the segments still in flight a second
+// time, so a slow peer does not hold up the end of the download.
+// Every consts.HaveInterval the segments delivered since are announced to the peers (HAVE). Announcements of other
+// downloading peers add the segments they stored, and the peers themselves if they are new to the swarm. While
+// downloading peers are in the swarm, segments nobody holds are waited for until no peer announced anything for
+// consts.SwarmTimeout. Peers found while the swarm runs are sent on more, which may be nil. Segments nobody holds are
+// waited for until more is closed.
+// Returns the error of deliver if it fails, which stops the swarm, or an error if some segments could not be
+// fetched from any peer.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// peers := transfer.FindPeers("sample.mp4", holders)
+// err := transfer.Swarm("sample.mp4", []int{1, 2, 3}, peers, nil, transfer.InOrder, func(vidSeg utility.VidSegment, holder string) error { ... })
+func Swarm(fname string, ids []int, peers []Peer, more <-chan []Peer, order Order, deliver func(utility.VidSegment, string) error) error {
+	s := &swarm{
+		fname:    fname,
+		order:    order,
+		pending:  append([]int(nil), ids...),
+		holders:  make(map[int]int),
+		fetching: make(map[int]map[string]bool),
+		peers:    make(map[string]*swarmPeer),
+		deliver:  deliver,
+	}
+	s.changed = sync.NewCond(&s.lock)
+	swarmsLock.Lock()
+	if swarms[fname] == nil {
+		swarms[fname] = make(map[*swarm]bool)
+	}
+	swarms[fname][s] = true
+	swarmsLock.Unlock()
+
+	s.lock.Lock()
+	for _, peer := range peers {
+		s.addPeer(peer.Addr, peer.Segs)
+		s.peers[peer.Addr].Downloading = peer.Downloading
+	}
+	s.lastHave = time.Now()
+	if more != nil {
+		s.finding = true
+		go s.find(more)
+	}
+	go s.announce()
+	for s.workers > 0 || s.awaitingHave() || (s.finding && s.err == nil && len(s.pending) > 0) {
+		if s.workers == 0 {
+			time.AfterFunc(s.lastHave.Add(consts.SwarmTimeout).Sub(time.Now()), func() {
+				s.lock.Lock()
+				s.changed.Broadcast()
+				s.lock.Unlock()
+			})
+		}
+		s.changed.Wait()
+	}
+	s.ended = true
+	s.lock.Unlock()
+
+	swarmsLock.Lock()
+	delete(swarms[fname], s)
+	if len(swarms[fname]) == 0 {
+		delete(swarms, fname)
+	}
+	swarmsLock.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if len(s.pending) > 0 {
+		return errors.New(strconv.Itoa(len(s.pending)) + " segments of " + fname + " unavailable from every peer.")
+	}
+	return nil
+}
+
+// Adds a peer to the swarm, or segments to a peer already in it, and starts requesting segments from the peer if
+// it has any the swarm needs. Must hold the lock.
+func (s *swarm) addPeer(addr string, segs catalog.Bitmap) {
+	p, ok := s.peers[addr]
+	if !ok {
+		p = &swarmPeer{Peer: Peer{Addr: addr}, rejected: make(map[int]bool)}
+		s.peers[addr] = p
+	}
+	for _, id := range segs.IDs() {
+		if p.Segs.Has(id) {
+			continue
+		}
+		p.Segs = p.Segs.Set(id)
+		if p.failures < consts.SwarmMaxFailures {
+			s.holders[int(id)]++
+		}
+	}
+	if p.workers > 0 || p.failures >= consts.SwarmMaxFailures || !s.waiting(p) {
+		return
+	}
+	for i := 0; i < consts.SwarmInFlight; i++ {
+		p.workers++
+		s.workers++
+		go s.work(p)
+	}
+}
+
+// Adds the peers sent on more until it is closed
+func (s *swarm) find(more <-chan []Peer) {
+	for peers := range more {
+		s.lock.Lock()
+		for _, peer := range peers {
+			if s.ended {
+				break
+			}
+			if peer.Addr == rpcAddress {
+				continue
+			}
+			s.addPeer(peer.Addr, peer.Segs)
+			s.peers[peer.Addr].Downloading = s.peers[peer.Addr].Downloading || peer.Downloading
+		}
+		s.changed.Broadcast()
+		s.lock.Unlock()
+	}
+	s.lock.Lock()
+	s.finding = false
+	s.changed.Broadcast()
+	s.lock.Unlock()
+}
+
+// Records a HAVE announcement of a peer
+func (s *swarm) have(addr string, segs catalog.Bitmap) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ended || addr == rpcAddress {
+		return
+	}
+	s.addPeer(addr, segs)
+	s.peers[addr].Downloading = true
+	s.lastHave = time.Now()
+	s.changed.Broadcast()
+}
+
+// Returns true if segments are missing that downloading peers may still announce. Must hold the lock.
+func (s *swarm) awaitingHave() bool {
+	if s.err != nil || len(s.pending) == 0 || time.Since(s.lastHave) >= consts.SwarmTimeout {
+		return false
+	}
+	for _, p := range s.peers {
+		if p.Downloading && p.failures < consts.SwarmMaxFailures {
+			return true
+		}
+	}
+	return false
+}
+
+// Announces the delivered segments to the peers every consts.HaveInterval until the swarm ends. The first
+// announcement has no segments, it makes the peers list this node as downloading the file.
+func (s *swarm) announce() {
+	for first := true; ; first = false {
+		s.lock.Lock()
+		ended := s.ended
+		ids := s.stored
+		s.stored = nil
+		var addrs []string
+		for addr := range s.peers {
+			addrs = append(addrs, addr)
+		}
+		s.lock.Unlock()
+		if first || len(ids) > 0 {
+			msg := &utility.HaveMsg{Filename: s.fname, From: rpcAddress, Ids: ids}
+			for _, addr := range addrs {
+				go sendHave(addr, msg)
+			}
+		}
+		if ended {
+			return
+		}
+		time.Sleep(consts.HaveInterval)
+	}
+}
+
+// Requests segments from a peer over a connection of its own until the swarm has nothing left for it
+func (s *swarm) work(p *swarmPeer) {
+	var nodeService *rpc.Client
+	defer func() {
+		if nodeService != nil {
+			nodeService.Close()
+		}
+		s.lock.Lock()
+		p.workers--
+		s.workers--
+		s.changed.Broadcast()
+		s.lock.Unlock()
+	}()
+	for {
+		id := s.next(p)
+		if id == 0 {
+			return
+		}
+		var err error
+		if nodeService == nil {
+			nodeService, err = rpc.Dial(consts.TransProtocol, p.Addr)
+			if err != nil {
+				nodeService = nil
+				s.failed(p, id, err)
+				continue
+			}
+		}
+		vidSeg, err := fetchWithin(nodeService, &utility.ReqStruct{Filename: s.fname, SegmentId: id}, consts.SwarmTimeout)
+		if err != nil {
+			// a late reply must not be taken for the next request
+			nodeService.Close()
+			nodeService = nil
+			s.failed(p, id, err)
+			continue
+		}
+		chokes.receivedFrom(p.Addr, len(vidSeg.Body))
+		if !s.done(p, vidSeg) {
+			return
+		}
+	}
+}
+
+// Picks the next segment for a peer and marks it as requested, waiting while the segments the peer could fetch are
+// in flight elsewhere. Returns 0 once there is nothing left for the peer.
+func (s *swarm) next(p *swarmPeer) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for {
+		if s.err != nil || len(s.pending) == 0 || p.failures >= consts.SwarmMaxFailures {
+			return 0
+		}
+		if time.Now().Before(p.choked) {
+			if !s.waiting(p) {
+				return 0
+			}
+			s.changed.Wait()
+			continue
+		}
+		candidate, duplicate := 0, 0
+		for _, id := range s.pending {
+			if !p.Segs.Has(int64(id)) || p.rejected[id] || s.fetching[id][p.Addr] {
+				continue
+			}
+			if len(s.fetching[id]) == 0 {
+				if s.order == InOrder {
+					candidate = id
+					break
+				}
+				if candidate == 0 || s.holders[id] < s.holders[candidate] {
+					candidate = id
+				}
+				continue
+			}
+			if duplicate == 0 && len(s.fetching[id]) == 1 {
+				duplicate = id
+			}
+		}
+		if candidate == 0 {
+			candidate = duplicate
+		}
+		if candidate != 0 {
+			if s.fetching[candidate] == nil {
+				s.fetching[candidate] = make(map[string]bool)
+			}
+			s.fetching[candidate][p.Addr] = true
+			return candidate
+		}
+		if !s.waiting(p) {
+			return 0
+		}
+		s.changed.Wait()
+	}
+}
+
+// Returns true if segments the peer could still fetch are in flight, they come back to it if their requests fail.
+// Must hold the lock.
+func (s *swarm) waiting(p *swarmPeer) bool {
+	for _, id := range s.pending {
+		if p.Segs.Has(int64(id)) && !p.rejected[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// Records a failed request, the segment is left to the other holders of it
+func (s *swarm) failed(p *swarmPeer, id int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.fetching[id], p.Addr)
+	if isChoked(err) {
+		// not a failure, the peer uploads to others for now
+		if !time.Now().Before(p.choked) {
+			colorprint.Info(p.Addr + " choked the download of " + s.fname)
+			p.choked = time.Now().Add(consts.ChokeInterval)
+			time.AfterFunc(consts.ChokeInterval, func() {
+				s.lock.Lock()
+				s.changed.Broadcast()
+				s.lock.Unlock()
+			})
+		}
+		s.changed.Broadcast()
+		return
+	}
+	p.failures++
+	if (err.Error() == "Segment checksum mismatch." || err.Error() == "Segment corrupt.") && !p.rejected[id] {
+		p.rejected[id] = true
+		s.holders[id]--
+	}
+	colorprint.Alert("Segment " + strconv.Itoa(id) + " from " + p.Addr + " failed: " + err.Error())
+	if p.failures == consts.SwarmMaxFailures {
+		colorprint.Warning("Dropping " + p.Addr + " from the download of " + s.fname)
+		for _, id := range p.Segs.IDs() {
+			if !p.rejected[int(id)] {
+				s.holders[int(id)]--
+			}
+		}
+	}
+	s.changed.Broadcast()
+}
+
+// Hands a fetched segment to deliver unless another peer was faster. Returns false once the swarm stopped.
+func (s *swarm) done(p *swarmPeer, vidSeg utility.VidSegment) bool {
+	s.lock.Lock()
+	if p.failures < consts.SwarmMaxFailures {
+		// dropped peers stay dropped
+		p.failures = 0
+	}
+	if s.err != nil {
+		s.lock.Unlock()
+		return false
+	}
+	if _, ok := s.fetching[vidSeg.Id]; !ok {
+		// duplicate request, delivered by another peer
+		s.lock.Unlock()
+		return true
+	}
+	delete(s.fetching, vidSeg.Id)
+	for i, id := range s.pending {
+		if id == vidSeg.Id {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			break
+		}
+	}
+	s.lock.Unlock()
+
+	err := s.deliver(vidSeg, p.Addr)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+	if err == nil {
+		s.stored = append(s.stored, vidSeg.Id)
+	}
+	s.changed.Broadcast()
+	return err == nil
+}
+
+// Returns the nodes that announced they are downloading a file within consts.DownloaderExpiry, forgetting the
+// others
+func downloadersOf(fname string) []string {
+	swarmsLock.Lock()
+	defer swarmsLock.Unlock()
+	var addrs []string
+	for addr, seen := range downloaders[fname] {
+		if time.Since(seen) > consts.DownloaderExpiry {
+			delete(downloaders[fname], addr)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(downloaders[fname]) == 0 {
+		delete(downloaders, fname)
+	}
+	return addrs
+}
+
+// This method sends a HAVE announcement to the node at nodeAdd. Nodes that can't be reached are skipped, they get
+// the next one.
+func sendHave(nodeAdd string, msg *utility.HaveMsg) {
+	nodeService, err := rpc.Dial(consts.TransProtocol, nodeAdd)
+	if err != nil {
+		return
+	}
+	defer nodeService.Close()
+	var ok bool
+	nodeService.Call("Service.Have", msg, &ok)
+}
+
+// This method gets a segment over an open rpc connection like fetchSegment, but gives up after timeout
+func fetchWithin(nodeService *rpc.Client, segReq *utility.ReqStruct, timeout time.Duration) (utility.VidSegment, error) {
+	type result struct {
+		vidSeg utility.VidSegment
+		err    error
+	}
+	reply := make(chan result, 1)
+	go func() {
+		vidSeg, err := fetchSegment(nodeService, segReq)
+		reply <- result{vidSeg, err}
+	}()
+	select {
+	case r := <-reply:
+		return r.vidSeg, r.err
+	case <-time.After(timeout):
+		return utility.VidSegment{}, errors.New("Segment request timed out.")
+	}
+}
+
+// This method asks the node at nodeAdd which segments of a file it holds and which nodes it knows are downloading
+// the file. A node without the file holds none.
+func segmentsOn(nodeAdd string, fname string) (catalog.Bitmap, []string, error) {
+	nodeService, err := rpc.Dial(consts.TransProtocol, nodeAdd)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer nodeService.Close()
+	var response utility.Response
+	err = nodeService.Call("Service.LocalFileAvailability", fname, &response)
+	if _, unavailable := err.(rpc.ServerError); unavailable {
+		return nil, nil, nil
+	}
+	return catalog.Bitmap(response.Segments), response.Downloaders, err
+}
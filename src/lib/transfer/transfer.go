@@ -2,6 +2,8 @@ package transfer
 
 import (
 	"../../consts"
+	"../castore"
+	"../catalog"
 	"../colorprint"
 	"../filemgmt"
 	"../player"
@@ -24,7 +26,10 @@ import (
 // =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
 
 // This type just holds an integer to use for registering the RPC Service
-type Service int
+// Serves the rpc calls of one connection
+type Service struct {
+	remote string // address the connection comes from, "" for calls made within this node
+}
 
 //type FTService int
 
@@ -42,12 +47,19 @@ type Progress struct {
 var localFileSys utility.FileSys
 var rpcAddress string
 var progLock *sync.RWMutex
-var filePaths utility.FilePath
 var nodeName string
 var prog Progress = Progress{
 	show: true,
 }
 
+// Returns the file transfer addresses of the nodes holding a segment. Set by main to the lookup of the overlay in
+// use, it is used to re-fetch segments that fail verification.
+var SegmentHolders func(filename string, segId int) []string
+
+// Returns the hash of a segment from the manifest its publisher stored in the DHT, or "" if unknown. Set by main
+// before streaming a file; segments are then verified against it instead of the holder's own hash.
+var PublishedHash func(filename string, segId int) string
+
 // =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
 // =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
 // INBOUND RPC CALL METHODS
@@ -76,26 +88,21 @@ var prog Progress = Progress{
 //
 func (service *Service) LocalFileAvailability(filename string, response *utility.Response) error {
 	colorprint.Debug("INBOUND RPC REQUEST: Checking utility.File Availability " + filename)
-	localFileSys.RLock()
-	video, ok := localFileSys.Files[filename]
+	entry, ok := filemgmt.Catalog().Get(filename)
 	if ok {
 		colorprint.Info("utility.File " + filename + " is available")
-		var segstr string = ""
-		for _, value := range video.SegsAvail {
-			segstr += strconv.FormatInt(value, 10) + " "
-		}
-		colorprint.Info("Locally available segments are " + segstr + "out of " + strconv.FormatInt(video.SegNums, 10))
+		colorprint.Info("Locally available segments are " + strconv.Itoa(entry.Segments.Count()) + " out of " + strconv.FormatInt(entry.SegNums, 10))
 		colorprint.Debug("INBOUND RPC REQUEST COMPLETED")
 		response.Avail = true
-		response.SegNums = video.SegNums
-		response.SegsAvail = video.SegsAvail
+		response.SegNums = entry.SegNums
+		response.Segments = entry.Segments
+		response.Downloaders = downloadersOf(filename)
 	} else {
 		colorprint.Alert("utility.File " + filename + " is unavailable")
 		response.Avail = false
 		return errors.New("utility.File " + filename + " is unavailable")
 
 	}
-	localFileSys.RUnlock()
 	return nil
 }
 
@@ -109,38 +116,64 @@ func (service *Service) LocalFileAvailability(filename string, response *utility
 
 // This method responds to an rpc Call for a particular segment of a file. It first looks up and checks if the video file is available. If the
 // file is available, it continues on to see if the segment is available. If the segment is available, it returns a response with the utility.VidSegment.
-// In case of unavailability, it will either return an error saying "utility.File Unavailable." or "Segment unavailable." depending on what was unavailable.
-// The method locks the local filesystem for all Reads and Writes during the process.
+// Segments are read from disk on request, hot segments are served from the in memory segment cache (see filemgmt.ReadSegment).
+// In case of unavailability, it returns an error saying "Segment unavailable.".
+// Requests of peers that are choked while all upload slots are busy are refused with "Choked." (see choke.go).
 func (service *Service) GetFileSegment(segReq *utility.ReqStruct, segment *utility.VidSegment) error {
+	if !chokes.admit(requester(segReq.From, service.remote)) {
+		return errors.New("Choked.")
+	}
+	defer chokes.release()
 	t := time.Now().String()
 	colorprint.Debug("------------------------------------------------------------------")
 	colorprint.Debug(">> " + t + "  <<")
 	colorprint.Debug("INBOUND RPC REQUEST: Sending video segment for " + segReq.Filename)
-	var seg utility.VidSegment
-	localFileSys.RLock()
-	outputstr := ""
-	video, ok := localFileSys.Files[segReq.Filename]
-	if ok {
-		outputstr += ("Node is asking for segment no. " + strconv.Itoa(segReq.SegmentId) + " for " + segReq.Filename)
-		_, ok := (video.Segments[1])
-		seg, ok = video.Segments[segReq.SegmentId]
-		fmt.Println(segReq.SegmentId)
-		if ok {
-			segment.Body = seg.Body
-		} else {
-			outputstr += ("\nSegment " + strconv.Itoa(segReq.SegmentId) + " unavailable for " + segReq.Filename)
-			return errors.New("Segment unavailable.")
-			localFileSys.Unlock()
-		}
-	} else {
-
-		return errors.New("utility.File unavailable.")
-		localFileSys.Unlock()
+	outputstr := ("Node is asking for segment no. " + strconv.Itoa(segReq.SegmentId) + " for " + segReq.Filename)
+	seg, err := filemgmt.ReadSegment(segReq.Filename, segReq.SegmentId)
+	if err == castore.ErrCorrupt {
+		outputstr += ("\nSegment " + strconv.Itoa(segReq.SegmentId) + " is corrupt for " + segReq.Filename)
+		colorprint.Alert(outputstr)
+		return errors.New("Segment corrupt.")
+	}
+	if err != nil {
+		outputstr += ("\nSegment " + strconv.Itoa(segReq.SegmentId) + " unavailable for " + segReq.Filename)
+		colorprint.Warning(outputstr)
+		return errors.New("Segment unavailable.")
 	}
+	if !filemgmt.VerifySegment(seg) {
+		outputstr += ("\nSegment " + strconv.Itoa(segReq.SegmentId) + " is corrupt for " + segReq.Filename)
+		colorprint.Alert(outputstr)
+		return errors.New("Segment corrupt.")
+	}
+	segment.Body = seg.Body
+	segment.Hash = seg.Hash
 	colorprint.Warning(outputstr)
 	return nil
 }
 
+// This method responds to an rpc Call for the content hash of a segment, so that the caller can skip the transfer of
+// content it already stores. Replies with an empty hash if the segment is not stored on this node.
+func (service *Service) GetSegmentHash(segReq *utility.ReqStruct, hash *string) error {
+	*hash = filemgmt.SegmentHash(segReq.Filename, segReq.SegmentId)
+	return nil
+}
+
+// This method responds to an rpc Call asking whether content with the given hash is stored on this node
+func (service *Service) HasObject(hash string, has *bool) error {
+	*has = filemgmt.Objects().Has(hash)
+	return nil
+}
+
+// This method answers to an rpc to delete an unpublished video from this node
+func (service *Service) DeleteFile(filename string, deleted *bool) error {
+	colorprint.Debug("INBOUND RPC REQUEST: Deleting " + filename)
+	if err := RemoveFile(filename); err != nil {
+		return err
+	}
+	*deleted = true
+	return nil
+}
+
 // This method answers to an rpc to save a video segment locally into the local filesystem
 func (service *Service) ReceiveFileSegment(seqStruct *utility.SeqStruct, segment *utility.VidSegment) error {
 	fmt.Println("SS")
@@ -151,7 +184,24 @@ func (service *Service) ReceiveFileSegment(seqStruct *utility.SeqStruct, segment
 	colorprint.Debug(">> " + t + "  <<")
 	colorprint.Debug("INBOUND RPC REQUEST: Receiving video segment for " + seqStruct.Filename)
 	// localFileSys.Lock()
-	filemgmt.AddVidSegIntoFileSys(filename, int64(seqStruct.SegNums), seqStruct.Segment, &localFileSys)
+	if len(seqStruct.Segment.Body) == 0 && seqStruct.Segment.Hash != "" {
+		// the sender left the body out since this node already stores the content
+		body, err := filemgmt.Objects().Get(seqStruct.Segment.Hash)
+		if err != nil {
+			return errors.New("Segment content " + seqStruct.Segment.Hash + " unavailable.")
+		}
+		seqStruct.Segment.Body = body
+	}
+	if !filemgmt.VerifySegment(seqStruct.Segment) {
+		colorprint.Alert("Segment " + strconv.Itoa(seqStruct.Segment.Id) + " for " + filename + " rejected: checksum mismatch")
+		return errors.New("Segment checksum mismatch.")
+	}
+	err := filemgmt.AddVidSegIntoFileSys(filename, int64(seqStruct.SegNums), seqStruct.Segment, &localFileSys)
+	if err != nil {
+		// the sender places the segment on another node
+		colorprint.Alert("Segment " + strconv.Itoa(seqStruct.Segment.Id) + " for " + filename + " refused: " + err.Error())
+		return errors.New("Storage quota exceeded on this node: " + err.Error())
+	}
 	outputstr += ("\nSegment " + strconv.Itoa(seqStruct.Segment.Id) + " received for " + filename)
 	colorprint.Warning(outputstr)
 	//localFileSys.Unlock()
@@ -190,7 +240,7 @@ func CheckFileAvailability(filename string, nodeadd string) (bool, int64, []int6
 	if response.Avail == true {
 		fmt.Println("utility.File:", filename, " is available")
 		segNums = response.SegNums
-		segsAvail = response.SegsAvail
+		segsAvail = catalog.Bitmap(response.Segments).IDs()
 		return true, segNums, segsAvail
 	} else {
 		fmt.Println("utility.File:", filename, " is not available on node["+""+"].")
@@ -209,10 +259,10 @@ func CheckFileAvailability(filename string, nodeadd string) (bool, int64, []int6
 // segNums := 100
 // vidMap := make(map[int]utility.VidSegment)
 // for i := 0; i < segNums; i++ {
-// 		vidMap[i] = transfer.GetVideoSegment("sample.mp4", 45, ":3000")
+// 		vidMap[i], err = transfer.GetVideoSegment("sample.mp4", 45, ":3000")
 // }
 //
-func GetVideoSegment(fname string, segNums int64, segId int, nodeAdd string) utility.VidSegment {
+func GetVideoSegment(fname string, segNums int64, segId int, nodeAdd string) (utility.VidSegment, error) {
 	nodeService, err := rpc.Dial(consts.TransProtocol, nodeAdd)
 	// utility.CheckError(err)
 	waitstr := "."
@@ -242,14 +292,105 @@ func GetVideoSegment(fname string, segNums int64, segId int, nodeAdd string) uti
 		Filename:  fname,
 		SegmentId: segId,
 	}
-	var vidSeg utility.VidSegment
-	vidSeg.Id = segId
+	vidSeg, err := fetchUnchoked(nodeAdd, nodeService, segReq)
+	nodeService.Close()
+	if err != nil {
+		// corrupt or missing on this node, re-fetch it from another holder
+		colorprint.Alert("Segment " + strconv.Itoa(segId) + " from " + nodeAdd + " rejected: " + err.Error())
+		if vidSeg, _, err = fetchFromHolders(segReq, nodeAdd); err != nil {
+			return vidSeg, err
+		}
+	}
+	if err = filemgmt.CacheVidSegment(fname, segNums, vidSeg); err != nil {
+		colorprint.Warning("Segment " + strconv.Itoa(segId) + " of " + fname + " not cached: " + err.Error())
+	}
+	return vidSeg, nil
+}
+
+// This method gets a segment of a video from the node at nodeAdd, or from the other holders of the segment if that node
+// is unreachable or its copy fails verification. Unlike GetVideoSegment it neither waits for the node nor keeps the segment,
+// and returns an error once every holder failed. Also returns the address the segment was fetched from.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// vidSeg, holder, err := transfer.FetchVideoSegment("sample.mp4", 45, ":3000")
+func FetchVideoSegment(fname string, segId int, nodeAdd string) (utility.VidSegment, string, error) {
+	segReq := &utility.ReqStruct{
+		Filename:  fname,
+		SegmentId: segId,
+	}
+	nodeService, err := rpc.Dial(consts.TransProtocol, nodeAdd)
+	if err == nil {
+		var vidSeg utility.VidSegment
+		vidSeg, err = fetchUnchoked(nodeAdd, nodeService, segReq)
+		nodeService.Close()
+		if err == nil {
+			return vidSeg, nodeAdd, nil
+		}
+	}
+	colorprint.Alert("Segment " + strconv.Itoa(segId) + " from " + nodeAdd + " unavailable: " + err.Error())
+	return fetchFromHolders(segReq, nodeAdd)
+}
+
+// This method gets a segment over an open rpc connection and verifies it against the published hash, or the hash of
+// the holder's manifest.
+// The transfer is skipped if the content is already stored locally, e.g. as part of another file.
+func fetchSegment(nodeService *rpc.Client, segReq *utility.ReqStruct) (utility.VidSegment, error) {
+	var hash string
+	err := nodeService.Call("Service.GetSegmentHash", segReq, &hash)
+	if err != nil {
+		return utility.VidSegment{}, err
+	}
+	if PublishedHash != nil {
+		if published := PublishedHash(segReq.Filename, segReq.SegmentId); published != "" {
+			if hash != "" && hash != published {
+				return utility.VidSegment{}, errors.New("Segment checksum mismatch.")
+			}
+			hash = published
+		}
+	}
+	vidSeg := utility.VidSegment{Id: segReq.SegmentId, Hash: hash}
+	if body, err := filemgmt.Objects().Get(hash); err == nil {
+		vidSeg.Body = body
+		return vidSeg, nil
+	}
+	segReq.From = rpcAddress
 	err = nodeService.Call("Service.GetFileSegment", segReq, &vidSeg)
-	utility.CheckError(err)
-	err = nodeService.Close()
-	utility.CheckError(err)
-	filemgmt.AddVidSegIntoFileSys(fname, segNums, vidSeg, &localFileSys)
-	return vidSeg
+	if err != nil {
+		return vidSeg, err
+	}
+	vidSeg.Id = segReq.SegmentId
+	if (hash != "" && vidSeg.Hash != hash) || !filemgmt.VerifySegment(vidSeg) {
+		return vidSeg, errors.New("Segment checksum mismatch.")
+	}
+	return vidSeg, nil
+}
+
+// This method tries to get a segment from every other holder returned by SegmentHolders until one of them returns
+// a segment that passes verification. Also returns the holder the segment was fetched from.
+func fetchFromHolders(segReq *utility.ReqStruct, exclude string) (utility.VidSegment, string, error) {
+	err := errors.New("Segment unavailable.")
+	if SegmentHolders == nil {
+		return utility.VidSegment{}, "", err
+	}
+	for _, addr := range SegmentHolders(segReq.Filename, segReq.SegmentId) {
+		if addr == exclude {
+			continue
+		}
+		nodeService, derr := rpc.Dial(consts.TransProtocol, addr)
+		if derr != nil {
+			continue
+		}
+		var vidSeg utility.VidSegment
+		vidSeg, err = fetchUnchoked(addr, nodeService, segReq)
+		nodeService.Close()
+		if err == nil {
+			colorprint.Info("Segment " + strconv.Itoa(segReq.SegmentId) + " re-fetched from " + addr)
+			return vidSeg, addr, nil
+		}
+		colorprint.Alert("Segment " + strconv.Itoa(segReq.SegmentId) + " from " + addr + " rejected: " + err.Error())
+	}
+	return utility.VidSegment{}, "", err
 }
 
 // This method sends a utility.VidSegment to another node for saving
@@ -266,7 +407,7 @@ func GetVideoSegment(fname string, segNums int64, segId int, nodeAdd string) uti
 // 		vidMap[i] = transfer.SendVideoSegment("sample.mp4", ":3000", segment)
 // }
 //
-func SendVideoSegment(fname string, nodeAdd string, segNums int, segment utility.VidSegment) {
+func SendVideoSegment(fname string, nodeAdd string, segNums int, segment utility.VidSegment) error {
 	fmt.Printf("\rSending segment " + strconv.Itoa(segment.Id))
 	waitstr := "."
 	counter, incrementer := 0, 1
@@ -289,11 +430,54 @@ func SendVideoSegment(fname string, nodeAdd string, segNums int, segment utility
 		SegmentId: segment.Id,
 		Segment:   segment,
 	}
-	err = nodeService.Call("Service.ReceiveFileSegment", segReq, &segment)
-	utility.CheckError(err)
-	err = nodeService.Close()
+	if segReq.Segment.Hash == "" {
+		segReq.Segment.Hash = castore.Hash(segment.Body)
+	}
+	// leave the body out if the receiver already stores the content
+	var has bool
+	err = nodeService.Call("Service.HasObject", segReq.Segment.Hash, &has)
 	utility.CheckError(err)
+	if has {
+		segReq.Segment.Body = nil
+	}
+	// refused if the receiver's storage quota is exceeded, the caller places the segment elsewhere
+	err = nodeService.Call("Service.ReceiveFileSegment", segReq, &segment)
+	nodeService.Close()
+	return err
+}
 
+// This method asks the node at nodeAdd to delete an unpublished video
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// err := transfer.DeleteFile(":3000", "sample.mp4")
+func DeleteFile(nodeAdd string, fname string) error {
+	nodeService, err := rpc.Dial(consts.TransProtocol, nodeAdd)
+	if err != nil {
+		return err
+	}
+	defer nodeService.Close()
+	var deleted bool
+	return nodeService.Call("Service.DeleteFile", fname, &deleted)
+}
+
+// This method asks the node at nodeAdd whether it holds segments of a file. A node that can't be reached returns
+// an error.
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// holds, err := transfer.HoldsFile(":3000", "sample.mp4")
+func HoldsFile(nodeAdd string, fname string) (bool, error) {
+	segs, _, err := segmentsOn(nodeAdd, fname)
+	return segs.Count() > 0, err
+}
+
+// This method deletes a video from this node, including the segments loaded into memory at startup
+func RemoveFile(fname string) error {
+	localFileSys.Lock()
+	delete(localFileSys.Files, fname)
+	localFileSys.Unlock()
+	return filemgmt.DeleteFile(fname)
 }
 
 // =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
@@ -303,10 +487,8 @@ func SendVideoSegment(fname string, nodeAdd string, segNums int, segment utility
 // =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
 
 // This method sets up the RPC connection using UDP
-func setUpRPC(nodeRPC string) {
-	rpcServ := new(Service)
-	rpc.Register(rpcServ)
-	rpcAddr, err := net.ResolveTCPAddr("tcp", nodeRPC)
+func setUpRPC(bindAddr string) {
+	rpcAddr, err := net.ResolveTCPAddr("tcp", bindAddr)
 	if err != nil {
 		log.Fatal("listen error:", err)
 	}
@@ -318,7 +500,10 @@ func setUpRPC(nodeRPC string) {
 		conn, _ := l.AcceptTCP()
 		colorprint.Alert("=========================================================================================")
 		colorprint.Debug("REQ " + strconv.Itoa(i) + ": ESTABLISHING RPC REQUEST CONNECTION WITH " + conn.LocalAddr().String())
-		go rpc.ServeConn(conn)
+		// every connection gets a service of its own, which knows where the requests come from
+		server := rpc.NewServer()
+		server.Register(&Service{remote: conn.RemoteAddr().String()})
+		go server.ServeConn(conn)
 		colorprint.Blue("REQ " + strconv.Itoa(i) + ": Request Served")
 		colorprint.Alert("=========================================================================================")
 		defer conn.Close()
@@ -408,10 +593,8 @@ func playHelper(fname string) {
 	fmt.Scan(&fname)
 	colorprint.Debug("<<<< " + fname)
 	player.Filename = fname
-	for _, element := range filePaths.Files {
-		if element.Name == fname {
-			player.Filepath = element.Path
-		}
+	if entry, ok := filemgmt.Catalog().Get(fname); ok {
+		player.Filepath = entry.Path
 	}
 
 	player.Run()
@@ -423,17 +606,19 @@ func playHelper(fname string) {
 // =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
 // =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
 
-// This method starts up the transfer rpc and also initializes the filesystem
-func Initialize(nodeRPC string, name string) *utility.FileSys {
-	if !utility.ValidIP(nodeRPC, "[node RPC ip:port]") {
+// This method starts up the transfer rpc and also initializes the filesystem. bindAddr is the local address the rpc
+// listens on and advertiseAddr is the address peers use to reach it (empty to advertise bindAddr).
+func Initialize(bindAddr string, advertiseAddr string, name string) *utility.FileSys {
+	if !utility.ValidIP(bindAddr, "[node RPC ip:port]") {
 		colorprint.Alert("Please provide a valid IP string.")
 		return nil
 	}
 	// ========================================
 	progLock = &sync.RWMutex{}
 	// ========================================
-	rpcAddress = nodeRPC
-	go setUpRPC(nodeRPC)
+	rpcAddress = utility.AdvertiseAddr(bindAddr, advertiseAddr)
+	go setUpRPC(bindAddr)
+	go runChoker()
 	nodeName = name
 	localFileSys = utility.FileSys{
 		Id:    1,
@@ -3,11 +3,13 @@ package utility
 // package clientstream
 
 import (
-	"../../consts"
+	"errors"
 	"fmt"
 	"github.com/fatih/color"
+	"net"
 	"os"
-	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -21,12 +23,14 @@ import (
 type VidSegment struct {
 	Id   int
 	Body []byte
+	Hash string // SHA-256 of Body (hex) from the publisher's manifest, checked whenever the segment is received or read
 }
 
 // This struct holds the info for obtaining a video segment
 type ReqStruct struct {
 	Filename  string
 	SegmentId int
+	From      string // file transfer address of the requesting node, "" if it doesn't say
 }
 
 // This struct holds the fields for sending a video segment to be saved onto a node
@@ -34,16 +38,15 @@ type SeqStruct struct {
 	Filename  string
 	SegNums   int
 	SegmentId int
-	Segment   VidSegment
+	Segment   VidSegment // the body is left out when the receiver already stores content with Segment.Hash
 }
 
-// This struct holds the VidSegments of a particular video file. SegNums refers to the total number of segments in the entire video.
-// This colorprint.Info is used to reorder the segments when playing the video stream.
+// This struct indexes the locally available segments of a particular video file. SegNums refers to the total number of segments in the
+// entire video. The segments themselves stay on disk and are read on request.
 type Video struct {
 	Name      string
 	SegNums   int64
 	SegsAvail []int64
-	Segments  map[int]VidSegment
 }
 
 // This struct represents the local FileSystem to hold the Video's. Each FileSys object has an id and a map of Files with the keys to the map being the
@@ -54,25 +57,20 @@ type FileSys struct {
 	sync.RWMutex
 }
 
-// This struct represents the Files as their names and the directory that they are located in
-type File struct {
-	Name      string  `json:"name"`
-	Path      string  `json:"dir"`
-	SegNums   int64   `json:"segnums"`
-	SegsAvail []int64 `json:"segsavail"`
-}
-
-// This struct represents the filenames and their directory paths from which we are to read the files to be processed
-type FilePath struct {
-	Files []File `json:"Files"`
-}
-
 // This struct represents the response that an RPC call will write to. It is used to check if a node has a particular file and if it does, which parts
-// of that file it has in its local filesystem.
+// of that file it has in its local filesystem. Segments is a bitfield (see catalog.Bitmap), one bit per segment instead of a list of ids.
 type Response struct {
-	Avail     bool
-	SegNums   int64
-	SegsAvail []int64
+	Avail       bool
+	SegNums     int64
+	Segments    []byte   // bit (id-1)%8 of byte (id-1)/8 is set for every segment id the node holds
+	Downloaders []string // nodes that recently announced they are downloading the file, they may hold segments by now
+}
+
+// This struct announces the segments a node stored while downloading a file to the other nodes of its swarm
+type HaveMsg struct {
+	Filename string
+	From     string // file transfer address of the announcing node
+	Ids      []int  // segments stored since the last announcement, none in the first one
 }
 
 // =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
@@ -91,22 +89,116 @@ func CheckError(err error) {
 	}
 }
 
-// This method saves file information into a json file in the filesys folder
-func SaveFileInfoToJson(jsondata []byte) {
-	jsonFile, err := os.Create(consts.DirPath + "/localFiles.json")
-	CheckError(err)
-	_, err = jsonFile.Write(jsondata)
-	CheckError(err)
-	jsonFile.Close()
-}
-
-// Checks if the ip provided is valid. Accepts only the port as well eg. :3000 although in this case
-// it assumes the localhost ip address
+// Checks if the address provided is valid. The host is an ip or a hostname eg. localhost:3000. Accepts only the
+// port as well eg. :3000 although in this case it assumes the localhost ip address. IPv6 literals must be
+// bracketed eg. [::1]:3000
 func ValidIP(ipAddress string, field string) bool {
-	re, _ := regexp.Compile(`[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\:[0-9]{1,5}|\:[0-9]{1,5}`)
-	if re.MatchString(ipAddress) {
-		return true
+	host, port, err := net.SplitHostPort(ipAddress)
+	if err == nil {
+		p, perr := strconv.Atoi(port)
+		if perr == nil && p >= 0 && p <= 65535 && (host == "" || net.ParseIP(host) != nil || validHostname(host)) {
+			return true
+		}
 	}
 	fmt.Println("\x1b[31;1mError: "+field+":"+ipAddress, "is not in the correct format\x1b[0m")
 	return false
 }
+
+// Checks that every dot separated label of a hostname is 1 to 63 letters, digits or hyphens, not starting or
+// ending with a hyphen
+func validHostname(host string) bool {
+	if len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Returns the canonical host:port form of an address. This is the form that is handed to peers and hashed into
+// identifiers, so that the same node always ends up with the same identifier no matter how its address was written.
+// An empty or unspecified host (eg. :3000 or 0.0.0.0:3000) is replaced with this machine's ip address (see LocalIP),
+// ip literals are normalized (eg. [0:0::1]:03000 becomes [::1]:3000) and hostnames are lowercased.
+func CanonicalAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(strings.TrimSpace(addr))
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return "", errors.New("invalid port in address " + addr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() {
+			host = LocalIP()
+		} else {
+			host = ip.String()
+		}
+	} else if host == "" {
+		host = LocalIP()
+	} else {
+		host = strings.ToLower(host)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p)), nil
+}
+
+// Returns the address that peers should use to reach an endpoint bound to bindAddr. If advertiseAddr is empty the
+// bind address is advertised. advertiseAddr may also be a bare host (eg. 10.0.0.5 or ::1) in which case the port
+// of the bind address is used. The result is always in canonical form.
+func AdvertiseAddr(bindAddr string, advertiseAddr string) string {
+	if advertiseAddr == "" {
+		advertiseAddr = bindAddr
+	} else if _, _, err := net.SplitHostPort(advertiseAddr); err != nil {
+		_, port, err := net.SplitHostPort(bindAddr)
+		CheckError(err)
+		advertiseAddr = net.JoinHostPort(strings.Trim(advertiseAddr, "[]"), port)
+	}
+	addr, err := CanonicalAddr(advertiseAddr)
+	CheckError(err)
+	return addr
+}
+
+// Returns the first non loopback ip address of this machine, preferring IPv4. Falls back to 127.0.0.1 when the
+// machine has no other interface.
+func LocalIP() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "127.0.0.1"
+	}
+	var v6 string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		}
+		if v6 == "" {
+			v6 = ipnet.IP.String()
+		}
+	}
+	if v6 != "" {
+		return v6
+	}
+	return "127.0.0.1"
+}
+
+// Returns the host:port form of a bind address that can be handed to listeners which do not accept an empty host
+// (eg. ffplay's udp:// urls). An empty host becomes 0.0.0.0.
+func ListenAddr(bindAddr string) string {
+	host, port, err := net.SplitHostPort(bindAddr)
+	CheckError(err)
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return net.JoinHostPort(host, port)
+}
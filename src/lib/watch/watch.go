@@ -0,0 +1,110 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+//  STRUCTS & TYPES
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Polls a directory for new and changed files. A file is reported once its size and modification time stayed the
+// same for a whole poll, so files still being copied into the directory are not picked up half written.
+type Watcher struct {
+	dir      string
+	interval time.Duration
+	match    func(name string) bool
+	seen     map[string]state
+}
+
+type state struct {
+	size     int64
+	modTime  time.Time
+	reported bool
+}
+
+// Extensions of the files Videos matches
+var VideoExtensions = []string{".mp4", ".m4v", ".mkv", ".mov", ".webm", ".avi", ".ts"}
+
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// PUBLIC METHODS
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+// =-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-
+
+// Returns a watcher of the files in dir (not its subdirectories) accepted by match, polled every interval
+// -------------------
+// INSTRUCTIONS:
+// -------------------
+// w := watch.New("./videos", 5*time.Second, watch.Videos)
+// go w.Run(func(path string, info os.FileInfo) { ... })
+func New(dir string, interval time.Duration, match func(name string) bool) *Watcher {
+	return &Watcher{dir: dir, interval: interval, match: match, seen: make(map[string]state)}
+}
+
+// Accepts the names of video files, by extension. Hidden files are left out.
+func Videos(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, video := range VideoExtensions {
+		if ext == video {
+			return true
+		}
+	}
+	return false
+}
+
+// Polls the directory forever and calls handle for every new or changed file, one file at a time. Every file
+// present at the start is reported too, after the first poll.
+func (w *Watcher) Run(handle func(path string, info os.FileInfo)) {
+	for {
+		for _, info := range w.Poll() {
+			handle(filepath.Join(w.dir, info.Name()), info)
+		}
+		time.Sleep(w.interval)
+	}
+}
+
+// Lists the directory once and returns the files that are ready to be reported: new or changed files whose size
+// and modification time did not change since the previous poll. Unreadable directories yield nothing.
+func (w *Watcher) Poll() []os.FileInfo {
+	infos, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return nil
+	}
+	var ready []os.FileInfo
+	present := make(map[string]bool)
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !w.match(name) {
+			continue
+		}
+		present[name] = true
+		last, ok := w.seen[name]
+		current := state{size: info.Size(), modTime: info.ModTime()}
+		if ok && last.size == current.size && last.modTime.Equal(current.modTime) {
+			if !last.reported {
+				last.reported = true
+				w.seen[name] = last
+				ready = append(ready, info)
+			}
+			continue
+		}
+		// new or still changing, reported once it settles
+		w.seen[name] = current
+	}
+	for name := range w.seen {
+		if !present[name] {
+			delete(w.seen, name)
+		}
+	}
+	return ready
+}
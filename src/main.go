@@ -1,100 +1,228 @@
 package main
 
 import (
+	"./consts"
+	"./lib/catalog"
 	"./lib/chordRPC"
+	"./lib/crypt"
+	"./lib/download"
 	"./lib/filemgmt"
+	"./lib/kademlia"
+	"./lib/kvstore"
+	"./lib/manifest"
 	"./lib/player"
+	"./lib/publish"
+	"./lib/search"
 	"./lib/transfer"
+	"./lib/utility"
+	"./lib/watch"
 	//"bufio"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	chordAddress string
-	ftAddress    string
+	ftAddress    string // advertised file transfer address
 	peerAddress  string
 	//peerAddress1 	string
 	vid []byte
+
+	chordAdvertise = flag.String("chord-advertise", "", "address (host or host:port) peers use to reach the chord service, defaults to <chordAddress>")
+	ftAdvertise    = flag.String("ft-advertise", "", "address (host or host:port) peers use to reach the file transfer service, defaults to <ftAddress>")
+	overlay        = flag.String("overlay", "chord", "dht used for segment placement: chord or kademlia")
+	storeDir       = flag.String("store-dir", "chordstore", "directory of the durable chord key value store, in memory when empty")
+	segmentLength  = flag.Duration("segment-duration", 0, "cut shared files at keyframes into segments of about this duration (e.g. 10s), fixed size segments when 0")
+	startAt        = flag.Duration("start-at", 0, "position to start streaming from, for files cut at keyframes")
+	quotaBytes     = flag.Int64("quota", 0, "disk budget of this node's segments in bytes, unlimited when 0")
+	eviction       = flag.String("eviction", "lru", "order cached segments are evicted in when the quota runs out: lru or popularity")
+	unpublishFile  = flag.String("unpublish", "", "remove a shared file from every node that holds it, then continue as usual")
+	erasureCode    = flag.String("erasure", "", "erasure code shared files with k data and m parity shards per group (e.g. 4+2) instead of storing whole segments")
+	segmentCache   = flag.Int64("segment-cache", consts.SegmentCacheBytes, "bytes of recently read segments kept in memory, segments are read from disk otherwise")
+	encrypt        = flag.Bool("encrypt", false, "encrypt shared files with a key of their own, viewers stream them with the printed share link")
+	watchDir       = flag.String("watch", "", "directory whose new and changed videos are shared automatically")
+
+	// erasure code of shared files given by -erasure, whole segments are stored when dataShards is 0
+	dataShards   int
+	parityShards int
+
+	// segment placement functions of the selected overlay
+	getAddressForSegment   func(string) string
+	getAddressesForSegment func(string) []string
+	getAddressesForShards  func(string, int) []string
+	saveToMap              func(string, []byte)
+	removeFromMap          func(string)
+	putManifest            func(string, []byte) error
+	getManifest            func(string) ([]byte, error)
+
+	downloads  *download.Manager
+	publishing *publish.Tracker
+	index      *search.Index
+	sharing    sync.Mutex // one file is shared at a time
 )
 
 func main() {
 
 	vid = []byte{}
 
-	if len(os.Args) < 4 {
-		fmt.Printf("Usage : go run main.go <chordAddress> <ftAddress> <peerAddress>")
+	flag.Parse()
+	if flag.NArg() < 3 {
+		fmt.Printf("Usage : go run main.go [-overlay chord|kademlia] [-store-dir dir] [-segment-duration d] [-start-at d] [-quota bytes] [-eviction lru|popularity] [-segment-cache bytes] [-unpublish file] [-erasure k+m] [-encrypt] [-watch dir] [-chord-advertise host[:port]] [-ft-advertise host[:port]] <chordAddress> <ftAddress> <peerAddress>")
 		os.Exit(-1)
 	}
 
-	chordAddress = os.Args[1]
-	ftAddress = os.Args[2]
-	peerAddress = os.Args[3]
+	chordAddress = flag.Arg(0)
+	ftBind := flag.Arg(1)
+	peerAddress = flag.Arg(2)
 	//peerAddress1 = os.Args[3]
+	ftAddress = utility.AdvertiseAddr(ftBind, *ftAdvertise)
+	if *eviction != "lru" && *eviction != "popularity" {
+		fmt.Printf("Unknown eviction policy %s. Use lru or popularity\n", *eviction)
+		os.Exit(-1)
+	}
+	filemgmt.SetQuota(*quotaBytes, *eviction)
+	filemgmt.SetSegmentCache(*segmentCache)
+	if *erasureCode != "" {
+		_, err := fmt.Sscanf(*erasureCode, "%d+%d", &dataShards, &parityShards)
+		if err != nil || dataShards < 1 || parityShards < 1 || dataShards+parityShards > 256 {
+			fmt.Printf("Invalid erasure code %s. Use k+m, e.g. 4+2\n", *erasureCode)
+			os.Exit(-1)
+		}
+	}
 
 	// Initialize local filesystem
-	localFileSystem := transfer.Initialize(ftAddress, ":6666")
+	localFileSystem := transfer.Initialize(ftBind, ftAddress, ":6666")
 	filemgmt.ProcessLocalFiles(localFileSystem)
 	filemgmt.PrintFileSysContents(localFileSystem)
 
-	// Init chord
-	go chordRPC.Start(chordAddress, peerAddress, ftAddress)
+	// Init overlay
+	switch *overlay {
+	case "chord":
+		if *storeDir != "" {
+			// one log per node so that several nodes can run from the same directory. The name comes from the bind
+			// address, which unlike the advertised address does not change with the machine's ip.
+			logNamer := strings.NewReplacer(":", "_", "[", "", "]", "")
+			logPath := filepath.Join(*storeDir, logNamer.Replace(chordAddress)+".log")
+			store, err := kvstore.OpenLog(logPath, kvstore.DefaultOptions())
+			utility.CheckError(err)
+			chordRPC.SetStore(store)
+		}
+		go chordRPC.Start(chordAddress, *chordAdvertise, peerAddress, ftAddress)
+		getAddressForSegment = chordRPC.GetAddressForSegment
+		getAddressesForSegment = chordRPC.GetAddressesForSegment
+		getAddressesForShards = chordRPC.GetAddressesForShards
+		saveToMap = chordRPC.SaveToMap
+		removeFromMap = chordRPC.RemoveFromMap
+		putManifest = chordRPC.Put
+		getManifest = chordRPC.Get
+	case "kademlia":
+		go kademlia.Start(chordAddress, *chordAdvertise, peerAddress, ftAddress, "")
+		getAddressForSegment = kademlia.GetAddressForSegment
+		getAddressesForSegment = kademlia.GetAddressesForSegment
+		getAddressesForShards = kademlia.GetAddressesForShards
+		saveToMap = kademlia.SaveToMap
+		removeFromMap = kademlia.RemoveFromMap
+		putManifest = func(key string, data []byte) error {
+			if kademlia.Put(key, data) == 0 {
+				return errors.New("no node stored " + key)
+			}
+			return nil
+		}
+		getManifest = func(key string) ([]byte, error) {
+			data, ok := kademlia.Get(key)
+			if !ok {
+				return nil, errors.New(key + " not found")
+			}
+			return data, nil
+		}
+	default:
+		fmt.Printf("Unknown overlay %s. Use chord or kademlia\n", *overlay)
+		os.Exit(-1)
+	}
+	// segments failing verification are fetched again from the other holders
+	transfer.SegmentHolders = func(fname string, segId int) []string {
+		return getAddressesForSegment(strings.Split(fname, ".")[0] + "_" + strconv.Itoa(segId))
+	}
+
+	transfer.ShardHolders = getAddressesForShards
+	index = search.New(putManifest, getManifest, countSeeders)
+
+	// downloads interrupted by the last shutdown continue with their missing segments
+	store, err := kvstore.OpenLog(consts.DirPath+consts.DownloadsPath, kvstore.DefaultOptions())
+	utility.CheckError(err)
+	downloads, err = download.Open(store, fetchSegments)
+	utility.CheckError(err)
+	transfer.PublishedHash = downloads.PublishedHash
+	downloads.ResumeInterrupted()
+
+	go collectGarbage()
+	go repairShards()
+	if *unpublishFile != "" {
+		unpublish(*unpublishFile)
+	}
+
+	// shares interrupted by the last shutdown continue where they stopped
+	store, err = kvstore.OpenLog(consts.DirPath+consts.PublishPath, kvstore.DefaultOptions())
+	utility.CheckError(err)
+	publishing, err = publish.Open(store)
+	utility.CheckError(err)
+	go func() {
+		for _, rec := range publishing.Pending() {
+			if err := share(rec.Name, nil, localFileSystem); err != nil {
+				fmt.Printf("Unable to share %s: %v\n", rec.Name, err)
+			}
+		}
+		if *watchDir != "" {
+			watchFolder(*watchDir, localFileSystem)
+		}
+	}()
 
 	var shareFile string
 	fmt.Println("Please enter name of file you wish to share: ")
 	fmt.Scan(&shareFile)
 	if shareFile != "" {
-		filemgmt.SplitFile(shareFile)
-		fmt.Println("File splitting complete.")
-	}
-
-	// distribute the parts over all connected nodes
-	fnArr := strings.Split(shareFile, ".")
-	available, segNums, _ := transfer.CheckFileAvailability(shareFile, ftAddress)
-	fmt.Printf("Total segments available to distribute: %d\n", segNums)
-	// TODO: Delay
-	if available {
-		fmt.Println("Available. Commencing file load balancing...")
-
-		// for all segs, distribute
-		for i := 1; i <= int(segNums); i++ {
-			filename := fnArr[0] + "_" + strconv.FormatInt(int64(i), 10)
-			addr := chordRPC.GetAddressForSegment(filename)
-			fmt.Println("Found node with address %s\n", addr)
-			// now send file to addr
-			if addr != ftAddress {
-				//filemgmt.PrintFileSysContents(localFileSystem)
-				vidSeg := transfer.GetVideoSegment(shareFile, segNums, i, ftAddress)
-				transfer.SendVideoSegment(shareFile, addr, int(segNums), vidSeg)
-				chordRPC.SaveToMap(filename, vidSeg.Body)
-				fmt.Printf("Sent segment # %d\n", i)
-			} else {
-				fmt.Println("This node already stores the segment")
-			}
+		info, err := os.Stat(consts.DirPath + "/downloaded/" + shareFile)
+		utility.CheckError(err)
+		if err = share(shareFile, info, localFileSystem); err != nil {
+			fmt.Printf("Unable to share %s: %v\n", shareFile, err)
 		}
 	}
 
 	// stream a file
-	var streamFile string
-	fmt.Println("Please enter name of file you wish to stream: ")
-	fmt.Scan(&streamFile)
-	fnArr = strings.Split(streamFile, ".")
+	var link string
+	fmt.Println("Please enter name (or share link) of file you wish to stream: ")
+	fmt.Scan(&link)
+	streamFile, streamKey, err := crypt.ParseLink(link)
+	utility.CheckError(err)
 	if streamFile != "" {
-		go player.Run()
-		fmt.Printf("Preparing to stream %s\n", streamFile)
-
-		for i := 1; i <= int(segNums); i++ {
-			filename := fnArr[0] + "_" + strconv.FormatInt(int64(i), 10)
-			addr := chordRPC.GetAddressForSegment(filename)
-
-			// now get file segment from this node and push byte stream to vlc
-			vidSeg := transfer.GetVideoSegment(streamFile, segNums, i, addr)
-			for j := 0; j < len(vidSeg.Body); j++ {
-				player.ByteChan <- vidSeg.Body[j]
-				vid = append(vid, vidSeg.Body[j])
+		if data, err := getManifest(manifest.Key(streamFile)); err != nil {
+			// files shared before manifests were published are found the old way
+			fmt.Printf("No manifest of %s (%v), asking the holder of its first segment\n", streamFile, err)
+			go streamUnpublished(streamFile, streamKey)
+		} else {
+			m, err := manifest.Decode(data)
+			utility.CheckError(err)
+			if m.Deleted {
+				utility.CheckError(errors.New(streamFile + " was unpublished"))
 			}
+			if m.Encrypted && streamKey == nil {
+				utility.CheckError(errors.New(streamFile + " is encrypted, stream it with its share link"))
+			}
+			fmt.Printf("Preparing to stream %s (%d segments, %.1fs %s)\n", streamFile, m.SegNums, m.Duration, m.Codec)
+
+			// files cut at keyframes can start at any segment
+			err = downloads.Start(m, m.SegmentAt(startAt.Seconds()))
+			utility.CheckError(err)
+			go play(m, streamKey)
 		}
 	}
 	////////////////
@@ -126,7 +254,681 @@ func main() {
 	// } else {
 	// 	fmt.Println("File is unavailable")
 	// }
+	manageDownloads()
+	fmt.Println("Exiting...")
+}
+
+// Shares a file of the downloaded folder: splits it into segments (sealed with a key of its own with -encrypt),
+// places them on the nodes responsible for them and publishes the manifest. info describes the source of the file,
+// a changed source is shared again from scratch. The progress is tracked in publishing so that a share interrupted
+// by a shutdown continues with the segments not yet placed, nil info just continues the last share of the file.
+// A failed share is left in its stage and continues on the next start.
+func share(shareFile string, info os.FileInfo, localFileSystem *utility.FileSys) error {
+	sharing.Lock()
+	defer sharing.Unlock()
+	rec, ok := publishing.Get(shareFile)
+	if info != nil && !publishing.Unchanged(shareFile, info.Size(), info.ModTime().UnixNano()) {
+		if ok {
+			// segments of the previous version are replaced
+			if err := filemgmt.DeleteFile(shareFile); err != nil {
+				return err
+			}
+		}
+		// storage nodes only get the sealed segments, the key is only in the share link
+		var key []byte
+		var err error
+		if *encrypt {
+			if key, err = crypt.NewKey(); err != nil {
+				return err
+			}
+		}
+		if rec, err = publishing.Begin(shareFile, info.Size(), info.ModTime().UnixNano(), key); err != nil {
+			return err
+		}
+	} else if !ok {
+		return nil
+	} else if rec.Stage == publish.Published {
+		fmt.Printf("%s is already shared\n", shareFile)
+		if rec.Key != nil {
+			fmt.Printf("Share link for viewers of %s: %s\n", shareFile, crypt.Link(shareFile, rec.Key))
+		}
+		return nil
+	} else {
+		fmt.Printf("Resuming the share of %s (%s)\n", shareFile, rec.Stage)
+	}
+
+	if rec.Stage == publish.Splitting {
+		var err error
+		if *segmentLength > 0 {
+			err = filemgmt.SplitFileAtKeyframes(shareFile, *segmentLength)
+		} else {
+			err = filemgmt.SplitFile(shareFile)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println("File splitting complete.")
+		if rec.Key != nil {
+			if err = filemgmt.EncryptFile(shareFile, rec.Key); err != nil {
+				return err
+			}
+			fmt.Println("File encryption complete.")
+		}
+		if err = publishing.SetStage(shareFile, publish.Distributing); err != nil {
+			return err
+		}
+	}
+
+	// distribute the parts over all connected nodes
+	fnArr := strings.Split(shareFile, ".")
+	available, segNums, _ := transfer.CheckFileAvailability(shareFile, ftAddress)
+	fmt.Printf("Total segments available to distribute: %d\n", segNums)
+	if !available {
+		return errors.New(shareFile + " is not available on this node")
+	}
+	// segments placed before the last shutdown are only skipped if they were placed with the same erasure code
+	layout := ""
+	if dataShards > 0 {
+		layout = fmt.Sprintf("%d+%d", dataShards, parityShards)
+	}
+	if err := publishing.SetLayout(shareFile, layout); err != nil {
+		return err
+	}
+	rec, _ = publishing.Get(shareFile)
+	if dataShards == 0 {
+		fmt.Println("Available. Commencing file load balancing...")
+
+		// for all segs not placed before the last shutdown, distribute
+		for i := 1; i <= int(segNums); i++ {
+			if rec.Placed.Has(int64(i)) {
+				continue
+			}
+			filename := fnArr[0] + "_" + strconv.FormatInt(int64(i), 10)
+			addr := getAddressForSegment(filename)
+			fmt.Printf("Found node with address %s\n", addr)
+			// now send file to addr
+			if addr != ftAddress {
+				vidSeg, err := transfer.GetVideoSegment(shareFile, segNums, i, ftAddress)
+				if err != nil {
+					return err
+				}
+				if placed := placeSegment(shareFile, filename, addr, int(segNums), vidSeg); placed != "" {
+					saveToMap(filename, vidSeg.Body)
+					fmt.Printf("Sent segment # %d to %s\n", i, placed)
+				} else {
+					fmt.Printf("No node has room for segment # %d, keeping it on this node\n", i)
+				}
+			} else {
+				fmt.Println("This node already stores the segment")
+			}
+			if err := publishing.Place(shareFile, int64(i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// publish the manifest so that readers don't need to know the layout of the file
+	m, err := filemgmt.VideoManifest(shareFile)
+	if err != nil {
+		return err
+	}
+	m.Encrypted = rec.Key != nil
+	if dataShards > 0 {
+		fmt.Printf("Available. Distributing %d+%d erasure coded shards per group...\n", dataShards, parityShards)
+		if err = distributeShards(&m, dataShards, parityShards, rec.Placed, localFileSystem); err != nil {
+			return err
+		}
+	}
+	data, err := manifest.Encode(m)
+	if err != nil {
+		return err
+	}
+	if err = putManifest(manifest.Key(shareFile), data); err != nil {
+		// left in the distributing stage, the manifest is published again on the next start
+		return errors.New("unable to publish the manifest: " + err.Error())
+	}
+	if err = index.Add(m); err != nil {
+		fmt.Printf("Unable to index %s for search: %v\n", shareFile, err)
+	}
+	if err = publishing.SetStage(shareFile, publish.Published); err != nil {
+		return err
+	}
+	if m.Encrypted {
+		fmt.Printf("Share link for viewers of %s: %s\n", shareFile, crypt.Link(shareFile, rec.Key))
+	}
+	return nil
+}
+
+// Shares the videos copied or moved into dir, and shares them again when they change. Files are linked (or copied,
+// across file systems) into the downloaded folder first, files shared before from the same source are skipped.
+func watchFolder(dir string, localFileSystem *utility.FileSys) {
+	fmt.Printf("Watching %s for videos to share\n", dir)
+	downloaded, _ := filepath.Abs(consts.DirPath + "/downloaded")
+	watch.New(dir, consts.WatchInterval, watch.Videos).Run(func(path string, info os.FileInfo) {
+		name := info.Name()
+		if rec, ok := publishing.Get(name); ok && rec.Stage == publish.Published && publishing.Unchanged(name, info.Size(), info.ModTime().UnixNano()) {
+			return
+		}
+		if abs, _ := filepath.Abs(path); filepath.Dir(abs) != downloaded {
+			if err := importFile(path, consts.DirPath+"/downloaded/"+name); err != nil {
+				fmt.Printf("Unable to share %s: %v\n", path, err)
+				return
+			}
+		}
+		if err := share(name, info, localFileSystem); err != nil {
+			fmt.Printf("Unable to share %s: %v\n", name, err)
+		}
+	})
+}
+
+// Makes the file at path available at target, by a hard link when possible
+func importFile(path string, target string) error {
+	os.Remove(target)
+	if os.Link(path, target) == nil {
+		return nil
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// Plays a file from the segment given by -start-at while it is downloaded. Pausing the download stalls the player.
+func play(m manifest.Manifest, key []byte) {
+	go player.Run()
+	for i := m.SegmentAt(startAt.Seconds()); i <= int(m.SegNums); i++ {
+		vidSeg, err := downloads.Segment(m.Name, i)
+		if err != nil {
+			// cancelled or failed, the node keeps serving others
+			fmt.Println("Stopped playing " + m.Name + ": " + err.Error())
+			player.Stop()
+			return
+		}
+		body := vidSeg.Body
+		if m.Encrypted {
+			body, err = crypt.Open(key, m.Name, i, vidSeg.Body)
+			if err != nil {
+				fmt.Println("Stopped playing " + m.Name + ": " + err.Error())
+				player.Stop()
+				return
+			}
+		}
+		// push byte stream to vlc
+		for j := 0; j < len(body); j++ {
+			player.ByteChan <- body[j]
+			vid = append(vid, body[j])
+		}
+	}
+}
+
+// Streams a file without a manifest, e.g. one shared before manifests were published. The number of segments is
+// asked from the holder of the first segment and every segment is fetched from the node the overlay places it on.
+// Without a manifest the segments are only checked against the hashes of their holders.
+func streamUnpublished(streamFile string, key []byte) {
+	prefix := strings.Split(streamFile, ".")[0]
+	addr := getAddressForSegment(prefix + "_1")
+	if addr == "" {
+		fmt.Println(streamFile + " is not available")
+		return
+	}
+	available, segNums, _ := transfer.CheckFileAvailability(streamFile, addr)
+	if !available {
+		fmt.Println(streamFile + " is not available")
+		return
+	}
+	go player.Run()
+	for i := 1; i <= int(segNums); i++ {
+		vidSeg, err := transfer.GetVideoSegment(streamFile, segNums, i, getAddressForSegment(prefix+"_"+strconv.Itoa(i)))
+		body := vidSeg.Body
+		if err == nil && key != nil {
+			body, err = crypt.Open(key, streamFile, i, vidSeg.Body)
+		}
+		if err != nil {
+			fmt.Println("Stopped playing " + streamFile + ": " + err.Error())
+			player.Stop()
+			return
+		}
+		// push byte stream to vlc
+		for j := 0; j < len(body); j++ {
+			player.ByteChan <- body[j]
+			vid = append(vid, body[j])
+		}
+	}
+}
+
+// Fetches segments for the download manager. Plain segments are swarmed from every node holding some of them: the
+// nodes the overlay places them on and the nodes they were fetched from before. Erasure coded segments are rebuilt
+// from their group one after the other.
+func fetchSegments(m manifest.Manifest, ids []int, hints map[int]string, rarestFirst bool, deliver func(utility.VidSegment, string) error) error {
+	if m.Coded() {
+		for _, id := range ids {
+			vidSeg, err := transfer.GetCodedSegment(m, id)
+			if err != nil {
+				return err
+			}
+			if err = deliver(vidSeg, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var keys []string
+	stripes := make(map[string]bool)
+	for _, id := range ids {
+		stripe, ok := m.StripeOf(int64(id))
+		if !ok {
+			return errors.New("segment " + strconv.Itoa(id) + " missing from the manifest of " + m.Name)
+		}
+		if !stripes[stripe.Key] {
+			stripes[stripe.Key] = true
+			keys = append(keys, stripe.Key)
+		}
+	}
+	// the holders of the first stripes needed are looked up before the swarm starts, the others while it runs.
+	// Downloading peers found on the way announce what they hold anyway.
+	first := keys
+	if len(first) > consts.SwarmLookahead {
+		first = first[:consts.SwarmLookahead]
+	}
+	asked := map[string]bool{ftAddress: true}
+	var candidates []string
+	for _, addr := range hints {
+		candidates = append(candidates, addr)
+	}
+	candidates = newCandidates(append(candidates, lookupHolders(first)...), asked)
+	more := make(chan []transfer.Peer)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(more)
+		for i := len(first); i < len(keys); i += consts.SwarmLookahead {
+			end := i + consts.SwarmLookahead
+			if end > len(keys) {
+				end = len(keys)
+			}
+			addrs := newCandidates(lookupHolders(keys[i:end]), asked)
+			if len(addrs) == 0 {
+				continue
+			}
+			select {
+			case more <- transfer.FindPeers(m.Name, addrs):
+			case <-done:
+				return
+			}
+		}
+	}()
+	order := transfer.InOrder
+	if rarestFirst {
+		order = transfer.RarestFirst
+	}
+	return transfer.Swarm(m.Name, ids, transfer.FindPeers(m.Name, candidates), more, order, deliver)
+}
+
+// Looks up the holders of several stripes in parallel
+func lookupHolders(keys []string) []string {
+	var addrs []string
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			found := getAddressesForSegment(key)
+			lock.Lock()
+			addrs = append(addrs, found...)
+			lock.Unlock()
+		}(key)
+	}
+	wg.Wait()
+	return addrs
+}
+
+// Returns the addresses not asked yet and marks them asked
+func newCandidates(addrs []string, asked map[string]bool) []string {
+	var fresh []string
+	for _, addr := range addrs {
+		if addr != "" && !asked[addr] {
+			asked[addr] = true
+			fresh = append(fresh, addr)
+		}
+	}
+	return fresh
+}
+
+// Reads commands from the console until it is closed: search <words>, and the download commands list, fetch <file>
+// (keep a copy of a file without playing it), pause <file>, resume <file> and cancel <file>
+func manageDownloads() {
+	fmt.Println("Commands: search <words>, list, fetch <file>, pause <file>, resume <file>, cancel <file>")
+	var cmd, fname string
 	for {
+		if _, err := fmt.Scan(&cmd); err != nil {
+			// no console, keep serving
+			select {}
+		}
+		if cmd == "list" {
+			for _, d := range downloads.List() {
+				mode := "playing"
+				if d.Background {
+					mode = "background"
+				}
+				fmt.Printf("%s: %s (%s), %d of %d segments\n", d.Name, d.State, mode, d.Done.Count(), d.Manifest.SegNums)
+			}
+			continue
+		}
+		if cmd == "search" {
+			results, err := index.Search(restOfLine())
+			if err != nil {
+				fmt.Println(err)
+			}
+			for _, r := range results {
+				fmt.Printf("%s: %d bytes, %.1fs, %d seeders", r.Name, r.Size, r.Duration, r.Seeders)
+				if r.Encrypted {
+					fmt.Print(", encrypted")
+				}
+				fmt.Println()
+			}
+			fmt.Printf("%d videos found\n", len(results))
+			continue
+		}
+		fmt.Scan(&fname)
+		var err error
+		switch cmd {
+		case "fetch":
+			var data []byte
+			var m manifest.Manifest
+			if data, err = getManifest(manifest.Key(fname)); err == nil {
+				m, err = manifest.Decode(data)
+			}
+			if err == nil && m.Deleted {
+				err = errors.New(fname + " was unpublished")
+			}
+			if err == nil {
+				err = downloads.Fetch(m)
+			}
+		case "pause":
+			err = downloads.Pause(fname)
+		case "resume":
+			err = downloads.Resume(fname)
+		case "cancel":
+			err = downloads.Cancel(fname)
+		default:
+			err = errors.New("Unknown command " + cmd)
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// Returns the rest of the console line, fmt.Scan reads the console unbuffered so nothing is lost
+func restOfLine() string {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if n, err := os.Stdin.Read(b); n == 0 || err != nil || b[0] == '\n' {
+			return string(line)
+		}
+		line = append(line, b[0])
+	}
+}
+
+// Counts the nodes holding segments (or shards) of a video, among the nodes the overlay places them on. Only the
+// holders of consts.SeederSample stripes (or groups) spread over the video are looked up and asked, so a count
+// costs the same for videos of any length.
+func countSeeders(m manifest.Manifest) int {
+	fname := m.Name
+	var candidates []string
+	if m.Coded() {
+		fname = manifest.ShardFile(m.Name)
+		for _, group := range sample(m.Groups(), consts.SeederSample) {
+			candidates = append(candidates, getAddressesForShards(manifest.ShardKey(m.Name, group), m.ShardNodes())...)
+		}
+	} else {
+		var keys []string
+		for _, i := range sample(len(m.Stripes), consts.SeederSample) {
+			keys = append(keys, m.Stripes[i].Key)
+		}
+		candidates = lookupHolders(keys)
+	}
+	var seeders int32
+	var wg sync.WaitGroup
+	for _, addr := range newCandidates(candidates, make(map[string]bool)) {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if holds, _ := transfer.HoldsFile(addr, fname); holds {
+				atomic.AddInt32(&seeders, 1)
+			}
+		}(addr)
+	}
+	wg.Wait()
+	return int(seeders)
+}
+
+// Returns up to count indices spread evenly over 0 to n-1
+func sample(n int, count int) []int {
+	if n < count {
+		count = n
+	}
+	indices := make([]int, count)
+	for i := range indices {
+		indices[i] = i * n / count
+	}
+	return indices
+}
+
+// Sends a segment to the node responsible for it. A node refuses segments that exceed its storage quota, the segment
+// is then placed on the next node of the segment's preference list, where readers look for it when the responsible
+// node does not have it. Returns the address the segment was placed on, "" if every node refused it.
+func placeSegment(fname string, key string, addr string, segNums int, vidSeg utility.VidSegment) string {
+	err := transfer.SendVideoSegment(fname, addr, segNums, vidSeg)
+	if err == nil {
+		return addr
+	}
+	fmt.Printf("Segment # %d refused by %s: %v\n", vidSeg.Id, addr, err)
+	for _, alt := range getAddressesForSegment(key) {
+		if alt == addr || alt == ftAddress {
+			continue
+		}
+		if err = transfer.SendVideoSegment(fname, alt, segNums, vidSeg); err == nil {
+			return alt
+		}
+		fmt.Printf("Segment # %d refused by %s: %v\n", vidSeg.Id, alt, err)
+	}
+	return ""
+}
+
+// Removes a shared file from the network. The manifest is replaced by a tombstone, every holder of a segment (and
+// of its replicas) is asked to delete the file and the segment keys are removed from the map. Holders that can't
+// be reached delete the file once collectGarbage finds the tombstone.
+func unpublish(fname string) {
+	data, err := getManifest(manifest.Key(fname))
+	if err != nil {
+		fmt.Printf("Unable to unpublish %s: %v\n", fname, err)
+		return
+	}
+	m, err := manifest.Decode(data)
+	utility.CheckError(err)
+	tombstone, err := manifest.Encode(manifest.Tombstone(fname))
+	utility.CheckError(err)
+	if err = putManifest(manifest.Key(fname), tombstone); err != nil {
+		fmt.Printf("Unable to unpublish %s: %v\n", fname, err)
+		return
+	}
+	// searches skip tombstones anyway, the postings are removed to keep them short
+	if err = index.Remove(m); err != nil {
+		fmt.Printf("Unable to remove %s from the search index: %v\n", fname, err)
+	}
+	// the watched folder shares the file again only once its source changes
+	sharing.Lock()
+	err = publishing.Remove(fname)
+	sharing.Unlock()
+	if err != nil {
+		fmt.Printf("Unable to forget the share of %s: %v\n", fname, err)
+	}
+
+	holders := map[string]bool{ftAddress: true}
+	prefix := strings.Split(fname, ".")[0]
+	for i := 1; i <= int(m.SegNums); i++ {
+		key := prefix + "_" + strconv.Itoa(i)
+		for _, addr := range getAddressesForSegment(key) {
+			holders[addr] = true
+		}
+		removeFromMap(key)
+	}
+	shardHolders := map[string]bool{ftAddress: true}
+	for group := 0; m.Coded() && group < m.Groups(); group++ {
+		for _, addr := range getAddressesForShards(manifest.ShardKey(fname, group), m.ShardNodes()) {
+			if addr != "" {
+				shardHolders[addr] = true
+			}
+		}
+	}
+
+	deleted := 0
+	for addr := range holders {
+		if addr == ftAddress {
+			err = transfer.RemoveFile(fname)
+		} else {
+			err = transfer.DeleteFile(addr, fname)
+		}
+		if err != nil {
+			fmt.Printf("Unable to delete %s on %s, it will be removed by garbage collection: %v\n", fname, addr, err)
+			continue
+		}
+		deleted++
+	}
+	fmt.Printf("Unpublished %s, deleted on %d of %d nodes\n", fname, deleted, len(holders))
+	for addr := range shardHolders {
+		if !m.Coded() {
+			break
+		}
+		if addr == ftAddress {
+			err = transfer.RemoveFile(manifest.ShardFile(fname))
+		} else {
+			err = transfer.DeleteFile(addr, manifest.ShardFile(fname))
+		}
+		if err != nil {
+			fmt.Printf("Unable to delete the shards of %s on %s, they will be removed by garbage collection: %v\n", fname, addr, err)
+		}
+	}
+}
+
+// Periodically deletes files that were unpublished while this node was unreachable, then reclaims the space of
+// deleted segments
+func collectGarbage() {
+	for {
+		time.Sleep(consts.GCInterval)
+		for _, entry := range filemgmt.Catalog().Files() {
+			data, err := getManifest(manifest.Key(manifest.SourceFile(entry.Name)))
+			if err != nil {
+				continue
+			}
+			if m, err := manifest.Decode(data); err == nil && m.Deleted {
+				if err = transfer.RemoveFile(entry.Name); err != nil {
+					fmt.Printf("Unable to delete unpublished %s: %v\n", entry.Name, err)
+				}
+			}
+		}
+		freed, err := filemgmt.CollectGarbage(consts.GCGrace)
+		if err != nil {
+			fmt.Printf("Garbage collection failed: %v\n", err)
+		} else if freed > 0 {
+			fmt.Printf("Garbage collection reclaimed %d bytes\n", freed)
+		}
+	}
+}
+
+// Encodes the segments of a file in groups of dataShards segments and places the shards of every group on
+// distinct nodes: the node owning the group's key and its successors. The shard layout is recorded in m. Shards
+// whose holder can't be reached or refuses them are left to repairShards. Groups set in done (counted from 1) were
+// placed before and are only encoded for their hashes. Fails if fewer nodes than shards per group are found, since
+// a node holding several shards of a group would take more than one shard with it when it fails.
+func distributeShards(m *manifest.Manifest, dataShards int, parityShards int, done catalog.Bitmap, localFileSystem *utility.FileSys) error {
+	var err error
+	m.DataShards, m.ParityShards = dataShards, parityShards
+	if m.Lengths, err = filemgmt.SegmentLengths(m.Name, m.SegNums); err != nil {
+		return err
+	}
+	m.ShardHashes = make([]string, m.Groups()*(dataShards+parityShards))
+	shardFile := manifest.ShardFile(m.Name)
+	for group := 0; group < m.Groups(); group++ {
+		shards, err := transfer.EncodeGroup(*m, group)
+		if err != nil {
+			return err
+		}
+		key := manifest.ShardKey(m.Name, group)
+		holders := getAddressesForShards(key, len(shards))
+		if len(holders) < len(shards) {
+			return fmt.Errorf("%d+%d erasure coding needs %d nodes, only %d found", dataShards, parityShards, len(shards), len(holders))
+		}
+		for index, shard := range shards {
+			if shard.Hash == "" {
+				// padding of the last group
+				continue
+			}
+			m.ShardHashes[shard.Id-1] = shard.Hash
+			if done.Has(int64(group + 1)) {
+				continue
+			}
+			addr := holders[index]
+			switch {
+			case addr == "":
+				fmt.Printf("Holder of shard # %d unreachable, leaving it to repair\n", shard.Id)
+			case addr == ftAddress:
+				if err = filemgmt.AddVidSegIntoFileSys(shardFile, int64(len(m.ShardHashes)), shard, localFileSystem); err != nil {
+					fmt.Printf("Shard # %d not stored on this node: %v\n", shard.Id, err)
+				}
+			default:
+				// no other node is asked, readers only look for the shards of a group on the group's nodes
+				if err = transfer.SendVideoSegment(shardFile, addr, len(m.ShardHashes), shard); err == nil {
+					fmt.Printf("Sent shard # %d to %s\n", shard.Id, addr)
+				} else {
+					fmt.Printf("Shard # %d refused by %s, leaving it to repair: %v\n", shard.Id, addr, err)
+				}
+			}
+		}
+		if err = publishing.Place(m.Name, int64(group+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Periodically restores the lost shards of the erasure coded files this node holds shards of
+func repairShards() {
+	for {
+		time.Sleep(consts.RepairInterval)
+		for _, entry := range filemgmt.Catalog().Files() {
+			name := manifest.SourceFile(entry.Name)
+			if name == entry.Name {
+				continue
+			}
+			data, err := getManifest(manifest.Key(name))
+			if err != nil {
+				continue
+			}
+			m, err := manifest.Decode(data)
+			if err != nil || m.Deleted || !m.Coded() {
+				continue
+			}
+			restored, err := transfer.RepairShards(m)
+			if err != nil {
+				fmt.Printf("Unable to repair the shards of %s: %v\n", name, err)
+			}
+			if restored > 0 {
+				fmt.Printf("Restored %d shards of %s\n", restored, name)
+			}
+		}
 	}
-	fmt.Println("Exiting...")
 }